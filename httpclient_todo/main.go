@@ -18,8 +18,17 @@ type ToDoTask struct {
 	Status      string `json:"status"`
 }
 
+// Problem is the server's application/problem+json error body.
+type Problem struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Detail  string `json:"detail"`
+	TraceID string `json:"trace_id"`
+}
+
 func main() {
 	baseURL := "http://localhost:8080"
+	user := "loadtest" // every task goes to this user's list
 	totalRequests := 20000
 	ratePerSec := 300
 
@@ -43,7 +52,7 @@ func main() {
 
 		go func(i int) {
 			defer wg.Done()
-			sendTask(ctx, client, baseURL, i)
+			sendTask(ctx, client, baseURL, user, i)
 		}(i)
 	}
 
@@ -52,7 +61,7 @@ func main() {
 	log.Println("All requests done -->", time.Since(start))
 }
 
-func sendTask(ctx context.Context, client *http.Client, baseURL string, i int) {
+func sendTask(ctx context.Context, client *http.Client, baseURL, user string, i int) {
 	// Build the payload
 	task := ToDoTask{
 		Description: fmt.Sprintf("task-%d", i),
@@ -64,8 +73,8 @@ func sendTask(ctx context.Context, client *http.Client, baseURL string, i int) {
 		return
 	}
 
-	// Create the POST request (so you can attach ctx)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/todo", bytes.NewReader(payload))
+	// Create the POST request (so you can attach ctx), see createTask in /openapi.json
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/todo/users/"+user, bytes.NewReader(payload))
 	if err != nil {
 		log.Printf("ERROR creating request for task %d: %v", i, err)
 		return
@@ -75,17 +84,17 @@ func sendTask(ctx context.Context, client *http.Client, baseURL string, i int) {
 	// Send it
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("ERROR POST /todo failed for task %d: %v", i, err)
+		log.Printf("ERROR POST /todo/users/%s failed for task %d: %v", user, i, err)
 		return
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusCreated {
+		var p Problem
+		json.NewDecoder(resp.Body).Decode(&p)
+		log.Printf("ERROR unexpected status for task %d: got %d %s: %s (trace %s)", i, resp.StatusCode, p.Code, p.Detail, p.TraceID)
+	}
+
 	// Drain the body so connections can be reused
 	io.Copy(io.Discard, resp.Body)
-
-	if resp.StatusCode != http.StatusCreated {
-		log.Printf("ERROR unexpected status for task %d: got %d", i, resp.StatusCode)
-	} /* else {
-		log.Print(i)
-	} */
 }
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"to-do/todo"
+)
+
+// Auth checks API requests, set it before starting the server. nil, the default, lets
+// every request through.
+var Auth *todo.Authenticator
+
+const identityKey ctxKey = "identity"
+
+// IdentityFromContext returns who the request was authenticated as, or nil.
+func IdentityFromContext(ctx context.Context) *todo.Identity {
+	id, _ := ctx.Value(identityKey).(*todo.Identity)
+	return id
+}
+
+// authRequired reports whether requests must carry credentials.
+func authRequired() bool {
+	return Auth != nil && Auth.Required
+}
+
+// WithAuth authenticates the request's bearer token or JWT, puts the identity in the
+// request context and checks it may use the {userID} in the path. It goes inside
+// WithLoggingAndTrace, so its errors carry the trace ID.
+func WithAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authRequired() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		bearer, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		id, err := Auth.Authenticate(strings.TrimSpace(bearer))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="todo"`)
+			writeError(w, err)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), identityKey, id))
+		if err := authorize(r, r.PathValue("userID")); err != nil {
+			writeError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize checks that the request's identity may use user's list. A "" user is
+// always allowed.
+func authorize(r *http.Request, user string) error {
+	if !authRequired() || user == "" {
+		return nil
+	}
+	if id := IdentityFromContext(r.Context()); !id.CanUse(user) {
+		return fmt.Errorf("%w: %s may not use the tasks of %q", todo.ErrForbidden, identityName(id), user)
+	}
+	return nil
+}
+
+// RequireAdmin lets only admin identities through. It goes inside WithAuth.
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := IdentityFromContext(r.Context()); authRequired() && (id == nil || !id.Admin) {
+			writeError(w, fmt.Errorf("%w: %s is not an admin", todo.ErrForbidden, identityName(id)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func identityName(id *todo.Identity) string {
+	if id == nil {
+		return "anonymous"
+	}
+	return fmt.Sprintf("%s (%s)", id.User, id.Via)
+}
+
+// tokenStore is where the admin endpoints keep tokens.
+func tokenStore() (*todo.TokenStore, error) {
+	if Auth == nil || Auth.Tokens == nil {
+		return nil, fmt.Errorf("%w: this server has no token store", todo.ErrUnavailable)
+	}
+	return Auth.Tokens, nil
+}
+
+// TokenRequest is the body of POST /admin/tokens.
+type TokenRequest struct {
+	User  string `json:"user"`
+	Name  string `json:"name"`
+	Admin bool   `json:"admin"`
+}
+
+// IssuedToken is the reply to POST /admin/tokens, the only time Token is shown.
+type IssuedToken struct {
+	todo.APIToken
+	Token string `json:"token"`
+}
+
+// IssueToken creates an API token, see todo.TokenStore.Issue.
+func IssueToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slog.SetDefault(LoggerFromContext(r.Context()))
+		store, err := tokenStore()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		var req TokenRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		secret, tok, err := store.Issue(req.User, req.Name, req.Admin)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		slog.Info("issued API token", "id", tok.ID, "user", tok.User, "admin", tok.Admin, "by", identityName(IdentityFromContext(r.Context())))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(IssuedToken{APIToken: tok, Token: secret})
+	}
+}
+
+// ListTokens returns every API token, without secrets or hashes.
+func ListTokens() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slog.SetDefault(LoggerFromContext(r.Context()))
+		store, err := tokenStore()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		tokens, err := store.List()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokens)
+	}
+}
+
+// RevokeToken deletes the API token {tokenID}.
+func RevokeToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slog.SetDefault(LoggerFromContext(r.Context()))
+		store, err := tokenStore()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := store.Revoke(r.PathValue("tokenID")); err != nil {
+			writeError(w, err)
+			return
+		}
+		slog.Info("revoked API token", "id", r.PathValue("tokenID"), "by", identityName(IdentityFromContext(r.Context())))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
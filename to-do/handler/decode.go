@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"to-do/todo"
+)
+
+// MaxBodyBytes caps every API request body, larger ones get 413. Set it before starting
+// the server.
+var MaxBodyBytes int64 = 1 << 20
+
+// WithBodyLimit makes reading more than MaxBodyBytes of r's body fail.
+func WithBodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+var errTrailingData = errors.New("has more data after the JSON value")
+
+// decodeJSON reads r's body, which must be one application/json value, into v. Unknown
+// fields and anything after the value are rejected. It answers the request itself when
+// it returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeProblem(w, todo.NewProblem(http.StatusUnsupportedMediaType, todo.CodeUnsupportedMediaType, "Content-Type must be application/json"))
+		return false
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		// only whitespace may follow the value
+		if err = dec.Decode(&json.RawMessage{}); err == io.EOF {
+			return true
+		}
+		if !errors.As(err, new(*http.MaxBytesError)) {
+			err = errTrailingData
+		}
+	}
+	writeBodyError(w, err)
+	return false
+}
+
+// writeBodyError answers a request whose body could not be read or decoded: 413 if it
+// was over MaxBodyBytes, otherwise 400 naming the field that was wrong.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeProblem(w, todo.NewProblem(http.StatusRequestEntityTooLarge, todo.CodeTooLarge, fmt.Sprintf("request body is over %d bytes", tooLarge.Limit)))
+		return
+	}
+	var syntax *json.SyntaxError
+	var wrongType *json.UnmarshalTypeError
+	verr := &todo.ValidationError{Field: "body", Reason: err.Error()}
+	switch {
+	case err == io.EOF:
+		verr.Reason = "is empty"
+	case err == io.ErrUnexpectedEOF:
+		verr.Reason = "ends in the middle of the JSON value"
+	case errors.As(err, &syntax):
+		verr.Reason = fmt.Sprintf("is not valid JSON at byte %d: %s", syntax.Offset, strings.TrimPrefix(err.Error(), "json: "))
+	case errors.As(err, &wrongType) && wrongType.Field == "":
+		verr.Reason = "must be a JSON object, not " + wrongType.Value
+	case errors.As(err, &wrongType):
+		verr.Field, verr.Reason = wrongType.Field, fmt.Sprintf("must be a %s, not %s", wrongType.Type, wrongType.Value)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		verr.Field, _ = strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		verr.Reason = "is not a known field"
+	}
+	writeError(w, verr)
+}
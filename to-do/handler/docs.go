@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// OpenAPISpec is the OpenAPI 3 document of the routes in Routes. The contract test in
+// handler_test fails if the two drift apart.
+//
+//go:embed openapi.json
+var OpenAPISpec []byte
+
+//go:embed docs.html
+var docsHTML string
+
+// OpenAPI serves OpenAPISpec.
+func OpenAPI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(OpenAPISpec)
+	}
+}
+
+// Docs serves OpenAPISpec as a single HTML page with no outside assets, so it also
+// works offline. Each operation has a "Try it" form that a small inline script sends to
+// this server.
+func Docs() http.HandlerFunc {
+	page, err := renderDocs()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	}
+}
+
+// The parts of an OpenAPI document the docs page shows.
+type (
+	apiSpec struct {
+		Info struct {
+			Title, Version, Description string
+		}
+		Paths      map[string]map[string]json.RawMessage
+		Components struct {
+			Parameters map[string]apiParam
+			Responses  map[string]apiResponse
+			Schemas    map[string]apiSchema
+		}
+	}
+	apiOperation struct {
+		OperationID string `json:"operationId"`
+		Summary     string
+		Description string
+		Parameters  []apiParam
+		RequestBody *struct {
+			Content map[string]json.RawMessage
+		} `json:"requestBody"`
+		Responses map[string]apiResponse
+	}
+	apiParam struct {
+		Ref         string `json:"$ref"`
+		Name, In    string
+		Description string
+		Required    bool
+		Schema      *apiSchema
+	}
+	apiResponse struct {
+		Ref         string `json:"$ref"`
+		Description string
+		Content     map[string]struct{ Schema *apiSchema }
+	}
+	apiSchema struct {
+		Ref         string `json:"$ref"`
+		Type        string
+		Format      string
+		Description string
+		Items       *apiSchema
+		Properties  map[string]*apiSchema
+	}
+)
+
+// docsPage is what docs.html renders.
+type docsPage struct {
+	Info    struct{ Title, Version, Description string }
+	Ops     []docsOp
+	Schemas []docsSchema
+}
+
+type docsOp struct {
+	ID, Method, Path, Summary, Description string
+	Params                                 []docsParam
+	Body                                   []string // request media types
+	Responses                              []docsResponse
+}
+
+type docsParam struct {
+	Name, In, Type, Description string
+	Required                    bool
+}
+
+type docsResponse struct {
+	Code, Description, Schema string
+}
+
+type docsSchema struct {
+	Name, Description string
+	Props             []docsParam
+}
+
+// methodOrder is the order a path's operations are listed in.
+var methodOrder = []string{"get", "post", "put", "patch", "delete"}
+
+func renderDocs() ([]byte, error) {
+	var spec apiSpec
+	if err := json.Unmarshal(OpenAPISpec, &spec); err != nil {
+		slog.Error("openapi.json does not parse", "error", err)
+		return nil, err
+	}
+	page := docsPage{Info: spec.Info}
+	for _, path := range sortedKeys(spec.Paths) {
+		var shared []apiParam
+		json.Unmarshal(spec.Paths[path]["parameters"], &shared)
+		for _, method := range methodOrder {
+			raw, ok := spec.Paths[path][method]
+			if !ok {
+				continue
+			}
+			var op apiOperation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				return nil, err
+			}
+			entry := docsOp{ID: op.OperationID, Method: method, Path: path, Summary: op.Summary, Description: op.Description}
+			for _, p := range append(append([]apiParam(nil), shared...), op.Parameters...) {
+				if p.Ref != "" {
+					p = spec.Components.Parameters[refName(p.Ref)]
+				}
+				entry.Params = append(entry.Params, docsParam{p.Name, p.In, schemaType(p.Schema), p.Description, p.Required})
+			}
+			if op.RequestBody != nil {
+				entry.Body = sortedKeys(op.RequestBody.Content)
+			}
+			for _, code := range sortedKeys(op.Responses) {
+				resp := op.Responses[code]
+				if resp.Ref != "" {
+					resp = spec.Components.Responses[refName(resp.Ref)]
+				}
+				var schemas []string
+				for _, ct := range sortedKeys(resp.Content) {
+					if t := schemaType(resp.Content[ct].Schema); t != "" && !slices.Contains(schemas, t) {
+						schemas = append(schemas, t)
+					}
+				}
+				entry.Responses = append(entry.Responses, docsResponse{code, resp.Description, strings.Join(schemas, " | ")})
+			}
+			page.Ops = append(page.Ops, entry)
+		}
+	}
+	for _, name := range sortedKeys(spec.Components.Schemas) {
+		s := spec.Components.Schemas[name]
+		entry := docsSchema{Name: name, Description: s.Description}
+		for _, p := range sortedKeys(s.Properties) {
+			entry.Props = append(entry.Props, docsParam{Name: p, Type: schemaType(s.Properties[p]), Description: s.Properties[p].Description})
+		}
+		page.Schemas = append(page.Schemas, entry)
+	}
+
+	var buf bytes.Buffer
+	if err := template.Must(template.New("docs").Parse(docsHTML)).Execute(&buf, page); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// refName is the last element of a "#/components/..." reference.
+func refName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+// schemaType is a short description of s, e.g. "ToDoTask[]" or "string (date)".
+func schemaType(s *apiSchema) string {
+	switch {
+	case s == nil:
+		return ""
+	case s.Ref != "":
+		return refName(s.Ref)
+	case s.Type == "array":
+		return schemaType(s.Items) + "[]"
+	case s.Format != "":
+		return s.Type + " (" + s.Format + ")"
+	}
+	return s.Type
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	return slices.Sorted(maps.Keys(m))
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"to-do/todo"
+)
+
+// statusForError maps the todo package's domain errors to an HTTP status code.
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, todo.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, todo.ErrInvalidInput):
+		return http.StatusBadRequest
+	case errors.Is(err, todo.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, todo.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, todo.ErrQuotaExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, todo.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, todo.ErrUnauthenticated):
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError writes err as a todo.Problem with the status from statusForError, listing
+// any ValidationErrors in it field by field. Storage and unknown errors are not echoed
+// to the client. A cluster follower's todo.NotLeaderError becomes a 307 to the same
+// request on the leader.
+func writeError(w http.ResponseWriter, err error) {
+	var notLeader *todo.NotLeaderError
+	if errors.As(err, &notLeader) {
+		slog.Info("redirecting to the cluster leader", "leader", notLeader.Leader)
+		w.Header().Set("Location", notLeader.Leader+notLeader.Path)
+		writeProblem(w, todo.NewProblem(http.StatusTemporaryRedirect, todo.CodeNotLeader, err.Error()))
+		return
+	}
+	status := statusForError(err)
+	p := todo.NewProblem(status, todo.ErrorCode(err), strings.ReplaceAll(err.Error(), "\n", "; "))
+	if status == http.StatusInternalServerError {
+		p.Detail = "Internal Server Error"
+	}
+	p.Errors = todo.FieldProblems(err)
+	slog.Error("request failed", "status", status, "error", err)
+	writeProblem(w, p)
+}
+
+// notFound is the reply for a path naming no task, e.g. a task index that is not a number.
+func notFound(w http.ResponseWriter, format string, args ...any) {
+	detail := fmt.Sprintf(format, args...)
+	slog.Error("not found", "detail", detail)
+	writeProblem(w, todo.NewProblem(http.StatusNotFound, todo.CodeNotFound, detail))
+}
+
+// writeProblem sends p with the request's trace ID, which WithLoggingAndTrace has put
+// in the response headers.
+func writeProblem(w http.ResponseWriter, p *todo.Problem) {
+	p.TraceID = w.Header().Get("X-Trace-ID")
+	w.Header().Set("Content-Type", todo.ProblemType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// WithProblems turns error replies that next did not write as a todo.Problem, such as
+// the 404 and 405 from http.ServeMux or the file server, into one.
+func WithProblems(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pw := &problemWriter{ResponseWriter: w}
+		next.ServeHTTP(pw, r)
+		if pw.status != 0 {
+			pw.writeProblem()
+		}
+	})
+}
+
+// problemWriter holds back a plain error reply so WithProblems can replace it.
+type problemWriter struct {
+	http.ResponseWriter
+	wrote  bool
+	status int // of the reply held back
+	body   bytes.Buffer
+}
+
+func (pw *problemWriter) WriteHeader(status int) {
+	if pw.wrote || pw.status != 0 {
+		return
+	}
+	ct := pw.Header().Get("Content-Type")
+	if status >= 400 && !strings.HasPrefix(ct, todo.ProblemType) && !strings.HasPrefix(ct, "text/html") {
+		pw.status = status
+		return
+	}
+	pw.wrote = true
+	pw.ResponseWriter.WriteHeader(status)
+}
+
+func (pw *problemWriter) Write(b []byte) (int, error) {
+	if !pw.wrote && pw.status == 0 {
+		pw.WriteHeader(http.StatusOK)
+	}
+	if pw.status != 0 {
+		if pw.body.Len() < 1<<10 {
+			pw.body.Write(b)
+		}
+		return len(b), nil
+	}
+	return pw.ResponseWriter.Write(b)
+}
+
+func (pw *problemWriter) Unwrap() http.ResponseWriter { return pw.ResponseWriter }
+
+func (pw *problemWriter) writeProblem() {
+	code := todo.CodeInternal
+	switch pw.status {
+	case http.StatusNotFound:
+		code = todo.CodeNotFound
+	case http.StatusMethodNotAllowed:
+		code = todo.CodeMethodNotAllowed
+	case http.StatusBadRequest:
+		code = todo.CodeInvalidInput
+	case http.StatusUnsupportedMediaType:
+		code = todo.CodeUnsupportedMediaType
+	case http.StatusRequestEntityTooLarge:
+		code = todo.CodeTooLarge
+	}
+	pw.Header().Del("Content-Length")
+	writeProblem(pw.ResponseWriter, todo.NewProblem(pw.status, code, strings.TrimSpace(pw.body.String())))
+}
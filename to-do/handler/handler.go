@@ -3,9 +3,11 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"expvar"
+	"fmt"
 	"html/template"
-	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"strconv"
 	"sync"
@@ -13,47 +15,114 @@ import (
 	"to-do/todo"
 )
 
-func requestMessage(r *http.Request) *todo.ToDoTask {
-	slog.Debug("request received in handler.requestMessage")
+// requestMessage reads and validates the task in r's body, see decodeJSON and
+// todo.ValidateTask. It answers the request itself when it returns false.
+func requestMessage(w http.ResponseWriter, r *http.Request) (*todo.ToDoTask, bool) {
 	var task todo.ToDoTask
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		slog.Error("could not read request", "Body length", len(body))
-		return nil
+	if !decodeJSON(w, r, &task) {
+		return nil, false
 	}
-	slog.Debug("raw request body", "body", string(body))
-	if json.Unmarshal(body, &task) != nil {
-		slog.Error("Invalid JSON", "Body length", len(body))
-		return nil
+	slog.Debug("request task", "task", task)
+	if err := todo.ValidateTask(task); err != nil {
+		writeError(w, err)
+		return nil, false
 	}
-	slog.Debug("Unmarshal parsed task data ", "task list", task)
-	return &task
+	return &task, true
 }
 
-func RunHttpServer(ctx context.Context, wg *sync.WaitGroup, actor chan todo.Request) {
-	defer wg.Done()
+// taskIndex reads the {id} path value, answering 404 itself if it is not an index.
+func taskIndex(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id := r.PathValue("id")
+	idv, err := strconv.Atoi(id)
+	if err != nil {
+		notFound(w, "no task %q: a task is named by its index, e.g. /todo/users/%s/0", id, r.PathValue("userID"))
+		return 0, false
+	}
+	return idv, true
+}
 
-	mux := http.NewServeMux()
+// ListenAddr is where RunHttpServer listens, set it before starting the server.
+var ListenAddr = ":8080"
+
+// LocalURL is how a CLI or REPL on the same machine reaches the server, see todo.Attach.
+func LocalURL() string {
+	host, port, err := net.SplitHostPort(ListenAddr)
+	if err != nil || host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
 
+// Route is one pattern the server registers.
+type Route struct {
+	Pattern string // http.ServeMux pattern
+	Handler http.Handler
+	Page    bool // an HTML or static page, not part of the API described in openapi.json
+}
+
+// Routes are every route RunHttpServer serves. Each API route must be described in
+// openapi.json.
+func Routes(actor chan todo.Request) []Route {
 	fs := http.FileServer(http.Dir("static"))
-	mux.Handle("/about/", http.StripPrefix("/about/", fs))              //static page
-	mux.Handle("/list", WithLoggingAndTrace(http.HandlerFunc(GetList))) //dyanmic page
+	return []Route{
+		{Pattern: "/about/", Handler: http.StripPrefix("/about/", fs), Page: true}, //static page
+		{Pattern: "/list", Handler: api(GetList(actor)), Page: true},               //dyanmic page
+		{Pattern: "GET /docs", Handler: Docs(), Page: true},
+
+		//APIs
+		{Pattern: "PUT /todo/users/{userID}/{id}", Handler: api(UpdateByID(actor))},
+		{Pattern: "PATCH /todo/users/{userID}/{id}", Handler: api(PatchByID(actor))},
+		{Pattern: "DELETE /todo/users/{userID}/{id}", Handler: api(DeleteByID(actor))},
+		{Pattern: "GET /todo/users/{userID}", Handler: api(http.HandlerFunc(GetAll(actor)))},
+		{Pattern: "GET /todo/users/{userID}/{id}", Handler: api(FindByID(actor))},
+
+		// e.g. POST /todo/users/andrew
+		{Pattern: "POST /todo/users/{userID}", Handler: api(Create(actor))},
+
+		//import and export, e.g. GET /todo/users/andrew/export?format=csv
+		{Pattern: "GET /todo/users/{userID}/export", Handler: api(Export(actor))},
+		{Pattern: "POST /todo/users/{userID}/import", Handler: api(Import(actor))},
+
+		//admin
+		{Pattern: "GET /admin/usage", Handler: admin(AdminUsage(actor))},
+		{Pattern: "GET /admin/tokens", Handler: admin(ListTokens())},
+		{Pattern: "POST /admin/tokens", Handler: admin(IssueToken())},
+		{Pattern: "DELETE /admin/tokens/{tokenID}", Handler: admin(RevokeToken())},
+		{Pattern: "GET /admin/metrics", Handler: admin(expvar.Handler())},
+
+		{Pattern: "GET /openapi.json", Handler: OpenAPI()},
+	}
+}
+
+// api wraps a handler in the middleware of every API route. Tracing is added around the
+// whole mux by NewMux.
+func api(h http.Handler) http.Handler {
+	return WithIPRateLimit(WithAuth(WithRateLimit(WithBodyLimit(h))))
+}
+
+// admin is api for routes only admins may use.
+func admin(h http.Handler) http.Handler {
+	return api(RequireAdmin(h))
+}
 
-	//APIs
-	mux.Handle("PUT /todo/users/{userID}/{id}", WithLoggingAndTrace(UpdateByID(actor)))
-	mux.Handle("DELETE /todo/users/{userID}/{id}", WithLoggingAndTrace(DeleteByID(actor)))
-	mux.Handle("GET /todo/users/{userID}", WithLoggingAndTrace(http.HandlerFunc(GetAll(actor))))
-	//mux.Handle("POST /todo", WithLoggingAndTrace(Create(actor)))
-	mux.Handle("GET /todo/users/{userID}/{id}", WithLoggingAndTrace(FindByID(actor)))
+// NewMux registers Routes on a new mux, with every error reply a todo.Problem. The trace
+// middleware goes outside, so the mux's own 404 and 405 replies carry a trace ID too.
+func NewMux(actor chan todo.Request) http.Handler {
+	mux := http.NewServeMux()
+	for _, r := range Routes(actor) {
+		mux.Handle(r.Pattern, r.Handler)
+	}
+	return WithLoggingAndTrace(WithProblems(mux))
+}
 
-	// e.g. POST /users/{userID}/todo
-	mux.Handle("POST /todo/users/{userID}", WithLoggingAndTrace(Create(actor)))
+func RunHttpServer(ctx context.Context, wg *sync.WaitGroup, actor chan todo.Request) {
+	defer wg.Done()
 
-	server := &http.Server{Addr: ":8080", Handler: mux}
+	server := &http.Server{Addr: ListenAddr, Handler: NewMux(actor)}
 	go func() {
-		slog.Info("Http Server listining on port :8080")
+		slog.Info("Http Server listining on port " + ListenAddr)
 		if err := server.ListenAndServe(); err != nil {
-			slog.Error("Error Listining to port 8080", "server", err)
+			slog.Error("Error Listining to port "+ListenAddr, "server", err)
 		}
 		slog.Info("HTTPServer ListenAndServe goroutine stopped")
 	}()
@@ -85,10 +154,8 @@ func Create(actor chan todo.Request) http.HandlerFunc {
 		user := r.PathValue("userID")
 
 		slog.Info("received request to create a todo", "user", user)
-		task := requestMessage(r)
-		if task == nil {
-			slog.Error("Invalid task:", "task", task)
-			http.Error(w, `{"error":"could not read request"}`, http.StatusBadRequest)
+		task, ok := requestMessage(w, r)
+		if !ok {
 			return
 		}
 		//slog.Debug("sending add command", "task", task)
@@ -97,8 +164,7 @@ func Create(actor chan todo.Request) http.HandlerFunc {
 		res := <-reply
 		//slog.Debug("received actor response", "response", res)
 		if res.Err != nil {
-			slog.Error("Invalid task:", "task", task)
-			http.Error(w, `{"error":"could not read request"}`, http.StatusInternalServerError)
+			writeError(w, res.Err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -114,42 +180,28 @@ func UpdateByID(actor chan todo.Request) http.HandlerFunc {
 		slog.Info("received request to update todo item")
 		user := r.PathValue("userID")
 
-		task := requestMessage(r)
-		if task == nil {
-			slog.Error("Invalid task:", "task", task)
-			http.Error(w, `{"error":"could not read request"}`, http.StatusBadRequest)
+		task, ok := requestMessage(w, r)
+		if !ok {
 			return
 		}
 
-		id := r.PathValue("id")
-		if id != "" { //create and findAll
-			idv, err := strconv.Atoi(id)
-			if err != nil {
-				slog.Error("invalid index parameter", "raw", id, "error", err)
-				http.Error(w, `{"error":"Task not found"}`, http.StatusNotFound)
-				return
-			}
-
-			//reply := make(chan todo.Response)
-			//actor <- todo.Request{Op: "update", UserID: user, Task: *task, Index: idv, ReplyCh: reply}
-			//res := <-reply
-			//slog.Debug("received actor response", "response", res)
+		idv, ok := taskIndex(w, r)
+		if !ok {
+			return
+		}
 
-			if Send(actor, "update", user, idv, *task).Err != nil {
-				slog.Error("Invalid task:", "index", id)
-				http.Error(w, `{"error":"could not read request"}`, http.StatusInternalServerError)
-				return
-			}
+		//reply := make(chan todo.Response)
+		//actor <- todo.Request{Op: "update", UserID: user, Task: *task, Index: idv, ReplyCh: reply}
+		//res := <-reply
+		//slog.Debug("received actor response", "response", res)
 
-		} else {
-			slog.Error("no index parameter", "index", id)
-			http.Error(w, `{"error":"Task not found"}`, http.StatusNotFound)
+		if err := Send(actor, "update", user, idv, *task).Err; err != nil {
+			writeError(w, err)
 			return
 		}
 
 		if err := json.NewEncoder(w).Encode(task); err != nil {
 			slog.Error("Failed to encode task response", "error", err)
-			http.Error(w, `{"error":"Internal Server Error"}`, http.StatusInternalServerError)
 			return
 		}
 		//	w.Header().Set("Content-Type", "application/json")
@@ -165,27 +217,16 @@ func DeleteByID(actor chan todo.Request) http.HandlerFunc {
 		slog.Info("received request to delete a todo item")
 		user := r.PathValue("userID")
 
-		id := r.PathValue("id")
-		if id != "" { //create and findAll
-			idv, err := strconv.Atoi(id)
-			if err != nil {
-				slog.Error("invalid index parameter", "raw", id, "error", err)
-				http.Error(w, `{"error":"Task not found"}`, http.StatusNotFound)
-				return
-			}
-
-			reply := make(chan todo.Response)
-			actor <- todo.Request{Op: "delete", UserID: user, Index: idv, ReplyCh: reply}
-			res := <-reply
-			slog.Debug("received actor response", "response", res)
-			if res.Err != nil {
-				slog.Error("Invalid task:", "index", id)
-				http.Error(w, `{"error":"could not read request"}`, http.StatusInternalServerError)
-				return
-			}
-		} else {
-			slog.Error("no index parameter", "index", id)
-			http.Error(w, `{"error":"Task not found"}`, http.StatusNotFound)
+		idv, ok := taskIndex(w, r)
+		if !ok {
+			return
+		}
+		reply := make(chan todo.Response)
+		actor <- todo.Request{Op: "delete", UserID: user, Index: idv, ReplyCh: reply}
+		res := <-reply
+		slog.Debug("received actor response", "response", res)
+		if res.Err != nil {
+			writeError(w, res.Err)
 			return
 		}
 
@@ -201,19 +242,8 @@ func FindByID(actor chan todo.Request) http.HandlerFunc {
 		user := r.PathValue("userID")
 
 		slog.Debug("received request to find todo item", "user", user)
-		var intIndex int
-		id := r.PathValue("id")
-		if id != "" {
-			idv, err := strconv.Atoi(id)
-			intIndex = idv
-			if err != nil {
-				slog.Error("invalid index parameter", "raw", id, "error", err)
-				http.Error(w, `{"error":"Task not found"}`, http.StatusNotFound)
-				return
-			}
-		} else {
-			slog.Error("no index parameter", "index", id)
-			http.Error(w, `{"error":"Task not found"}`, http.StatusNotFound)
+		intIndex, ok := taskIndex(w, r)
+		if !ok {
 			return
 		}
 		reply := make(chan todo.Response)
@@ -221,32 +251,47 @@ func FindByID(actor chan todo.Request) http.HandlerFunc {
 		res := <-reply
 		slog.Debug("received actor response", "response", res.Task)
 		if res.Err != nil {
-			slog.Error("Invalid task:", "index", id)
-			http.Error(w, `{"error":"could not read request"}`, http.StatusInternalServerError)
+			writeError(w, res.Err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(res.Task)
-		slog.Info("returned one task", "index", id, "task", res.Task)
+		slog.Info("returned one task", "index", intIndex, "task", res.Task)
 		slog.Debug("Request timings", "method", r.Method, "Url", r.RequestURI, "time", time.Since(start).Milliseconds())
 	}
 }
 
+// GetAll returns the user's tasks. With any of limit, cursor, status, tag, due_from,
+// due_to, q or fields it returns one filtered page instead, see writePage.
 func GetAll(actor chan todo.Request) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		slog.SetDefault(LoggerFromContext(r.Context()))
 		//slog.Info("received request to fetch all todo list")
 		user := r.PathValue("userID")
 
+		if isQuery(r) {
+			lq, err := parseListQuery(r)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			page, err := todo.QueryTasks(actor, user, lq.Query)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writePage(w, r, lq, page)
+			return
+		}
+
 		reply := make(chan todo.Response)
 		actor <- todo.Request{Op: "list", UserID: user, ReplyCh: reply}
 		res := <-reply
 		//slog.Debug("received actor response", "response", res.Tasks)
 		if res.Err != nil {
-			slog.Error("Internal error:")
-			http.Error(w, `{"error":"could not read request"}`, http.StatusInternalServerError)
+			writeError(w, res.Err)
 			return
 		}
 
@@ -256,25 +301,51 @@ func GetAll(actor chan todo.Request) http.HandlerFunc {
 	}
 }
 
-func GetList(w http.ResponseWriter, r *http.Request) {
-	slog.SetDefault(LoggerFromContext(r.Context()))
-	slog.Info("received request to list all todo items")
-
-	todoList, err := todo.LoadFile(todo.TodoFile)
-	if err != nil {
-		slog.Error("Failed to load tasks", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	tmpl, err := template.ParseFiles("dynamic/list.html")
-	if err != nil {
-		http.Error(w, "Template error", http.StatusInternalServerError)
-		slog.Error("template parse failed", "error", err)
-		return
+// AdminUsage reports every user's task count and recent operations against the configured limits.
+func AdminUsage(actor chan todo.Request) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slog.SetDefault(LoggerFromContext(r.Context()))
+		report, err := todo.GetUsage(actor)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(report)
 	}
+}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	if err := tmpl.Execute(w, todoList); err != nil {
-		slog.Error("template execute failed", "error", err)
+// GetList renders a user's tasks as HTML, e.g. /list?user=andrew (default user "default").
+// The tasks come from the actor, so the page shows the same data directory as the API.
+func GetList(actor chan todo.Request) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slog.SetDefault(LoggerFromContext(r.Context()))
+		user := r.URL.Query().Get("user")
+		if user == "" {
+			user = "default"
+		}
+		slog.Info("received request to list all todo items", "user", user)
+		if err := authorize(r, user); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		res := Send(actor, "list", user, 0, todo.ToDoTask{})
+		if res.Err != nil {
+			slog.Error("Failed to load tasks", "error", res.Err)
+			writeError(w, res.Err)
+			return
+		}
+		tmpl, err := template.ParseFiles("dynamic/list.html")
+		if err != nil {
+			writeError(w, fmt.Errorf("template: %w", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := tmpl.Execute(w, res.Tasks); err != nil {
+			slog.Error("template execute failed", "error", err)
+		}
 	}
 }
@@ -3,11 +3,16 @@ package handler_test
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -118,3 +123,755 @@ func TestHTTPActorConcurrencyOn8080(t *testing.T) {
 		t.Fatalf("expected %d tasks, got %d", n, len(tasks))
 	}
 }
+
+// brokenUserStore fails every save for the user "broken".
+type brokenUserStore struct {
+	*todo.MemStore
+}
+
+func (s brokenUserStore) Save(user string, tasks []todo.ToDoTask) error {
+	if user == "broken" {
+		return fmt.Errorf("disk full")
+	}
+	return s.MemStore.Save(user, tasks)
+}
+
+func TestErrorStatusCodes(t *testing.T) {
+	reqs := make(chan todo.Request)
+	defer close(reqs)
+	cfg := todo.DefaultConfig()
+	cfg.Store = brokenUserStore{todo.NewMemStore()}
+	go todo.RunActor(reqs, map[string][]todo.ToDoTask{"u": {{Description: "one", Status: "started"}}}, cfg)
+
+	mux := http.NewServeMux()
+	mux.Handle("PUT /todo/users/{userID}/{id}", handler.UpdateByID(reqs))
+	mux.Handle("DELETE /todo/users/{userID}/{id}", handler.DeleteByID(reqs))
+	mux.Handle("GET /todo/users/{userID}/{id}", handler.FindByID(reqs))
+	mux.Handle("POST /todo/users/{userID}", handler.Create(reqs))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"get existing", http.MethodGet, "/todo/users/u/0", "", http.StatusOK},
+		{"get out of range", http.MethodGet, "/todo/users/u/7", "", http.StatusNotFound},
+		{"update out of range", http.MethodPut, "/todo/users/u/7", `{"description":"x","status":"started"}`, http.StatusNotFound},
+		{"delete out of range", http.MethodDelete, "/todo/users/u/7", "", http.StatusNotFound},
+		{"storage failure", http.MethodPost, "/todo/users/broken", `{"description":"x"}`, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s: expected %d, got %d (%s)", tt.method, tt.path, tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	reqs := make(chan todo.Request)
+	defer close(reqs)
+	cfg := todo.DefaultConfig()
+	cfg.Store = todo.NewMemStore()
+	go todo.RunActor(reqs, map[string][]todo.ToDoTask{"u": {{Description: "one", Status: "started"}}}, cfg)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /todo/users/{userID}/export", handler.Export(reqs))
+	mux.Handle("POST /todo/users/{userID}/import", handler.Import(reqs))
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/todo/users/u/export?format=markdown", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "- [ ] one status:started\n" {
+		t.Fatalf("export: %d %q", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/markdown") {
+		t.Errorf("export Content-Type = %q", ct)
+	}
+	if rec := do(http.MethodGet, "/todo/users/u/export?format=pdf", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: expected 400, got %d", rec.Code)
+	}
+
+	body := "- [x] two\nnot a task\n"
+	rec = do(http.MethodPost, "/todo/users/u/import?format=markdown&dry_run=true", body)
+	var report todo.ImportReport
+	json.NewDecoder(rec.Body).Decode(&report)
+	if rec.Code != http.StatusOK || report.Parsed != 1 || len(report.Problems) != 1 || report.Result != 2 {
+		t.Fatalf("dry run: %d %+v", rec.Code, report)
+	}
+	if got := do(http.MethodGet, "/todo/users/u/export?format=csv", "").Body.String(); got != "description,status\none,started\n" {
+		t.Fatalf("dry run changed the list: %q", got)
+	}
+
+	if rec := do(http.MethodPost, "/todo/users/u/import?format=markdown", body); rec.Code != http.StatusCreated {
+		t.Fatalf("import: %d %s", rec.Code, rec.Body.String())
+	}
+	if got := do(http.MethodGet, "/todo/users/u/export?format=todotxt", "").Body.String(); got != "one status:started\nx two\n" {
+		t.Errorf("after import got %q", got)
+	}
+}
+
+func TestAttachRoutesThroughServer(t *testing.T) {
+	reqs := make(chan todo.Request)
+	defer close(reqs)
+	cfg := todo.DefaultConfig()
+	cfg.Store = todo.NewMemStore()
+	go todo.RunActor(reqs, map[string][]todo.ToDoTask{"u": {{Description: "one", Status: "started"}}}, cfg)
+
+	mux := http.NewServeMux()
+	mux.Handle("PUT /todo/users/{userID}/{id}", handler.UpdateByID(reqs))
+	mux.Handle("PATCH /todo/users/{userID}/{id}", handler.PatchByID(reqs))
+	mux.Handle("DELETE /todo/users/{userID}/{id}", handler.DeleteByID(reqs))
+	mux.Handle("GET /todo/users/{userID}", handler.GetAll(reqs))
+	mux.Handle("GET /todo/users/{userID}/{id}", handler.FindByID(reqs))
+	mux.Handle("POST /todo/users/{userID}", handler.Create(reqs))
+	mux.Handle("POST /todo/users/{userID}/import", handler.Import(reqs))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	dir := t.TempDir()
+	lock, err := todo.ClaimDir(dir, todo.Owner{Kind: todo.OwnerServer, Addr: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+
+	client := todo.DefaultConfig()
+	client.DataDir = dir
+	client.ServerMode = todo.ServerRefuse
+	if _, _, err := todo.Attach(&client, todo.OwnerCLI); !errors.Is(err, todo.ErrConflict) || !strings.Contains(err.Error(), ts.URL) {
+		t.Fatalf("refuse mode: expected a conflict naming the server, got %v", err)
+	}
+
+	client.ServerMode = todo.ServerRoute
+	remote, release, err := todo.Attach(&client, todo.OwnerCLI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if client.Remote != ts.URL {
+		t.Errorf("Remote = %q, want %q", client.Remote, ts.URL)
+	}
+
+	res := handler.Send(remote, "add", "u", 0, todo.ToDoTask{Description: "two", Status: "not started"})
+	if res.Err != nil || res.Task.Description != "two" {
+		t.Fatalf("add: %+v", res)
+	}
+	if res := handler.Send(remote, "delete", "u", 7, todo.ToDoTask{}); !errors.Is(res.Err, todo.ErrNotFound) {
+		t.Errorf("delete out of range: expected ErrNotFound, got %v", res.Err)
+	}
+	done := "completed"
+	if task, err := todo.PatchTask(remote, "u", 1, todo.TaskPatch{Status: &done}); err != nil || *task != (todo.ToDoTask{Description: "two", Status: "completed"}) {
+		t.Errorf("patch: %+v %v", task, err)
+	}
+	if err := todo.Replace(remote, "u", []todo.ToDoTask{{Description: "three", Status: "completed"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := todo.Flush(remote); err != nil {
+		t.Fatal(err)
+	}
+	// the server's actor saw every change
+	got := handler.Send(reqs, "list", "u", 0, todo.ToDoTask{}).Tasks
+	if len(got) != 1 || got[0] != (todo.ToDoTask{Description: "three", Status: "completed"}) {
+		t.Errorf("server list = %+v", got)
+	}
+}
+
+func TestClusterFollowerWrites(t *testing.T) {
+	for _, mode := range []string{todo.FollowersForward, todo.FollowersRedirect} {
+		t.Run(mode, func(t *testing.T) {
+			leader, follower := startHTTPCluster(t, mode)
+			noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+			resp, err := noFollow.Post(follower+"/todo/users/u", "application/json", strings.NewReader(`{"description":"a"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if mode == todo.FollowersForward && resp.StatusCode != http.StatusCreated {
+				t.Fatalf("POST to follower: expected 201, got %d", resp.StatusCode)
+			}
+			if mode == todo.FollowersRedirect {
+				if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != leader+"/todo/users/u" {
+					t.Fatalf("POST to follower: expected a 307 to the leader, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+				}
+				// a client that follows redirects lands on the leader
+				if resp, err = http.Post(follower+"/todo/users/u", "application/json", strings.NewReader(`{"description":"a"}`)); err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusCreated {
+					t.Fatalf("POST following the redirect: expected 201, got %d", resp.StatusCode)
+				}
+			}
+
+			resp, err = http.Get(leader + "/todo/users/u")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var tasks []todo.ToDoTask
+			json.NewDecoder(resp.Body).Decode(&tasks)
+			if len(tasks) != 1 || tasks[0].Description != "a" {
+				t.Errorf("leader has %+v", tasks)
+			}
+		})
+	}
+}
+
+// startHTTPCluster runs a two node cluster, each node behind its own test server, and
+// returns the leader's and the follower's URL once a leader is elected.
+func startHTTPCluster(t *testing.T, followers string) (leader, follower string) {
+	var peers []todo.ClusterPeer
+	var servers []*httptest.Server
+	muxes := make([]*http.ServeMux, 2)
+	for i := range muxes {
+		i := i
+		muxes[i] = http.NewServeMux()
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { muxes[i].ServeHTTP(w, r) }))
+		t.Cleanup(ts.Close)
+		servers = append(servers, ts)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers = append(peers, todo.ClusterPeer{ID: fmt.Sprintf("n%d", i), RaftAddr: l.Addr().String(), URL: ts.URL})
+		l.Close()
+	}
+	var nodes []*todo.Cluster
+	for i, p := range peers {
+		cfg := todo.DefaultConfig()
+		cfg.Store = todo.NewMemStore()
+		cfg.DataDir = t.TempDir()
+		cfg.Cluster = todo.ClusterConfig{NodeID: p.ID, Peers: peers, Followers: followers, Reads: todo.ReadsLocal}
+		c, err := todo.StartCluster(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Shutdown() })
+		nodes = append(nodes, c)
+		muxes[i].Handle("GET /todo/users/{userID}", handler.GetAll(c.Actor()))
+		muxes[i].Handle("POST /todo/users/{userID}", handler.Create(c.Actor()))
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		for i, c := range nodes {
+			if c.IsLeader() {
+				return servers[i].URL, servers[1-i].URL
+			}
+		}
+	}
+	t.Fatal("no leader elected")
+	return "", ""
+}
+
+func TestListPagination(t *testing.T) {
+	var tasks []todo.ToDoTask
+	for i := 0; i < 7; i++ {
+		tasks = append(tasks, todo.ToDoTask{Description: fmt.Sprintf("task %d #even=%v", i, i%2 == 0), Status: "started"})
+	}
+	tasks[3].Description += " #urgent due:2025-06-01"
+	reqs := make(chan todo.Request)
+	defer close(reqs)
+	cfg := todo.DefaultConfig()
+	cfg.Store = todo.NewMemStore()
+	go todo.RunActor(reqs, map[string][]todo.ToDoTask{"u": tasks}, cfg)
+	mux := http.NewServeMux()
+	mux.Handle("GET /todo/users/{userID}", handler.GetAll(reqs))
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	// walk every page by following the Link header
+	var seen []string
+	path := "/todo/users/u?limit=3&fields=index,description"
+	for pages := 0; path != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		rec := get(path)
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Total-Count") != "7" {
+			t.Fatalf("GET %s: %d, total %q", path, rec.Code, rec.Header().Get("X-Total-Count"))
+		}
+		var items []map[string]any
+		json.NewDecoder(rec.Body).Decode(&items)
+		for _, item := range items {
+			if len(item) != 2 {
+				t.Errorf("fields=index,description returned %v", item)
+			}
+			seen = append(seen, fmt.Sprint(item["index"]))
+		}
+		path = ""
+		if link := rec.Header().Get("Link"); link != "" {
+			path = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+	if got := strings.Join(seen, ","); got != "0,1,2,3,4,5,6" {
+		t.Errorf("pages returned indexes %s", got)
+	}
+
+	rec := get("/todo/users/u?tag=urgent&due_from=2025-06-01&due_to=2025-06-30&fields=due,tags")
+	var items []map[string]any
+	json.NewDecoder(rec.Body).Decode(&items)
+	if len(items) != 1 || items[0]["due"] != "2025-06-01" || rec.Header().Get("Link") != "" {
+		t.Errorf("tag and due filter: %d %v", rec.Code, items)
+	}
+
+	first := get("/todo/users/u?limit=2&status=started")
+	cursor := strings.Split(strings.Split(first.Header().Get("Link"), "cursor=")[1], "&")[0]
+	for _, bad := range []string{"?limit=0", "?limit=5000", "?fields=secret", "?due_from=tomorrow", "?cursor=junk", "?limit=2&cursor=" + cursor} {
+		if rec := get("/todo/users/u" + bad); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: expected 400, got %d", bad, rec.Code)
+		}
+	}
+
+	// without query parameters the whole list comes back as before
+	var all []todo.ToDoTask
+	json.NewDecoder(get("/todo/users/u").Body).Decode(&all)
+	if len(all) != 7 {
+		t.Errorf("plain list has %d tasks", len(all))
+	}
+}
+
+func TestPatchByID(t *testing.T) {
+	reqs := make(chan todo.Request)
+	defer close(reqs)
+	cfg := todo.DefaultConfig()
+	cfg.Store = todo.NewMemStore()
+	go todo.RunActor(reqs, map[string][]todo.ToDoTask{"u": {{Description: "paint fence", Status: "not started"}}}, cfg)
+	mux := http.NewServeMux()
+	mux.Handle("PATCH /todo/users/{userID}/{id}", handler.PatchByID(reqs))
+	patch := func(contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/todo/users/u/0", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := patch(handler.MergePatchType, `{"status":"completed"}`)
+	var got todo.ToDoTask
+	json.NewDecoder(rec.Body).Decode(&got)
+	if rec.Code != http.StatusOK || got != (todo.ToDoTask{Description: "paint fence", Status: "completed"}) {
+		t.Errorf("merge patch: %d %+v", rec.Code, got)
+	}
+
+	jsonPatch := `[{"op":"test","path":"/status","value":"completed"},{"op":"replace","path":"/description","value":"paint gate"}]`
+	if rec := patch(handler.JSONPatchType, jsonPatch); rec.Code != http.StatusOK {
+		t.Errorf("JSON patch: %d %s", rec.Code, rec.Body)
+	}
+	stale := `[{"op":"test","path":"/description","value":"paint fence"},{"op":"replace","path":"/status","value":"started"}]`
+	if rec := patch(handler.JSONPatchType, stale); rec.Code != http.StatusConflict {
+		t.Errorf("failed test op: expected 409, got %d", rec.Code)
+	}
+	if rec := patch(handler.MergePatchType, `{"status":null}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("null status: expected 400, got %d", rec.Code)
+	}
+	if rec := patch("application/json", `{"status":"started"}`); rec.Code != http.StatusUnsupportedMediaType || rec.Header().Get("Accept-Patch") == "" {
+		t.Errorf("plain JSON: expected 415 with Accept-Patch, got %d", rec.Code)
+	}
+
+	t1, _ := todo.PatchTask(reqs, "u", 0, todo.TaskPatch{})
+	if *t1 != (todo.ToDoTask{Description: "paint gate", Status: "completed"}) {
+		t.Errorf("task after patches: %+v", *t1)
+	}
+}
+
+func TestProblemResponses(t *testing.T) {
+	reqs := make(chan todo.Request)
+	defer close(reqs)
+	cfg := todo.DefaultConfig()
+	cfg.Store = todo.NewMemStore()
+	go todo.RunActor(reqs, map[string][]todo.ToDoTask{"u": {{Description: "one", Status: "started"}}}, cfg)
+	mux := http.NewServeMux()
+	mux.Handle("GET /todo/users/{userID}", handler.GetAll(reqs))
+	mux.Handle("GET /todo/users/{userID}/{id}", handler.FindByID(reqs))
+	mux.Handle("POST /todo/users/{userID}", handler.Create(reqs))
+	mux.Handle("PATCH /todo/users/{userID}/{id}", handler.PatchByID(reqs))
+	// as NewMux does it, so the mux's own 404 and 405 are traced too
+	ts := httptest.NewServer(handler.WithLoggingAndTrace(handler.WithProblems(mux)))
+	defer ts.Close()
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		code               string
+		fields             []string
+	}{
+		{"GET", "/todo/users/u/first", "", http.StatusNotFound, todo.CodeNotFound, nil},
+		{"GET", "/todo/users/u/5", "", http.StatusNotFound, todo.CodeNotFound, nil},
+		{"GET", "/todo/users/u?limit=0&fields=secret", "", http.StatusBadRequest, todo.CodeInvalidInput, []string{"limit", "fields"}},
+		{"POST", "/todo/users/u", "{", http.StatusBadRequest, todo.CodeInvalidInput, []string{"body"}},
+		{"DELETE", "/todo/users/u", "", http.StatusMethodNotAllowed, todo.CodeMethodNotAllowed, nil},
+		{"GET", "/nowhere", "", http.StatusNotFound, todo.CodeNotFound, nil},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+		req.Header.Set("X-Trace-ID", "trace-test")
+		if tt.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p todo.Problem
+		json.NewDecoder(resp.Body).Decode(&p)
+		resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != todo.ProblemType || resp.StatusCode != tt.status || p.Status != tt.status || p.Code != tt.code || p.Detail == "" {
+			t.Errorf("%s %s: %d %s %+v", tt.method, tt.path, resp.StatusCode, ct, p)
+		}
+		var fields []string
+		for _, f := range p.Errors {
+			fields = append(fields, f.Field)
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%s %s: fields %v, want %v", tt.method, tt.path, fields, tt.fields)
+		}
+		if p.TraceID != "trace-test" {
+			t.Errorf("%s %s: trace_id %q", tt.method, tt.path, p.TraceID)
+		}
+	}
+
+	// the client side turns a problem back into typed errors
+	remote := todo.RemoteActor(ts.URL, "")
+	defer close(remote)
+	empty := ""
+	_, err := todo.PatchTask(remote, "u", 0, todo.TaskPatch{Status: &empty})
+	var verr *todo.ValidationError
+	var rerr *todo.RemoteError
+	if !errors.Is(err, todo.ErrInvalidInput) || !errors.As(err, &verr) || verr.Field != "status" || !errors.As(err, &rerr) || rerr.TraceID == "" {
+		t.Errorf("remote patch: %#v", err)
+	}
+	done := "completed"
+	if _, err := todo.PatchTask(remote, "u", 9, todo.TaskPatch{Status: &done}); !errors.Is(err, todo.ErrNotFound) {
+		t.Errorf("remote patch of a missing task: expected ErrNotFound, got %v", err)
+	}
+}
+
+// TestOpenAPIContract fails when a route is added, removed or renamed without the same
+// change to openapi.json, or when a documented schema no longer matches its Go type.
+func TestOpenAPIContract(t *testing.T) {
+	var spec struct {
+		Paths      map[string]map[string]json.RawMessage
+		Components struct {
+			Schemas map[string]struct{ Properties map[string]json.RawMessage }
+		}
+	}
+	if err := json.Unmarshal(handler.OpenAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	documented := map[string]bool{}
+	for path, ops := range spec.Paths {
+		for method := range ops {
+			if method != "parameters" {
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+	for _, r := range handler.Routes(nil) {
+		if r.Page {
+			continue
+		}
+		if !documented[r.Pattern] {
+			t.Errorf("route %q is not in openapi.json", r.Pattern)
+		}
+		delete(documented, r.Pattern)
+	}
+	for op := range documented {
+		t.Errorf("openapi.json documents %q, which is not a route", op)
+	}
+
+	for name, v := range map[string]any{
+		"ToDoTask": todo.ToDoTask{}, "ImportReport": todo.ImportReport{}, "UsageReport": todo.UsageReport{},
+		"Limits": todo.Limits{}, "Usage": todo.Usage{}, "Problem": todo.Problem{}, "FieldProblem": todo.FieldProblem{},
+		"TokenRequest": handler.TokenRequest{},
+	} {
+		var want []string
+		typ := reflect.TypeOf(v)
+		for i := 0; i < typ.NumField(); i++ {
+			want = append(want, strings.Split(typ.Field(i).Tag.Get("json"), ",")[0])
+		}
+		var got []string
+		for prop := range spec.Components.Schemas[name].Properties {
+			got = append(got, prop)
+		}
+		sort.Strings(want)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("schema %s has properties %v, %T has %v", name, got, v, want)
+		}
+	}
+
+	ts := httptest.NewServer(handler.NewMux(nil))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Contains(page, []byte(`id="patchTask"`)) || !bytes.Contains(page, []byte(`<form data-method="patch" data-path="/todo/users/{userID}/{id}">`)) {
+		t.Errorf("GET /docs: %d, %d bytes", resp.StatusCode, len(page))
+	}
+	resp, err = http.Get(ts.URL + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(served, handler.OpenAPISpec) {
+		t.Error("GET /openapi.json does not serve the document")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	reqs := make(chan todo.Request)
+	defer close(reqs)
+	cfg := todo.DefaultConfig()
+	cfg.Store = todo.NewMemStore()
+	cfg.DataDir = t.TempDir()
+	cfg.Auth = todo.AuthConfig{Mode: todo.AuthRequired, JWTSecret: "s3cret"}
+	go todo.RunActor(reqs, map[string][]todo.ToDoTask{"u": {{Description: "one", Status: "started"}}, "v": {}}, cfg)
+	handler.Auth = todo.NewAuthenticator(cfg)
+	defer func() { handler.Auth = nil }()
+	ts := httptest.NewServer(handler.NewMux(reqs))
+	defer ts.Close()
+
+	userToken, _, err := handler.Auth.Tokens.Issue("u", "test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminJWT, _ := todo.SignJWT([]byte("s3cret"), todo.JWTClaims{Subject: "ops", Admin: true, ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	do := func(method, path, bearer, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	tests := []struct {
+		method, path, bearer string
+		status               int
+	}{
+		{"GET", "/todo/users/u", "", http.StatusUnauthorized},
+		{"GET", "/todo/users/u", "todo_0000_nope", http.StatusUnauthorized},
+		{"GET", "/todo/users/u", userToken, http.StatusOK},
+		{"GET", "/todo/users/v", userToken, http.StatusForbidden},
+		{"GET", "/todo/users/v", adminJWT, http.StatusOK},
+		{"GET", "/admin/usage", userToken, http.StatusForbidden},
+		{"GET", "/admin/usage", adminJWT, http.StatusOK},
+		{"GET", "/openapi.json", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp := do(tt.method, tt.path, tt.bearer, "")
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s with %.12q: %d, want %d", tt.method, tt.path, tt.bearer, resp.StatusCode, tt.status)
+		}
+		if tt.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s: 401 without WWW-Authenticate", tt.method, tt.path)
+		}
+	}
+
+	// an admin issues a token over the API, the client uses it, then it is revoked
+	resp := do("POST", "/admin/tokens", adminJWT, `{"user":"v","name":"ci"}`)
+	var issued handler.IssuedToken
+	json.NewDecoder(resp.Body).Decode(&issued)
+	if resp.StatusCode != http.StatusCreated || issued.Token == "" || issued.User != "v" {
+		t.Fatalf("issue: %d %+v", resp.StatusCode, issued)
+	}
+	remote := todo.RemoteActor(ts.URL, issued.Token)
+	defer close(remote)
+	if res := handler.Send(remote, "add", "v", 0, todo.ToDoTask{Description: "two"}); res.Err != nil {
+		t.Errorf("remote add with token: %v", res.Err)
+	}
+	if res := handler.Send(remote, "list", "u", 0, todo.ToDoTask{}); !errors.Is(res.Err, todo.ErrForbidden) {
+		t.Errorf("remote list of another user: expected ErrForbidden, got %v", res.Err)
+	}
+	if resp := do("DELETE", "/admin/tokens/"+issued.ID, adminJWT, ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("revoke: %d", resp.StatusCode)
+	}
+	if res := handler.Send(remote, "list", "v", 0, todo.ToDoTask{}); !errors.Is(res.Err, todo.ErrUnauthenticated) {
+		t.Errorf("remote list with a revoked token: expected ErrUnauthenticated, got %v", res.Err)
+	}
+	var tokens []todo.APIToken
+	json.NewDecoder(do("GET", "/admin/tokens", adminJWT, "").Body).Decode(&tokens)
+	if len(tokens) != 1 || tokens[0].Hash != "" {
+		t.Errorf("tokens after revoke: %+v", tokens)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	reqs := make(chan todo.Request)
+	defer close(reqs)
+	cfg := todo.DefaultConfig()
+	cfg.Store = todo.NewMemStore()
+	go todo.RunActor(reqs, map[string][]todo.ToDoTask{"u": {{Description: "one", Status: "started"}}}, cfg)
+	handler.RateLimits = handler.NewRateLimiter(todo.RateLimitConfig{
+		Reads:  todo.RateClass{PerSecond: 0.5, Burst: 2},
+		Writes: todo.RateClass{PerSecond: 0.5, Burst: 1},
+		Idle:   500 * time.Millisecond,
+	})
+	defer func() { handler.RateLimits = nil }()
+	mux := handler.NewMux(reqs)
+	do := func(method, path, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"description":"two"}`))
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	counter := func(name string) int64 {
+		v, _ := expvar.Get("rate_limit").(*expvar.Map).Get(name).(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+	rejected, evicted := counter("rejected_reads"), counter("evicted")
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rec := do("GET", "/todo/users/u", "10.0.0.1")
+		if rec.Code != want || rec.Header().Get("RateLimit-Limit") != "2" || rec.Header().Get("RateLimit-Remaining") != fmt.Sprint(max(0, 1-i)) {
+			t.Errorf("read %d: %d, headers %v", i, rec.Code, rec.Header())
+		}
+		if want == http.StatusTooManyRequests && (rec.Header().Get("Retry-After") != "2" || rec.Header().Get("Content-Type") != todo.ProblemType) {
+			t.Errorf("read %d: Retry-After %q, Content-Type %q", i, rec.Header().Get("Retry-After"), rec.Header().Get("Content-Type"))
+		}
+	}
+	if rec := do("POST", "/todo/users/u", "10.0.0.1"); rec.Code != http.StatusCreated {
+		t.Errorf("write after reads ran out: expected its own bucket, got %d", rec.Code)
+	}
+	if rec := do("POST", "/todo/users/u", "10.0.0.1"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second write: expected 429, got %d", rec.Code)
+	}
+	if rec := do("GET", "/todo/users/u", "10.0.0.2"); rec.Code != http.StatusOK {
+		t.Errorf("read from another IP: %d", rec.Code)
+	}
+	if got := counter("rejected_reads") - rejected; got != 1 {
+		t.Errorf("rejected_reads went up by %d, want 1", got)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	if rec := do("GET", "/todo/users/u", "10.0.0.3"); rec.Code != http.StatusOK {
+		t.Errorf("read after idle: %d", rec.Code)
+	}
+	if got := counter("evicted") - evicted; got != 2 {
+		t.Errorf("evicted went up by %d, want the 2 idle clients", got)
+	}
+	rec := do("GET", "/admin/metrics", "10.0.0.3")
+	var metrics struct {
+		RateLimit struct{ Clients int } `json:"rate_limit"`
+	}
+	json.NewDecoder(rec.Body).Decode(&metrics)
+	if rec.Code != http.StatusOK || metrics.RateLimit.Clients != 1 {
+		t.Errorf("GET /admin/metrics: %d %+v", rec.Code, metrics)
+	}
+
+	// bad credentials use up the IP's bucket, so tokens cannot be guessed without limit
+	authCfg := todo.Config{DataDir: t.TempDir(), Auth: todo.AuthConfig{Mode: todo.AuthRequired, JWTSecret: "s3cret"}}
+	handler.Auth = todo.NewAuthenticator(authCfg)
+	defer func() { handler.Auth = nil }()
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/todo/users/u", nil)
+		req.RemoteAddr = "10.0.0.4:1234"
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer guess-%d", i))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != want || (want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "") {
+			t.Errorf("bad token %d: %d, Retry-After %q", i, rec.Code, rec.Header().Get("Retry-After"))
+		}
+	}
+	// an authenticated user has one bucket wherever they send from
+	jwt, _ := todo.SignJWT([]byte("s3cret"), todo.JWTClaims{Subject: "u", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	for i, want := range []int{http.StatusCreated, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("POST", "/todo/users/u", strings.NewReader(`{"description":"two"}`))
+		req.RemoteAddr = fmt.Sprintf("10.0.1.%d:1234", i)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+jwt)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("write %d as u: expected %d, got %d", i, want, rec.Code)
+		}
+	}
+}
+
+func TestStrictDecoding(t *testing.T) {
+	reqs := make(chan todo.Request)
+	defer close(reqs)
+	cfg := todo.DefaultConfig()
+	cfg.Store = todo.NewMemStore()
+	go todo.RunActor(reqs, map[string][]todo.ToDoTask{"u": {{Description: "one", Status: "started"}}}, cfg)
+	defer func(max int64) { handler.MaxBodyBytes = max }(handler.MaxBodyBytes)
+	handler.MaxBodyBytes = 128
+	handler.Auth = todo.NewAuthenticator(todo.Config{DataDir: t.TempDir()}) // not required, but with a token store
+	defer func() { handler.Auth = nil }()
+	mux := handler.NewMux(reqs)
+
+	tests := []struct {
+		method, path, contentType, body string
+		status                          int
+		code                            string
+		fields                          []string
+	}{
+		{"POST", "/todo/users/u", "application/json; charset=utf-8", `{"description":"two"}`, http.StatusCreated, "", nil},
+		{"POST", "/todo/users/u", "text/plain", `{"description":"two"}`, http.StatusUnsupportedMediaType, todo.CodeUnsupportedMediaType, nil},
+		{"POST", "/todo/users/u", "", `{"description":"two"}`, http.StatusUnsupportedMediaType, todo.CodeUnsupportedMediaType, nil},
+		{"POST", "/todo/users/u", "application/json", `{"description":"two","priority":1}`, http.StatusBadRequest, todo.CodeInvalidInput, []string{"priority"}},
+		{"POST", "/todo/users/u", "application/json", `{"description":5}`, http.StatusBadRequest, todo.CodeInvalidInput, []string{"description"}},
+		{"POST", "/todo/users/u", "application/json", `{"description":"two"} {"description":"three"}`, http.StatusBadRequest, todo.CodeInvalidInput, []string{"body"}},
+		{"POST", "/todo/users/u", "application/json", `[]`, http.StatusBadRequest, todo.CodeInvalidInput, []string{"body"}},
+		{"POST", "/todo/users/u", "application/json", ``, http.StatusBadRequest, todo.CodeInvalidInput, []string{"body"}},
+		{"POST", "/todo/users/u", "application/json", `{"status":"started"}`, http.StatusBadRequest, todo.CodeInvalidInput, []string{"description"}},
+		{"PUT", "/todo/users/u/0", "application/json", `{"description":" ","status":"a\u0007"}`, http.StatusBadRequest, todo.CodeInvalidInput, []string{"description", "status"}},
+		{"POST", "/todo/users/u", "application/json", `{"description":"` + strings.Repeat("x", 200) + `"}`, http.StatusRequestEntityTooLarge, todo.CodeTooLarge, nil},
+		{"PATCH", "/todo/users/u/0", handler.MergePatchType, `{"description":""}`, http.StatusBadRequest, todo.CodeInvalidInput, []string{"description"}},
+		{"POST", "/admin/tokens", "application/json", `{"user":"u","expires":"never"}`, http.StatusBadRequest, todo.CodeInvalidInput, []string{"expires"}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s %s %s: %d, want %d (%s)", tt.method, tt.path, tt.body, rec.Code, tt.status, rec.Body)
+			continue
+		}
+		if tt.code == "" {
+			continue
+		}
+		var p todo.Problem
+		json.NewDecoder(rec.Body).Decode(&p)
+		var fields []string
+		for _, f := range p.Errors {
+			fields = append(fields, f.Field)
+		}
+		if p.Code != tt.code || !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%s %s %s: code %q fields %v, want %q %v", tt.method, tt.path, tt.body, p.Code, fields, tt.code, tt.fields)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"to-do/todo"
+)
+
+// Patch media types PatchByID accepts.
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+// PatchByID changes only the fields in the request body: an RFC 7396 merge patch such
+// as {"status":"completed"}, or an RFC 6902 JSON Patch whose "test" ops make it fail
+// with 409 if the task has changed.
+func PatchByID(actor chan todo.Request) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slog.SetDefault(LoggerFromContext(r.Context()))
+		user := r.PathValue("userID")
+		idv, ok := taskIndex(w, r)
+		if !ok {
+			return
+		}
+
+		parse := todo.ParseMergePatch
+		switch mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType {
+		case MergePatchType:
+		case JSONPatchType:
+			parse = todo.ParseJSONPatch
+		default:
+			w.Header().Set("Accept-Patch", MergePatchType+", "+JSONPatchType)
+			writeProblem(w, todo.NewProblem(http.StatusUnsupportedMediaType, todo.CodeUnsupportedMediaType, "Content-Type must be "+MergePatchType+" or "+JSONPatchType))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		patch, err := parse(body)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		task, err := todo.PatchTask(actor, user, idv, *patch)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		slog.Info("Patch OK", "index", idv)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(task)
+	}
+}
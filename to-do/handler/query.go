@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"to-do/todo"
+)
+
+// MaxPageSize caps ?limit= on the list endpoint.
+const MaxPageSize = 1000
+
+// queryParams are the list endpoint parameters that make GetAll page and filter.
+var queryParams = []string{"limit", "cursor", "status", "tag", "due_from", "due_to", "q", "fields"}
+
+// taskFields are the names ?fields= can pick.
+var taskFields = map[string]bool{"index": true, "description": true, "status": true, "tags": true, "due": true}
+
+// listQuery is a parsed list request.
+type listQuery struct {
+	todo.Query
+	fields []string
+}
+
+// isQuery reports whether r uses any of queryParams; without them GetAll returns the
+// whole list as it always has.
+func isQuery(r *http.Request) bool {
+	q := r.URL.Query()
+	for _, p := range queryParams {
+		if q.Has(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseListQuery reads queryParams. Every rejected parameter is reported, each as a
+// todo.ValidationError, so errors match todo.ErrInvalidInput.
+func parseListQuery(r *http.Request) (*listQuery, error) {
+	v := r.URL.Query()
+	lq := &listQuery{}
+	var errs []error
+	for _, s := range v["status"] {
+		for _, status := range strings.Split(s, ",") {
+			if status = strings.TrimSpace(status); status != "" {
+				lq.Status = append(lq.Status, status)
+			}
+		}
+	}
+	lq.Tag = strings.TrimLeft(v.Get("tag"), "#+@")
+	lq.Text = v.Get("q")
+	var err error
+	if lq.DueFrom, err = parseDate(v, "due_from"); err != nil {
+		errs = append(errs, err)
+	}
+	if lq.DueTo, err = parseDate(v, "due_to"); err != nil {
+		errs = append(errs, err)
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxPageSize {
+			errs = append(errs, &todo.ValidationError{Field: "limit", Reason: fmt.Sprintf("must be between 1 and %d", MaxPageSize)})
+		}
+		lq.Limit = n
+	}
+	if s := v.Get("fields"); s != "" {
+		for _, f := range strings.Split(s, ",") {
+			f = strings.TrimSpace(f)
+			if !taskFields[f] {
+				errs = append(errs, &todo.ValidationError{Field: "fields", Reason: fmt.Sprintf("unknown field %q", f)})
+			}
+			lq.fields = append(lq.fields, f)
+		}
+	}
+	if s := v.Get("cursor"); s != "" && len(errs) == 0 {
+		after, err := decodeCursor(s, lq.filterKey())
+		if err != nil {
+			errs = append(errs, err)
+		}
+		lq.After = after
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return lq, nil
+}
+
+func parseDate(v url.Values, name string) (time.Time, error) {
+	s := v.Get(name)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	d, err := time.Parse(todo.DueLayout, s)
+	if err != nil {
+		return time.Time{}, &todo.ValidationError{Field: name, Reason: "must be a date like 2025-01-31"}
+	}
+	return d, nil
+}
+
+// filterKey identifies the filters, so a cursor is only used with the query it came from.
+func (lq *listQuery) filterKey() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q|%q|%s|%s|%q", lq.Status, lq.Tag, lq.DueFrom.Format(todo.DueLayout), lq.DueTo.Format(todo.DueLayout), lq.Text)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:6])
+}
+
+// cursor is what an opaque ?cursor= value holds: the last task of the previous page.
+type cursor struct {
+	After  *todo.PageKey `json:"a"`
+	Filter string        `json:"f"`
+}
+
+func encodeCursor(after *todo.PageKey, filter string) string {
+	data, _ := json.Marshal(cursor{After: after, Filter: filter})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s, filter string) (*todo.PageKey, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil || c.After == nil || c.After.Index < 0 {
+		return nil, &todo.ValidationError{Field: "cursor", Reason: "not a cursor from this endpoint"}
+	}
+	if c.Filter != filter {
+		return nil, &todo.ValidationError{Field: "cursor", Reason: "belongs to a query with other filters"}
+	}
+	return c.After, nil
+}
+
+// writePage sends one page: the tasks (projected when ?fields= is set) as a JSON array,
+// the match count in X-Total-Count and the next page in a Link header.
+func writePage(w http.ResponseWriter, r *http.Request, lq *listQuery, page *todo.Page) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.Next != nil {
+		next := *r.URL
+		q := next.Query()
+		q.Set("cursor", encodeCursor(page.Next, lq.filterKey()))
+		next.RawQuery = q.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if len(lq.fields) == 0 {
+		json.NewEncoder(w).Encode(page.Tasks)
+		return
+	}
+	items := make([]map[string]any, len(page.Tasks))
+	for i, t := range page.Tasks {
+		item := make(map[string]any, len(lq.fields))
+		for _, f := range lq.fields {
+			switch f {
+			case "index":
+				item[f] = page.Indexes[i]
+			case "description":
+				item[f] = t.Description
+			case "status":
+				item[f] = t.Status
+			case "tags":
+				item[f] = todo.TaskTags(t)
+			case "due":
+				if due, ok := todo.TaskDue(t); ok {
+					item[f] = due.Format(todo.DueLayout)
+				} else {
+					item[f] = nil
+				}
+			}
+		}
+		items[i] = item
+	}
+	json.NewEncoder(w).Encode(items)
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"to-do/todo"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimits limits API requests, set it before starting the server. nil, the default,
+// lets every request through.
+var RateLimits *RateLimiter
+
+// rateMetrics counts allowed, rejected and evicted clients. expvar publishes it as
+// "rate_limit", served at /admin/metrics.
+var rateMetrics = func() *expvar.Map {
+	m := expvar.NewMap("rate_limit")
+	m.Set("clients", expvar.Func(func() any { return RateLimits.clients() }))
+	return m
+}()
+
+// RateLimiter keeps a read and a write token bucket for each client, see
+// todo.RateLimitConfig.
+type RateLimiter struct {
+	cfg todo.RateLimitConfig
+
+	mu        sync.Mutex
+	buckets   map[string]*rateClient
+	lastSweep time.Time
+}
+
+type rateClient struct {
+	reads, writes *rate.Limiter // nil for no limit
+	seen          time.Time
+}
+
+// NewRateLimiter limits clients as cfg says, or returns nil if cfg sets no limits.
+func NewRateLimiter(cfg todo.RateLimitConfig) *RateLimiter {
+	if cfg.Reads.PerSecond <= 0 && cfg.Writes.PerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{cfg: cfg, buckets: map[string]*rateClient{}}
+}
+
+func newBucket(c todo.RateClass) *rate.Limiter {
+	if c.PerSecond <= 0 {
+		return nil
+	}
+	burst := c.Burst
+	if burst <= 0 {
+		burst = int(math.Ceil(c.PerSecond))
+	}
+	return rate.NewLimiter(rate.Limit(c.PerSecond), burst)
+}
+
+// bucket returns key's read or write bucket, creating it. Clients idle for cfg.Idle are
+// dropped on the way, at most once per cfg.Idle.
+func (l *RateLimiter) bucket(key string, write bool, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg.Idle > 0 && now.Sub(l.lastSweep) >= l.cfg.Idle {
+		for k, c := range l.buckets {
+			if now.Sub(c.seen) >= l.cfg.Idle {
+				delete(l.buckets, k)
+				rateMetrics.Add("evicted", 1)
+			}
+		}
+		l.lastSweep = now
+	}
+	c := l.buckets[key]
+	if c == nil {
+		c = &rateClient{reads: newBucket(l.cfg.Reads), writes: newBucket(l.cfg.Writes)}
+		l.buckets[key] = c
+	}
+	c.seen = now
+	if write {
+		return c.writes
+	}
+	return c.reads
+}
+
+func (l *RateLimiter) clients() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// allow takes a token from key's bucket and sets the RateLimit-* headers. When the
+// bucket is empty it takes nothing and returns how long until it is not.
+func (l *RateLimiter) allow(w http.ResponseWriter, key string, write bool, now time.Time) (time.Duration, bool) {
+	lim := l.bucket(key, write, now)
+	if lim == nil {
+		return 0, true
+	}
+	res := lim.ReserveN(now, 1)
+	wait := res.DelayFrom(now)
+	if wait > 0 {
+		res.CancelAt(now)
+	}
+	tokens := lim.TokensAt(now)
+	full := time.Duration((float64(lim.Burst()) - tokens) / float64(lim.Limit()) * float64(time.Second))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(lim.Burst()))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(max(0, int(tokens))))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(full)))
+	return wait, wait == 0
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// clientIP is the address r came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+// WithIPRateLimit answers 429 with Retry-After once the client IP has used up its
+// bucket, see RateLimits. It goes outside WithAuth, so requests with a bad token or JWT
+// use up the bucket too and credentials cannot be guessed any faster.
+func WithIPRateLimit(next http.Handler) http.Handler {
+	return withRateLimit(next, func(r *http.Request) string { return "ip " + clientIP(r) })
+}
+
+// WithRateLimit is WithIPRateLimit for the authenticated user, wherever their requests
+// come from. It goes inside WithAuth; requests without an identity pass.
+func WithRateLimit(next http.Handler) http.Handler {
+	return withRateLimit(next, func(r *http.Request) string {
+		if id := IdentityFromContext(r.Context()); id != nil {
+			return "user " + id.User
+		}
+		return ""
+	})
+}
+
+// withRateLimit limits requests by the bucket key returns, "" for none.
+func withRateLimit(next http.Handler, key func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if RateLimits == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := key(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		write, class := r.Method != http.MethodGet && r.Method != http.MethodHead, "reads"
+		if write {
+			class = "writes"
+		}
+		wait, ok := RateLimits.allow(w, key, write, time.Now())
+		if !ok {
+			rateMetrics.Add("rejected_"+class, 1)
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+			writeError(w, fmt.Errorf("%w: too many %s from %s, retry in %s", todo.ErrQuotaExceeded, class, key, wait.Round(time.Millisecond)))
+			return
+		}
+		rateMetrics.Add("allowed", 1)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"to-do/todo"
+)
+
+// Export serves a user's tasks in the format named by ?format= (see todo.Formats).
+func Export(actor chan todo.Request) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slog.SetDefault(LoggerFromContext(r.Context()))
+		user := r.PathValue("userID")
+		format := r.URL.Query().Get("format")
+		slog.Info("received request to export tasks", "user", user, "format", format)
+
+		// render first so an error can still be sent with its own status
+		var buf bytes.Buffer
+		if err := todo.ExportTasks(actor, user, format, &buf); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", todo.ContentType(format))
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", user+todo.FileExt(format)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf.Bytes())
+	}
+}
+
+// Import reads tasks in the format named by ?format= from the request body and adds them
+// to the user's list, or replaces it with ?replace=true. With ?dry_run=true nothing is
+// changed. Either way the reply is a todo.ImportReport.
+func Import(actor chan todo.Request) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slog.SetDefault(LoggerFromContext(r.Context()))
+		user := r.PathValue("userID")
+		q := r.URL.Query()
+		format := q.Get("format")
+		dryRun, _ := strconv.ParseBool(q.Get("dry_run"))
+		replace, _ := strconv.ParseBool(q.Get("replace"))
+		slog.Info("received request to import tasks", "user", user, "format", format, "dryRun", dryRun)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		report, err := todo.ImportTasks(actor, user, format, bytes.NewReader(body), dryRun, replace)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		status := http.StatusOK
+		if !dryRun {
+			status = http.StatusCreated
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+	}
+}
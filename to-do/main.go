@@ -17,38 +17,77 @@ func main() {
 	//	initialTasks, _ := todo.LoadFile(todo.TodoFile)
 	//	go todo.Actor(initialTasks)
 
-	cwd, err := os.Getwd()
+	args, dataDirFlag := todo.TakeDataDirFlag(os.Args)
+	os.Args = args // the remaining flags are parsed by todo.Run
+	dataDir, err := todo.ResolveDataDir(dataDirFlag)
 	if err != nil {
-		log.Fatal("cannot determine cwd:", err)
+		log.Fatal("cannot resolve data directory:", err)
 	}
-	slog.Info("Get Workding Directory ", "DIR", cwd)
+	slog.Info("Using data directory", "DIR", dataDir)
 
-	userLists, err := todo.LoadAllTasksInDir(cwd)
+	cfg, err := todo.ConfigFromEnv()
 	if err != nil {
-		log.Fatal("failed loading tasks:", err)
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(todo.ExitCode(err))
+	}
+	cfg.DataDir = dataDir
+	if ran, err := todo.RunOffline(os.Args, cfg); ran {
+		if err != nil {
+			slog.Error("command failed", "error", err)
+		}
+		os.Exit(todo.ExitCode(err))
+	}
+	flag.Parse()
+	if flag.Arg(0) == "repl" {
+		actor, release, err := todo.Attach(&cfg, todo.OwnerREPL)
+		if err != nil {
+			log.Fatal("cannot use data directory: ", err)
+		}
+		todo.RunREPL(actor, "default") //added default as user and it will create default_todo.json file
+		if err := todo.Flush(actor); err != nil {
+			slog.Error("failed to flush tasks on exit", "error", err)
+		}
+		release()
+		return
+	}
+
+	lock, err := todo.ClaimDir(dataDir, todo.Owner{Kind: todo.OwnerServer, Addr: handler.LocalURL()})
+	if err != nil {
+		log.Fatal("cannot start server: ", err)
+	}
+	defer lock.Release()
+	cfg.Store, err = todo.OpenStore(cfg)
+	if err != nil {
+		log.Fatal("failed opening store:", err)
+	}
+
+	userLists, err := todo.Preload(cfg.Store)
+	if err != nil {
+		log.Fatal("failed loading tasks (run fsck to check the data directory):", err)
 	}
 	slog.Info("Loaded files ...", "DATA", userLists)
 
-	go todo.Actor(userLists)
+	go todo.RunActor(actor, userLists, cfg)
 
-	flag.Parse()
-	switch flag.Arg(0) {
-	case "repl":
-		todo.RunREPL(actor, "default") //added default as user and it will create default_todo.json file
-	default:
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
-		var wg sync.WaitGroup
-		wg.Add(1)
-		go todo.RunCLI(ctx, &wg, actor)
-		wg.Add(1)
-		go handler.RunHttpServer(ctx, &wg, actor)
-
-		handler.WaitForInterrupt()
-		cancel()
-		slog.Info("Shutting down gracefully...")
-		wg.Wait()
-		slog.Info("Todo Application stopped.")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler.Auth = todo.NewAuthenticator(cfg)
+	handler.RateLimits = handler.NewRateLimiter(cfg.RateLimit)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go todo.RunCLI(ctx, &wg, actor, cfg)
+	wg.Add(1)
+	go handler.RunHttpServer(ctx, &wg, actor)
+	go todo.WatchDir(ctx, cfg, actor)
+	go todo.RunBackups(ctx, cfg, actor)
+
+	handler.WaitForInterrupt()
+	cancel()
+	slog.Info("Shutting down gracefully...")
+	wg.Wait()
+	if err := todo.Flush(actor); err != nil {
+		slog.Error("failed to flush tasks on shutdown", "error", err)
 	}
+	slog.Info("Todo Application stopped.")
 }
@@ -2,9 +2,9 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"log/slog"
-	"os"
 	"sync"
 	"to-do/handler"
 	"to-do/todo"
@@ -14,31 +14,71 @@ var actor = todo.ReqChan
 
 func main() {
 	//initialTasks, _ := todo.LoadFile(todo.TodoFile)
+	dataDirFlag := flag.String(todo.DataDirFlag, "", "Data directory (default $TODO_DATA_DIR or $XDG_DATA_HOME/todo)")
+	flag.StringVar(&handler.ListenAddr, "addr", handler.ListenAddr, "Address the API listens on")
+	flag.Int64Var(&handler.MaxBodyBytes, "max-body", handler.MaxBodyBytes, "Largest request body the API accepts, in bytes")
+	flag.Parse()
 
-	cwd, err := os.Getwd()
+	dataDir, err := todo.ResolveDataDir(*dataDirFlag)
 	if err != nil {
-		log.Fatal("cannot determine cwd:", err)
+		log.Fatal("cannot resolve data directory:", err)
 	}
-	slog.Info("Get Workding Directory ", "DIR", cwd)
+	slog.Info("Using data directory", "DIR", dataDir)
 
-	userLists, err := todo.LoadAllTasksInDir(cwd)
+	cfg, err := todo.ConfigFromEnv()
 	if err != nil {
-		log.Fatal("failed loading tasks:", err)
+		log.Fatal("invalid configuration: ", err)
+	}
+	cfg.DataDir = dataDir
+	lock, err := todo.ClaimDir(dataDir, todo.Owner{Kind: todo.OwnerServer, Addr: handler.LocalURL()})
+	if err != nil {
+		log.Fatal("cannot start server: ", err)
+	}
+	defer lock.Release()
+	cfg.Store, err = todo.OpenStore(cfg)
+	if err != nil {
+		log.Fatal("failed opening store:", err)
 	}
-	slog.Info("Loaded files ...", "DATA", userLists)
 
-	go todo.Actor(userLists)
+	var cluster *todo.Cluster
+	if cfg.Cluster.NodeID != "" {
+		cluster, err = todo.StartCluster(cfg)
+		if err != nil {
+			log.Fatal("failed starting cluster node:", err)
+		}
+		actor = cluster.Actor()
+	} else {
+		userLists, err := todo.Preload(cfg.Store)
+		if err != nil {
+			log.Fatal("failed loading tasks (run fsck to check the data directory):", err)
+		}
+		slog.Info("Loaded files ...", "DATA", userLists)
+
+		go todo.RunActor(actor, userLists, cfg)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	//	defer cancel()
 
+	handler.Auth = todo.NewAuthenticator(cfg)
+	handler.RateLimits = handler.NewRateLimiter(cfg.RateLimit)
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go handler.RunHttpServer(ctx, &wg, actor)
+	go todo.WatchDir(ctx, cfg, actor)
+	go todo.RunBackups(ctx, cfg, actor)
 
 	handler.WaitForInterrupt()
 	cancel()
 	slog.Info("Shutting down gracefully...")
 	wg.Wait()
+	if err := todo.Flush(actor); err != nil {
+		slog.Error("failed to flush tasks on shutdown", "error", err)
+	}
+	if cluster != nil {
+		if err := cluster.Shutdown(); err != nil {
+			slog.Error("failed to leave the cluster cleanly", "error", err)
+		}
+	}
 	slog.Info("Todo Application stopped.")
 }
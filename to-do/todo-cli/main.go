@@ -1,45 +1,53 @@
 package main
 
 import (
-	"context"
 	"log"
 	"log/slog"
 	"os"
-	"sync"
-	"to-do/handler"
 	"to-do/todo"
 )
 
-var actor = todo.ReqChan
-
 func main() {
 	//initialTasks, _ := todo.LoadFile(todo.TodoFile)
 	//go todo.Actor(initialTasks)
 
-	cwd, err := os.Getwd()
+	args, dataDirFlag := todo.TakeDataDirFlag(os.Args)
+	os.Args = args // the remaining flags are parsed by todo.Run
+	dataDir, err := todo.ResolveDataDir(dataDirFlag)
 	if err != nil {
-		log.Fatal("cannot determine cwd:", err)
+		log.Fatal("cannot resolve data directory:", err)
 	}
-	slog.Info("Get Workding Directory ", "DIR", cwd)
+	slog.Info("Using data directory", "DIR", dataDir)
 
-	userLists, err := todo.LoadAllTasksInDir(cwd)
+	cfg, err := todo.ConfigFromEnv()
 	if err != nil {
-		log.Fatal("failed loading tasks:", err)
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(todo.ExitCode(err))
+	}
+	cfg.DataDir = dataDir
+	if ran, err := todo.RunOffline(os.Args, cfg); ran {
+		if err != nil {
+			slog.Error("command failed", "error", err)
+		}
+		os.Exit(todo.ExitCode(err))
+	}
+	actor, release, err := todo.Attach(&cfg, todo.OwnerCLI)
+	if err != nil {
+		slog.Error("cannot use data directory", "error", err)
+		os.Exit(todo.ExitCode(err))
 	}
-	slog.Info("Loaded files ...", "DATA", userLists)
-
-	go todo.Actor(userLists)
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go todo.RunCLI(ctx, &wg, actor)
 
-	handler.WaitForInterrupt()
-	cancel()
-	slog.Info("Shutting down gracefully...")
-	wg.Wait()
-	slog.Info("Todo Application stopped.")
+	todo.InitLogwithTraceID()
+	runErr := todo.RunWithConfig(os.Args, actor, cfg)
+	if err := todo.Flush(actor); err != nil {
+		slog.Error("failed to flush tasks on exit", "error", err)
+		if runErr == nil {
+			runErr = err
+		}
+	}
+	release()
+	if runErr != nil {
+		slog.Error("command failed", "error", runErr)
+	}
+	os.Exit(todo.ExitCode(runErr))
 }
@@ -9,13 +9,12 @@ import (
 	"to-do/todo"
 )
 
-var actor = todo.ReqChan
-
 func main() {
 	//initialTasks, _ := todo.LoadFile(todo.TodoFile)
 	//go todo.Actor(initialTasks)
 
 	user := flag.String("user", "", "User ID (required for repl session)")
+	dataDirFlag := flag.String(todo.DataDirFlag, "", "Data directory (default $TODO_DATA_DIR or $XDG_DATA_HOME/todo)")
 	flag.Parse()
 	if *user == "" {
 		fmt.Fprintln(os.Stderr, "ERROR: you must provide -user")
@@ -23,20 +22,25 @@ func main() {
 		os.Exit(1)
 	}
 
-	cwd, err := os.Getwd()
+	dataDir, err := todo.ResolveDataDir(*dataDirFlag)
 	if err != nil {
-		log.Fatal("cannot determine cwd:", err)
+		log.Fatal("cannot resolve data directory:", err)
 	}
-	slog.Info("Get Workding Directory ", "DIR", cwd)
+	slog.Info("Using data directory", "DIR", dataDir)
 
-	userLists, err := todo.LoadAllTasksInDir(cwd)
+	cfg, err := todo.ConfigFromEnv()
 	if err != nil {
-		log.Fatal("failed loading tasks:", err)
+		log.Fatal("invalid configuration: ", err)
+	}
+	cfg.DataDir = dataDir
+	actor, release, err := todo.Attach(&cfg, todo.OwnerREPL)
+	if err != nil {
+		log.Fatal("cannot use data directory: ", err)
 	}
-	slog.Info("Loaded files ...", "DATA", userLists)
-
-	go todo.Actor(userLists)
 
 	todo.RunREPL(actor, *user)
-
+	if err := todo.Flush(actor); err != nil {
+		slog.Error("failed to flush tasks on exit", "error", err)
+	}
+	release()
 }
@@ -39,20 +39,32 @@ func RunREPL(actor chan Request, userID string) {
 			getList(actor, userID)
 			continue
 		case "help":
-			fmt.Println("Commands: add, list, update, delete, exit")
+			fmt.Println("Commands: add, list, update, status, delete, exit")
 		case "update":
 			if len(args) < 2 {
 				fmt.Println("Usage: update <index> <new description>")
 				continue
 			}
 			idx, err := strconv.Atoi(args[0])
-			if err != err {
+			if err != nil {
 				fmt.Println("Invalid Index - Usage: update 0 <new description>")
 				continue
 			}
 			newDesc := strings.Join(args[1:], " ")
 			UpdateItem(actor, userID, idx, newDesc)
 			continue
+		case "status":
+			if len(args) < 2 {
+				fmt.Println("Usage: status <index> <new status>")
+				continue
+			}
+			idx, err := strconv.Atoi(args[0])
+			if err != nil {
+				fmt.Println("Invalid Index - Usage: status 0 completed")
+				continue
+			}
+			SetStatus(actor, userID, idx, strings.Join(args[1:], " "))
+			continue
 		case "delete", "remove":
 			if len(args) == 0 {
 				fmt.Println("Usage: delete <Index>")
@@ -85,15 +97,24 @@ func AddItem(actor chan Request, user string, desc string) {
 	fmt.Printf("New item added, Description : %v, Status: Not Started \n", res.Task.Description)
 }
 
+// UpdateItem changes a task's description and keeps its status.
 func UpdateItem(actor chan Request, user string, idx int, newDesc string) {
-	reply := make(chan Response)
-	actor <- Request{Op: "update", UserID: user, Task: ToDoTask{Description: newDesc, Status: "Not Started"}, Index: idx, ReplyCh: reply}
-	res := <-reply
-	if res.Err != nil {
-		fmt.Println("failed to process this request: ", res.Err)
+	t, err := PatchTask(actor, user, idx, TaskPatch{Description: &newDesc})
+	if err != nil {
+		fmt.Println("failed to process this request: ", err)
+		return
+	}
+	fmt.Printf("Updated item, New Description : %v \n", t.Description)
+}
+
+// SetStatus changes a task's status and keeps its description.
+func SetStatus(actor chan Request, user string, idx int, status string) {
+	t, err := PatchTask(actor, user, idx, TaskPatch{Status: &status})
+	if err != nil {
+		fmt.Println("failed to process this request: ", err)
 		return
 	}
-	fmt.Printf("Updated item, New Description : %v \n", res.Task.Description)
+	fmt.Printf("Updated item, New Status : %v \n", t.Status)
 }
 
 func DeleteItem(actor chan Request, user string, idx int) {
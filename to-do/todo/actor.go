@@ -3,6 +3,7 @@ package todo
 import (
 	"fmt"
 	"log/slog"
+	"time"
 )
 
 type Request struct {
@@ -10,88 +11,277 @@ type Request struct {
 	Op      string
 	Index   int
 	Task    ToDoTask
+	Tasks   []ToDoTask            // "replace" and "append" ops only
+	Lists   map[string][]ToDoTask // "load" op only
+	Query   *Query                // "query" op only
+	Patch   *TaskPatch            // "patch" op only
 	ReplyCh chan Response
 }
 
 type Response struct {
 	Err   error
-	Task  *ToDoTask  // single task
-	Tasks []ToDoTask //all task
+	Task  *ToDoTask             // single task
+	Tasks []ToDoTask            //all task
+	Usage *UsageReport          // "usage" op only
+	Lists map[string][]ToDoTask // "snapshot" op only
+	Page  *Page                 // "query" op only
 }
 
 var ReqChan = make(chan Request, 1000)
 
+// Actor serves ReqChan with the default (durable) configuration.
 func Actor(initial map[string][]ToDoTask) chan Request {
-	//tasks := append([]ToDoTask(nil), initial...)
+	RunActor(ReqChan, initial, DefaultConfig())
+	return ReqChan
+}
+
+// actorState is the state owned by the RunActor goroutine.
+type actorState struct {
+	cfg    Config
+	lists  map[string][]ToDoTask
+	dirty  map[string]bool   // users changed since the last write-behind flush
+	onDisk map[string]string // fingerprint of each user's list as last read or written
+	ops    *opCounter
+	rows   RowStore // set when the store answers queries itself; lists is then unused
+}
 
-	lists := make(map[string][]ToDoTask, len(initial))
+// RunActor owns every user's task list and serves requests from reqs until it is closed.
+// Every request gets exactly one reply on its ReplyCh.
+//
+// In durable mode a mutation is applied to a copy of the list and only committed once
+// it has been saved; if the save fails the old list is kept and the error is returned.
+// In write-behind mode mutations are committed straight away and the user is marked
+// dirty; dirty users are saved once per cfg.FlushInterval, on a "flush" request and
+// when reqs is closed.
+//
+// When cfg.Store is a RowStore the actor keeps no lists in memory: every request is
+// answered by the store and every mutation is a single store transaction.
+func RunActor(reqs chan Request, initial map[string][]ToDoTask, cfg Config) {
+	if cfg.Store == nil {
+		cfg.Store = &JSONStore{Dir: "."}
+	}
+	a := &actorState{
+		cfg:    cfg,
+		lists:  make(map[string][]ToDoTask, len(initial)),
+		dirty:  make(map[string]bool),
+		ops:    newOpCounter(),
+		onDisk: make(map[string]string, len(initial)),
+	}
 	for user, tasks := range initial {
-		lists[user] = append([]ToDoTask(nil), tasks...)
-	}
-
-	for req := range ReqChan {
-		tasks := lists[req.UserID]
-		switch req.Op {
-		case "get":
-			slog.Debug("actor get")
-			if req.Index < 0 || req.Index >= len(tasks) {
-				req.ReplyCh <- Response{Err: fmt.Errorf("index %d out of range", req.Index)}
-			} else {
-				req.ReplyCh <- Response{Task: &tasks[req.Index]}
-			}
-		case "list":
-			slog.Debug("actor list")
-			req.ReplyCh <- Response{Tasks: append([]ToDoTask(nil), tasks...)}
-			//slog.Info("updated todo list", "task", tasks)
-		case "add":
-			//slog.Debug("adding task...", "task", req.Task)
-			//req.Task.ID = len(tasks)
-			if req.Task.Status != "" {
-				tasks = append(tasks, req.Task)
-			} else {
-				t := ToDoTask{Description: req.Task.Description, Status: "not started"}
-				tasks = append(tasks, t)
-			}
-			lists[req.UserID] = tasks
-			//go func(s []ToDoTask) {
-			if err := SaveFile(tasks, req.UserID+"_"+TodoFile); err != nil {
-				slog.Error("actor: failed to save tasks", "error", err)
-			}
-			//}(append([]ToDoTask(nil), tasks...))
-			req.ReplyCh <- Response{Task: &tasks[len(tasks)-1]}
-			//slog.Info("Added new task", "task", tasks)
-
-		case "update":
-			slog.Debug("actor update", "task", tasks, "index", req.Index, "len", len(tasks))
-			if req.Index < 0 || req.Index >= len(tasks) {
-				req.ReplyCh <- Response{Err: fmt.Errorf("index %d out of range", req.Index)}
-			} else {
-				tasks[req.Index] = req.Task
-				req.ReplyCh <- Response{Task: &tasks[req.Index]}
-				if err := SaveFile(tasks, req.UserID+"_"+TodoFile); err != nil {
-					slog.Error("actor: failed to save tasks", "error", err)
-					req.ReplyCh <- Response{Err: fmt.Errorf("actor: failed to save tasks -  %d ", err)}
-				}
+		a.lists[user] = append([]ToDoTask(nil), tasks...)
+		a.onDisk[user] = fingerprint(tasks)
+	}
+	if rows, ok := cfg.Store.(RowStore); ok {
+		a.rows = rows
+	}
+
+	var tick <-chan time.Time
+	if a.writeBehind() {
+		ticker := time.NewTicker(cfg.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case req, ok := <-reqs:
+			if !ok {
+				a.flush()
+				return
 			}
-		case "delete":
-			slog.Debug("actor delete")
-			if req.Index < 0 || req.Index >= len(tasks) {
-				req.ReplyCh <- Response{Err: fmt.Errorf("index %d out of range", req.Index)}
-			} else {
-				tasks = append(tasks[:req.Index], tasks[req.Index+1:]...)
-
-				if err := SaveFile(tasks, req.UserID+"_"+TodoFile); err != nil {
-					slog.Error("actor: failed to save tasks", "error", err)
-					req.ReplyCh <- Response{Err: fmt.Errorf("could not save tasks: %v", err)}
-				} else {
-					req.ReplyCh <- Response{Tasks: append([]ToDoTask(nil), tasks...)}
-					slog.Info("Revised task list", "tasks", tasks)
-				}
+			req.ReplyCh <- a.handle(req)
+		case <-tick:
+			a.flush()
+		}
+	}
+}
+
+func (a *actorState) writeBehind() bool {
+	return a.cfg.PersistMode == PersistWriteBehind && a.rows == nil
+}
+
+// count returns how many tasks user has, or a StorageError when the RowStore can't say.
+func (a *actorState) count(user string) (int, error) {
+	if a.rows == nil {
+		return len(a.lists[user]), nil
+	}
+	n, err := a.rows.Count(user)
+	if err != nil {
+		return 0, rowErr(user, err)
+	}
+	return n, nil
+}
+
+func (a *actorState) handle(req Request) Response {
+	switch req.Op {
+	case "flush":
+		slog.Debug("actor flush", "dirty", len(a.dirty))
+		return Response{Err: a.flush()}
+	case "usage":
+		usage, err := a.usage(time.Now())
+		return Response{Usage: usage, Err: err}
+	case "snapshot":
+		return a.handleSnapshot()
+	case "load":
+		return a.handleLoad(req.Lists)
+	}
+
+	if err := ValidateUserID(req.UserID); err != nil {
+		return Response{Err: err}
+	}
+	if req.Op == "reload" {
+		return a.handleReload(req.UserID)
+	}
+	if err := a.checkRate(req.UserID, time.Now()); err != nil {
+		return Response{Err: err}
+	}
+	if req.Op == "query" {
+		return a.handleQuery(req)
+	}
+	if req.Op == "patch" {
+		var err error
+		if req, err = a.resolvePatch(req); err != nil {
+			return Response{Err: err}
+		}
+	}
+	if a.rows != nil {
+		return a.handleRows(req)
+	}
+	tasks := a.lists[req.UserID]
+	switch req.Op {
+	case "get":
+		slog.Debug("actor get")
+		if req.Index < 0 || req.Index >= len(tasks) {
+			return Response{Err: &IndexError{UserID: req.UserID, Index: req.Index, Len: len(tasks)}}
+		}
+		t := tasks[req.Index]
+		return Response{Task: &t}
+	case "list":
+		slog.Debug("actor list")
+		return Response{Tasks: append([]ToDoTask(nil), tasks...)}
+	case "add":
+		t := req.Task
+		if t.Status == "" {
+			t.Status = "not started"
+		}
+		if err := a.checkCount(req.UserID, len(tasks)); err != nil {
+			return Response{Err: err}
+		}
+		if err := a.checkDescription(req.UserID, t); err != nil {
+			return Response{Err: err}
+		}
+		// appending past len(tasks) never changes what the committed list shows, so a failed save needs no undo
+		next := append(tasks, t)
+		if err := a.commit(req.UserID, next, LogRecord{Op: "add", Task: &t}); err != nil {
+			return Response{Err: err}
+		}
+		return Response{Task: &t}
+	case "update":
+		slog.Debug("actor update", "index", req.Index, "len", len(tasks))
+		if req.Index < 0 || req.Index >= len(tasks) {
+			return Response{Err: &IndexError{UserID: req.UserID, Index: req.Index, Len: len(tasks)}}
+		}
+		if err := a.checkDescription(req.UserID, req.Task); err != nil {
+			return Response{Err: err}
+		}
+		next := append([]ToDoTask(nil), tasks...)
+		next[req.Index] = req.Task
+		t := req.Task
+		if err := a.commit(req.UserID, next, LogRecord{Op: "update", Index: req.Index, Task: &t}); err != nil {
+			return Response{Err: err}
+		}
+		return Response{Task: &t}
+	case "delete":
+		slog.Debug("actor delete")
+		if req.Index < 0 || req.Index >= len(tasks) {
+			return Response{Err: &IndexError{UserID: req.UserID, Index: req.Index, Len: len(tasks)}}
+		}
+		next := append(append(make([]ToDoTask, 0, len(tasks)-1), tasks[:req.Index]...), tasks[req.Index+1:]...)
+		if err := a.commit(req.UserID, next, LogRecord{Op: "delete", Index: req.Index}); err != nil {
+			return Response{Err: err}
+		}
+		slog.Info("Revised task list", "tasks", len(next))
+		return Response{Tasks: append([]ToDoTask(nil), next...)}
+	case "append":
+		slog.Debug("actor append", "tasks", len(req.Tasks))
+		next := append(append(make([]ToDoTask, 0, len(tasks)+len(req.Tasks)), tasks...), req.Tasks...)
+		if err := a.checkList(req.UserID, next); err != nil {
+			return Response{Err: err}
+		}
+		if err := a.commit(req.UserID, next, LogRecord{Op: "replace", Tasks: next}); err != nil {
+			return Response{Err: err}
+		}
+		return Response{Tasks: append([]ToDoTask(nil), next...)}
+	case "replace":
+		slog.Debug("actor replace", "tasks", len(req.Tasks))
+		if err := a.checkList(req.UserID, req.Tasks); err != nil {
+			return Response{Err: err}
+		}
+		next := append([]ToDoTask(nil), req.Tasks...)
+		if err := a.commit(req.UserID, next, LogRecord{Op: "replace", Tasks: next}); err != nil {
+			return Response{Err: err}
+		}
+		return Response{Tasks: append([]ToDoTask(nil), next...)}
+	default:
+		return a.handleUnknown(req)
+	}
+}
+
+func (a *actorState) handleUnknown(req Request) Response {
+	slog.Error("unknown op", "op", req.Op)
+	return Response{Err: fmt.Errorf("%w: unknown op %q", ErrInvalidInput, req.Op)}
+}
+
+// commit makes next the user's list; rec describes the change. In durable mode it is
+// persisted first, as a single record when the store is an Appender, and the in-memory
+// list is left untouched when that fails.
+func (a *actorState) commit(user string, next []ToDoTask, rec LogRecord) error {
+	if a.writeBehind() {
+		a.lists[user] = next
+		a.dirty[user] = true
+		return nil
+	}
+	var err error
+	if app, ok := a.cfg.Store.(Appender); ok {
+		err = app.Append(user, rec, next)
+	} else {
+		err = a.save(user, next)
+	}
+	if err != nil {
+		slog.Error("actor: failed to save tasks, change rolled back", "user", user, "error", err)
+		return &StorageError{UserID: user, Err: err}
+	}
+	a.lists[user] = next
+	return nil
+}
+
+func (a *actorState) save(user string, tasks []ToDoTask) error {
+	if err := a.cfg.Store.Save(user, tasks); err != nil {
+		return err
+	}
+	a.onDisk[user] = fingerprint(tasks)
+	return nil
+}
+
+// flush saves every dirty user. Users whose save fails stay dirty and are retried later.
+func (a *actorState) flush() error {
+	var firstErr error
+	for user := range a.dirty {
+		if err := a.save(user, a.lists[user]); err != nil {
+			slog.Error("actor: failed to flush tasks", "user", user, "error", err)
+			if firstErr == nil {
+				firstErr = &StorageError{UserID: user, Err: err}
 			}
-		default:
-			slog.Error("unknown op", "op", req.Op)
-			req.ReplyCh <- Response{Err: fmt.Errorf("unknown op %q", req.Op)}
+			continue
 		}
+		delete(a.dirty, user)
 	}
-	return ReqChan
+	return firstErr
+}
+
+// Flush asks the actor to save every dirty user now. It is a no-op in durable mode.
+func Flush(actor chan Request) error {
+	reply := make(chan Response, 1)
+	actor <- Request{Op: "flush", ReplyCh: reply}
+	return (<-reply).Err
 }
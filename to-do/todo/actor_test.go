@@ -1,12 +1,19 @@
 package todo
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
+
+	"github.com/hashicorp/raft"
 )
 
 var actor = ReqChan
@@ -86,6 +93,490 @@ func TestActorVerify(t *testing.T) {
 
 }
 
+func TestActorWriteBehindCoalescesSaves(t *testing.T) {
+	user := "writebehind"
+	dir := t.TempDir()
+	file := filepath.Join(dir, user+"_"+TodoFile)
+
+	reqs := make(chan Request)
+	defer close(reqs)
+	go RunActor(reqs, nil, Config{PersistMode: PersistWriteBehind, FlushInterval: time.Hour, Store: &JSONStore{Dir: dir}})
+
+	for i := 0; i < 3; i++ {
+		reply := make(chan Response)
+		reqs <- Request{Op: "add", UserID: user, Task: ToDoTask{Description: fmt.Sprintf("task-%d", i)}, ReplyCh: reply}
+		if res := <-reply; res.Err != nil {
+			t.Fatalf("add %d failed: %v", i, res.Err)
+		}
+	}
+
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("expected no file before flush, stat error = %v", err)
+	}
+
+	if err := Flush(reqs); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	loaded, err := LoadFile(file)
+	if err != nil {
+		t.Fatalf("LoadFile() error = %v", err)
+	}
+	if len(loaded) != 3 {
+		t.Fatalf("expected 3 tasks after flush, got %d", len(loaded))
+	}
+}
+
+// failingStore is a MemStore whose saves fail while failing is set.
+type failingStore struct {
+	*MemStore
+	failing bool
+}
+
+func (s *failingStore) Save(user string, tasks []ToDoTask) error {
+	if s.failing {
+		return errors.New("disk full")
+	}
+	return s.MemStore.Save(user, tasks)
+}
+
+func TestActorRollsBackOnSaveFailure(t *testing.T) {
+	store := &failingStore{MemStore: NewMemStore()}
+	cfg := DefaultConfig()
+	cfg.Store = store
+
+	reqs := make(chan Request)
+	defer close(reqs)
+	go RunActor(reqs, map[string][]ToDoTask{"u": {{Description: "keep", Status: "started"}}}, cfg)
+
+	// buffered so a second reply would be seen instead of blocking the actor
+	send := func(req Request) Response {
+		req.UserID = "u"
+		req.ReplyCh = make(chan Response, 2)
+		reqs <- req
+		res := <-req.ReplyCh
+		Flush(reqs) // the actor has finished with req once it serves the next request
+		if extra := len(req.ReplyCh); extra != 0 {
+			t.Fatalf("%s: expected exactly one reply, got %d more", req.Op, extra)
+		}
+		return res
+	}
+
+	store.failing = true
+	tests := []Request{
+		{Op: "add", Task: ToDoTask{Description: "new"}},
+		{Op: "update", Index: 0, Task: ToDoTask{Description: "changed", Status: "completed"}},
+		{Op: "delete", Index: 0},
+	}
+	for _, req := range tests {
+		if res := send(req); res.Err == nil {
+			t.Errorf("%s: expected save error, got success", req.Op)
+		}
+		res := send(Request{Op: "list"})
+		if len(res.Tasks) != 1 || res.Tasks[0].Description != "keep" || res.Tasks[0].Status != "started" {
+			t.Errorf("%s: expected list to be rolled back, got %+v", req.Op, res.Tasks)
+		}
+	}
+
+	store.failing = false
+	if res := send(Request{Op: "add", Task: ToDoTask{Description: "new"}}); res.Err != nil {
+		t.Fatalf("add after recovery failed: %v", res.Err)
+	}
+	if res := send(Request{Op: "list"}); len(res.Tasks) != 2 {
+		t.Fatalf("expected 2 tasks after recovery, got %d", len(res.Tasks))
+	}
+}
+
+func TestActorEnforcesLimits(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Store = NewMemStore()
+	cfg.Limits = Limits{MaxTasks: 2, MaxDescriptionLen: 5, MaxOpsPerMinute: 5}
+
+	reqs := make(chan Request)
+	defer close(reqs)
+	go RunActor(reqs, nil, cfg)
+
+	send := func(req Request) error {
+		req.UserID = "q"
+		req.ReplyCh = make(chan Response, 1)
+		reqs <- req
+		return (<-req.ReplyCh).Err
+	}
+
+	tests := []struct {
+		name  string
+		req   Request
+		limit string
+	}{
+		{"first add", Request{Op: "add", Task: ToDoTask{Description: "a"}}, ""},
+		{"description too long", Request{Op: "add", Task: ToDoTask{Description: "toolong"}}, "max_description_len"},
+		{"second add", Request{Op: "add", Task: ToDoTask{Description: "b"}}, ""},
+		{"too many tasks", Request{Op: "add", Task: ToDoTask{Description: "c"}}, "max_tasks"},
+		{"update too long", Request{Op: "update", Index: 0, Task: ToDoTask{Description: "toolong"}}, "max_description_len"},
+		{"too many ops", Request{Op: "list"}, "max_ops_per_minute"},
+	}
+	for _, tt := range tests {
+		err := send(tt.req)
+		var qe *QuotaError
+		switch {
+		case tt.limit == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case tt.limit != "" && !errors.As(err, &qe):
+			t.Errorf("%s: expected QuotaError, got %v", tt.name, err)
+		case tt.limit != "" && qe.Limit != tt.limit:
+			t.Errorf("%s: expected limit %s, got %s", tt.name, tt.limit, qe.Limit)
+		case tt.limit != "" && !errors.Is(err, ErrQuotaExceeded):
+			t.Errorf("%s: expected error to match ErrQuotaExceeded", tt.name)
+		}
+	}
+
+	report, err := GetUsage(reqs)
+	if err != nil {
+		t.Fatalf("GetUsage() error = %v", err)
+	}
+	if len(report.Users) != 1 || report.Users[0].Tasks != 2 || report.Users[0].OpsThisMinute != 5 {
+		t.Errorf("unexpected usage report %+v", report.Users)
+	}
+
+	// windows are only kept while a limit is set and until they close
+	ops, now := newOpCounter(), time.Now()
+	ops.check("unlimited", 0, now)
+	ops.check("old", 5, now)
+	ops.check("new", 5, now.Add(time.Minute))
+	if _, ok := ops.windows["unlimited"]; ok || len(ops.windows) != 1 || ops.windows["new"] == nil {
+		t.Errorf("op windows = %v, want only new", ops.windows)
+	}
+}
+
+func TestActorReloadsExternalEdits(t *testing.T) {
+	edited := []ToDoTask{{Description: "from editor", Status: "completed"}}
+	tests := []struct {
+		policy string
+		want   []ToDoTask
+	}{
+		{ConflictPreferDisk, edited},
+		{ConflictPreferMemory, []ToDoTask{{Description: "unsaved", Status: "not started"}}},
+		{ConflictKeepBoth, []ToDoTask{{Description: "unsaved", Status: "not started"}, {Description: ConflictMarker + "from editor", Status: "completed"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := DefaultConfig()
+			cfg.Store = &JSONStore{Dir: dir}
+			cfg.PersistMode = PersistWriteBehind
+			cfg.FlushInterval = time.Hour
+			cfg.ConflictPolicy = tt.policy
+
+			reqs := make(chan Request)
+			defer close(reqs)
+			go RunActor(reqs, nil, cfg)
+
+			// the actor's own writes are not external edits
+			if err := Flush(reqs); err != nil {
+				t.Fatal(err)
+			}
+			reply := make(chan Response, 1)
+			reqs <- Request{Op: "add", UserID: "w", Task: ToDoTask{Description: "unsaved"}, ReplyCh: reply}
+			if res := <-reply; res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			if err := SaveFile(edited, Paths{Dir: dir}.UserFile("w")); err != nil {
+				t.Fatal(err)
+			}
+			got, err := Reload(reqs, "w")
+			if err != nil {
+				t.Fatalf("Reload() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("after reload got %+v, want %+v", got, tt.want)
+			}
+			// write while the temp dir still exists, so closing reqs has nothing left to flush
+			if err := Flush(reqs); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// durable mode has no unsaved changes, so its own writes are ignored and edits always win
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.Store = &JSONStore{Dir: dir}
+	reqs := make(chan Request)
+	defer close(reqs)
+	go RunActor(reqs, nil, cfg)
+	reply := make(chan Response, 1)
+	reqs <- Request{Op: "add", UserID: "d", Task: ToDoTask{Description: "saved"}, ReplyCh: reply}
+	<-reply
+	if got, err := Reload(reqs, "d"); err != nil || len(got) != 1 || got[0].Description != "saved" {
+		t.Fatalf("reload of own write = %+v, %v", got, err)
+	}
+	if err := SaveFile(edited, Paths{Dir: dir}.UserFile("d")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Reload(reqs, "d"); err != nil || !reflect.DeepEqual(got, edited) {
+		t.Fatalf("reload of external edit = %+v, %v", got, err)
+	}
+}
+
+func TestClusterReplicatesAndFailsOver(t *testing.T) {
+	var peers []ClusterPeer
+	dirs := make(map[string]string)
+	for i := 1; i <= 3; i++ {
+		id := fmt.Sprintf("n%d", i)
+		peers = append(peers, ClusterPeer{ID: id, RaftAddr: freeAddr(t), URL: "http://" + id + ".invalid"})
+		dirs[id] = t.TempDir()
+	}
+	start := func(id string) *Cluster {
+		cfg := DefaultConfig()
+		cfg.DataDir = dirs[id]
+		cfg.Store = &JSONStore{Dir: dirs[id]}
+		cfg.Cluster = ClusterConfig{NodeID: id, Peers: peers, Followers: FollowersRedirect, Reads: ReadsLocal}
+		c, err := StartCluster(cfg)
+		if err != nil {
+			t.Fatalf("start %s: %v", id, err)
+		}
+		return c
+	}
+	nodes := make(map[string]*Cluster)
+	for _, p := range peers {
+		nodes[p.ID] = start(p.ID)
+	}
+	defer func() {
+		for _, c := range nodes {
+			c.Shutdown()
+		}
+	}()
+	send := func(c *Cluster, op string, task ToDoTask) Response {
+		reply := make(chan Response, 1)
+		c.Actor() <- Request{Op: op, UserID: "u", Task: task, ReplyCh: reply}
+		return <-reply
+	}
+	waitFor := func(want []ToDoTask) {
+		t.Helper()
+		for id, c := range nodes {
+			var got []ToDoTask
+			for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+				if got = send(c, "list", ToDoTask{}).Tasks; reflect.DeepEqual(got, want) {
+					break
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("node %s has %+v, want %+v", id, got, want)
+			}
+		}
+	}
+	leader := func() *Cluster {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			for _, c := range nodes {
+				if c.IsLeader() {
+					return c
+				}
+			}
+		}
+		t.Fatal("no leader elected")
+		return nil
+	}
+
+	first := leader()
+	if res := send(first, "add", ToDoTask{Description: "a"}); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	a := ToDoTask{Description: "a", Status: "not started"}
+	waitFor([]ToDoTask{a})
+	for _, c := range nodes {
+		if c == first {
+			continue
+		}
+		var notLeader *NotLeaderError
+		res := send(c, "add", ToDoTask{Description: "x"})
+		if !errors.As(res.Err, &notLeader) || notLeader.Leader != "http://"+first.Leader()+".invalid" || notLeader.Path != "/todo/users/u" {
+			t.Errorf("write to a follower: expected a redirect to the leader, got %v", res.Err)
+		}
+	}
+
+	// the other two elect a new leader and keep taking writes
+	oldID := first.Leader()
+	first.Shutdown()
+	delete(nodes, oldID)
+	if res := send(first, "list", ToDoTask{}); !errors.Is(res.Err, ErrUnavailable) {
+		t.Errorf("request after Shutdown: expected ErrUnavailable, got %v", res.Err)
+	}
+	if res := send(leader(), "add", ToDoTask{Description: "b"}); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	b := ToDoTask{Description: "b", Status: "not started"}
+	waitFor([]ToDoTask{a, b})
+
+	// a restarted node rebuilds its state from its log without applying anything twice
+	nodes[oldID] = start(oldID)
+	waitFor([]ToDoTask{a, b})
+	if got, err := LoadFile(Paths{Dir: dirs[oldID]}.UserFile("u")); err != nil || !reflect.DeepEqual(got, []ToDoTask{a, b}) {
+		t.Errorf("restarted node's file has %+v, %v", got, err)
+	}
+}
+
+func TestClusterCountsOpsOnce(t *testing.T) {
+	var peers []ClusterPeer
+	for _, id := range []string{"n1", "n2", "n3"} {
+		peers = append(peers, ClusterPeer{ID: id, RaftAddr: freeAddr(t), URL: "http://" + id + ".invalid"})
+	}
+	var nodes []*Cluster
+	for _, p := range peers {
+		cfg := DefaultConfig()
+		cfg.DataDir = t.TempDir()
+		cfg.Store = NewMemStore()
+		cfg.Limits.MaxOpsPerMinute = 2
+		cfg.Cluster = ClusterConfig{NodeID: p.ID, Peers: peers, Followers: FollowersRedirect, Reads: ReadsLinearizable}
+		c, err := StartCluster(cfg)
+		if err != nil {
+			t.Fatalf("start %s: %v", p.ID, err)
+		}
+		defer c.Shutdown()
+		nodes = append(nodes, c)
+	}
+	var leader, follower *Cluster
+	for deadline := time.Now().Add(10 * time.Second); leader == nil && time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		for _, c := range nodes {
+			if c.IsLeader() {
+				leader = c
+			} else {
+				follower = c
+			}
+		}
+	}
+	if leader == nil {
+		t.Fatal("no leader elected")
+	}
+	read := func(c *Cluster) error {
+		reply := make(chan Response, 1)
+		c.Actor() <- Request{Op: "list", UserID: "u", ReplyCh: reply}
+		return (<-reply).Err
+	}
+
+	// the follower sends linearizable reads on without using up the quota
+	for i := 0; i < 3; i++ {
+		var notLeader *NotLeaderError
+		if err := read(follower); !errors.As(err, &notLeader) {
+			t.Fatalf("read %d on the follower: expected a redirect, got %v", i, err)
+		}
+	}
+	// so the leader, where they are served, still has the whole quota
+	for i, quota := range []bool{false, false, true} {
+		if err := read(leader); errors.Is(err, ErrQuotaExceeded) != quota {
+			t.Errorf("read %d on the leader: got %v", i, err)
+		}
+	}
+}
+
+func TestClusterFSMStopsOnStorageFailure(t *testing.T) {
+	store := &failingStore{MemStore: NewMemStore()}
+	cfg := DefaultConfig()
+	cfg.Store = store
+	reqs := make(chan Request)
+	defer close(reqs)
+	go RunActor(reqs, nil, cfg)
+	fsm := &clusterFSM{actor: reqs, failed: make(chan struct{})}
+	entry := func(index uint64, desc string) Response {
+		data, _ := json.Marshal(raftCommand{Op: "add", UserID: "u", Task: ToDoTask{Description: desc}})
+		return fsm.Apply(&raft.Log{Index: index, Data: data}).(Response)
+	}
+
+	if res := entry(1, "a"); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	store.failing = true
+	if res := entry(2, "b"); !errors.Is(res.Err, ErrStorage) {
+		t.Fatalf("expected ErrStorage, got %v", res.Err)
+	}
+	select {
+	case <-fsm.failed:
+	default:
+		t.Fatal("expected the FSM to fail after a storage error")
+	}
+	// later entries are refused even once the store works again
+	store.failing = false
+	if res := entry(3, "c"); !errors.Is(res.Err, ErrStorage) {
+		t.Errorf("entry after the failure: expected ErrStorage, got %v", res.Err)
+	}
+	if tasks, _ := store.Load("u"); len(tasks) != 1 {
+		t.Errorf("store has %+v, want only the first entry", tasks)
+	}
+}
+
+// freeAddr returns a loopback address nothing listens on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestActorQuery(t *testing.T) {
+	tasks := []ToDoTask{
+		{Description: "file taxes #home due:2025-04-15", Status: "not started"},
+		{Description: "review PR +work", Status: "started"},
+		{Description: "buy milk #home", Status: "completed"},
+		{Description: "plan offsite +work due:2025-05-01", Status: "not started"},
+		{Description: "call plumber #HOME due:2025-03-01", Status: "Not Started"},
+	}
+	cfg := DefaultConfig()
+	cfg.Store = NewMemStore()
+	reqs := make(chan Request)
+	defer close(reqs)
+	go RunActor(reqs, map[string][]ToDoTask{"q": tasks}, cfg)
+
+	date := func(s string) time.Time { d, _ := time.Parse(DueLayout, s); return d }
+	tests := []struct {
+		name  string
+		query Query
+		want  []int
+		total int
+		next  int // Index of Next, -1 for the last page
+	}{
+		{"everything", Query{}, []int{0, 1, 2, 3, 4}, 5, -1},
+		{"status ignores case", Query{Status: []string{"not started"}}, []int{0, 3, 4}, 3, -1},
+		{"tag ignores case", Query{Tag: "home"}, []int{0, 2, 4}, 3, -1},
+		{"due range", Query{DueFrom: date("2025-04-01"), DueTo: date("2025-04-30")}, []int{0}, 1, -1},
+		{"text", Query{Text: "PLAN"}, []int{3}, 1, -1},
+		{"first page", Query{Tag: "home", Limit: 2}, []int{0, 2}, 3, 2},
+		{"last page", Query{Tag: "home", Limit: 2, After: &PageKey{Index: 2, Sum: taskSum(tasks[2])}}, []int{4}, 3, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := QueryTasks(reqs, "q", tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := -1
+			if page.Next != nil {
+				next = page.Next.Index
+			}
+			if !reflect.DeepEqual(page.Indexes, tt.want) || page.Total != tt.total || next != tt.next {
+				t.Errorf("got indexes %v total %d next %d, want %v %d %d", page.Indexes, page.Total, next, tt.want, tt.total, tt.next)
+			}
+			for i, idx := range page.Indexes {
+				if page.Tasks[i] != tasks[idx] {
+					t.Errorf("task %d = %+v, want %+v", i, page.Tasks[i], tasks[idx])
+				}
+			}
+		})
+	}
+
+	// deleting a task the first page returned must not make the second skip one
+	first, _ := QueryTasks(reqs, "q", Query{Tag: "home", Limit: 2})
+	reply := make(chan Response, 1)
+	reqs <- Request{Op: "delete", UserID: "q", Index: 0, ReplyCh: reply}
+	if res := <-reply; res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	second, err := QueryTasks(reqs, "q", Query{Tag: "home", Limit: 2, After: first.Next})
+	if err != nil || len(second.Tasks) != 1 || second.Tasks[0] != tasks[4] {
+		t.Errorf("page after a delete = %+v, %v; want %+v", second, err, tasks[4])
+	}
+}
+
 /*
 
 func TestActorConcurrentUpdated(t *testing.T) {
@@ -125,3 +616,55 @@ func TestActorConcurrentUpdated(t *testing.T) {
 }
 
 */
+
+func TestActorPatch(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Store = NewMemStore()
+	reqs := make(chan Request)
+	defer close(reqs)
+	go RunActor(reqs, map[string][]ToDoTask{"p": {{Description: "water plants", Status: "started"}}}, cfg)
+
+	// the CLI's -update changes only the flags it is given
+	if err := Run([]string{"todo", "-user=p", "-update=0", "-status=completed"}, reqs); err != nil {
+		t.Fatal(err)
+	}
+	if err := Run([]string{"todo", "status", "-user=p", "0", "on", "hold"}, reqs); err != nil {
+		t.Fatal(err)
+	}
+	desc := "water the plants"
+	got, err := PatchTask(reqs, "p", 0, TaskPatch{Description: &desc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ToDoTask{Description: "water the plants", Status: "on hold"}); *got != want {
+		t.Errorf("after patches got %+v, want %+v", *got, want)
+	}
+
+	p, err := ParseJSONPatch([]byte(`[{"op":"test","path":"/status","value":"started"},{"op":"replace","path":"/status","value":"done"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PatchTask(reqs, "p", 0, *p); !errors.Is(err, ErrConflict) {
+		t.Errorf("failed test op: expected ErrConflict, got %v", err)
+	}
+	if _, err := PatchTask(reqs, "p", 3, *p); !errors.Is(err, ErrNotFound) {
+		t.Errorf("bad index: expected ErrNotFound, got %v", err)
+	}
+	if err := Run([]string{"todo", "-user=p", "-update=0"}, reqs); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("-update without fields: expected ErrInvalidInput, got %v", err)
+	}
+	for _, body := range []string{`{"status":null}`, `{"status":""}`, `{"owner":"x"}`, `[1]`} {
+		if _, err := ParseMergePatch([]byte(body)); !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("merge patch %s: expected ErrInvalidInput, got %v", body, err)
+		}
+	}
+	// patches built in code are checked too, as the REPL's -task="" is
+	for _, bad := range []string{"", "  ", "bell\a"} {
+		if _, err := PatchTask(reqs, "p", 0, TaskPatch{Description: &bad}); !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("patch to description %q: expected ErrInvalidInput, got %v", bad, err)
+		}
+	}
+	if got, _ := PatchTask(reqs, "p", 0, TaskPatch{}); got == nil || got.Description != "water the plants" {
+		t.Errorf("task after rejected patches = %+v", got)
+	}
+}
@@ -0,0 +1,99 @@
+package todo
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BackupSuffix is appended to a user file to name its previous generation.
+const BackupSuffix = ".bak"
+
+// writeFileAtomic replaces path with data without ever exposing a partially written file.
+// The data goes to a temp file in the same directory which is fsynced and renamed over
+// path; the old contents are kept as path+BackupSuffix.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op once the rename has happened
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, perm)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := keepPreviousGeneration(path); err != nil {
+		slog.Warn("could not keep previous generation", "file", path, "error", err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// keepPreviousGeneration points path+BackupSuffix at the current contents of path.
+func keepPreviousGeneration(path string) error {
+	bak := path + BackupSuffix
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	os.Remove(bak)
+	if err := os.Link(path, bak); err == nil {
+		return nil
+	}
+	// hard links are not supported everywhere, fall back to a copy
+	return copyFile(path, bak)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir fsyncs a directory so a rename inside it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync %s: %w", dir, err)
+	}
+	return nil
+}
+
+// quarantine moves a file that cannot be read aside so it is not overwritten by the next save.
+func quarantine(path string) (string, error) {
+	dst := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+	return dst, os.Rename(path, dst)
+}
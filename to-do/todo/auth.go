@@ -0,0 +1,307 @@
+package todo
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API authentication modes, see AuthConfig.
+const (
+	AuthOff      = "off"      // every request is let through, as before authentication existed
+	AuthRequired = "required" // every API request needs a token or JWT
+)
+
+// AuthConfig controls API authentication.
+type AuthConfig struct {
+	Mode      string // AuthOff or AuthRequired
+	JWTSecret string // HS256 key for JWTs; "" accepts none
+	Token     string // what a CLI, REPL or cluster node sends to a server, a token or JWT
+}
+
+// Identity is who an authenticated request comes from.
+type Identity struct {
+	User  string // whose list it may use
+	Admin bool   // may use every list and the admin endpoints
+	Via   string // "token" or "jwt"
+}
+
+// CanUse reports whether id may read and change user's list.
+func (id *Identity) CanUse(user string) bool {
+	return id != nil && (id.Admin || id.User == user)
+}
+
+// APIToken is a personal API token. Only a hash of its secret is kept.
+type APIToken struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Admin   bool      `json:"admin"`
+	Name    string    `json:"name,omitempty"`
+	Created time.Time `json:"created"`
+	Hash    string    `json:"hash,omitempty"` // hex SHA-256 of the secret, never sent to clients
+}
+
+// tokenPrefix starts every token secret, which is tokenPrefix + ID + "_" + random part.
+const tokenPrefix = "todo_"
+
+// TokenStore keeps API tokens in a JSON file. It is read again whenever the file
+// changes, so tokens the CLI issues or revokes apply to a running server at once.
+type TokenStore struct {
+	Path string
+
+	mu     sync.Mutex
+	stamp  string // modification time and size of Path when tokens was read
+	tokens []APIToken
+}
+
+// NewTokenStore keeps tokens in dir's tokens.json, see Paths.Tokens.
+func NewTokenStore(dir string) *TokenStore {
+	return &TokenStore{Path: Paths{Dir: dir}.Tokens()}
+}
+
+// load refreshes s.tokens from disk if the file changed. Callers hold s.mu.
+func (s *TokenStore) load() error {
+	info, err := os.Stat(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.tokens, s.stamp = nil, ""
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	stamp := fmt.Sprint(info.ModTime().UnixNano(), info.Size())
+	if stamp == s.stamp {
+		return nil
+	}
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	var tokens []APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrStorage, s.Path, err)
+	}
+	s.tokens, s.stamp = tokens, stamp
+	return nil
+}
+
+// update applies change to the tokens on disk, holding the store lock of their
+// directory so a CLI and a server never overwrite each other's changes.
+func (s *TokenStore) update(change func([]APIToken) ([]APIToken, error)) error {
+	unlock, err := (&JSONStore{Dir: filepath.Dir(s.Path)}).lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stamp = "" // always read under the lock
+	if err := s.load(); err != nil {
+		return err
+	}
+	tokens, err := change(append([]APIToken(nil), s.tokens...))
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.Path, data, 0600); err != nil {
+		return fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	s.stamp = ""
+	return nil
+}
+
+// List returns every token, without hashes.
+func (s *TokenStore) List() ([]APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	out := make([]APIToken, len(s.tokens))
+	for i, t := range s.tokens {
+		t.Hash = ""
+		out[i] = t
+	}
+	return out, nil
+}
+
+// Issue creates a token for user and returns its secret, which is not stored and
+// cannot be shown again.
+func (s *TokenStore) Issue(user, name string, admin bool) (string, APIToken, error) {
+	if user == "" {
+		return "", APIToken{}, &ValidationError{Field: "user", Reason: "is required"}
+	}
+	if err := ValidateUserID(user); err != nil {
+		return "", APIToken{}, err
+	}
+	id, random := make([]byte, 4), make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return "", APIToken{}, err
+	}
+	if _, err := rand.Read(random); err != nil {
+		return "", APIToken{}, err
+	}
+	secret := tokenPrefix + hex.EncodeToString(id) + "_" + base64.RawURLEncoding.EncodeToString(random)
+	tok := APIToken{ID: hex.EncodeToString(id), User: user, Admin: admin, Name: name, Created: time.Now().UTC(), Hash: hashSecret(secret)}
+	err := s.update(func(tokens []APIToken) ([]APIToken, error) {
+		return append(tokens, tok), nil
+	})
+	tok.Hash = ""
+	return secret, tok, err
+}
+
+// Revoke deletes the token with id. An unknown id is ErrNotFound.
+func (s *TokenStore) Revoke(id string) error {
+	return s.update(func(tokens []APIToken) ([]APIToken, error) {
+		for i, t := range tokens {
+			if t.ID == id {
+				return append(tokens[:i], tokens[i+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("%w: no token %q", ErrNotFound, id)
+	})
+}
+
+// Lookup returns the token secret belongs to, or ErrUnauthenticated.
+func (s *TokenStore) Lookup(secret string) (*APIToken, error) {
+	rest, ok := strings.CutPrefix(secret, tokenPrefix)
+	id, _, ok2 := strings.Cut(rest, "_")
+	if !ok || !ok2 {
+		return nil, fmt.Errorf("%w: malformed API token", ErrUnauthenticated)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	hash := hashSecret(secret)
+	for _, t := range s.tokens {
+		if t.ID == id && subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown or revoked API token", ErrUnauthenticated)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// JWTClaims are the claims of the HS256 JWTs the API accepts. Exp is required.
+type JWTClaims struct {
+	Subject   string `json:"sub"`
+	Admin     bool   `json:"admin,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+// jwtLeeway allows for clock differences between the issuer and the server.
+const jwtLeeway = 30 * time.Second
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// SignJWT returns c as a JWT signed with secret.
+func SignJWT(secret []byte, c JWTClaims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + jwtSignature(secret, signed), nil
+}
+
+// VerifyJWT checks token's HS256 signature and times and returns its claims. Errors
+// match ErrUnauthenticated.
+func VerifyJWT(secret []byte, token string, now time.Time) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed JWT", ErrUnauthenticated)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if data, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil || json.Unmarshal(data, &header) != nil || header.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: JWT must be signed with HS256", ErrUnauthenticated)
+	}
+	want := jwtSignature(secret, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(want)) {
+		return nil, fmt.Errorf("%w: bad JWT signature", ErrUnauthenticated)
+	}
+	var c JWTClaims
+	if data, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(data, &c) != nil {
+		return nil, fmt.Errorf("%w: malformed JWT claims", ErrUnauthenticated)
+	}
+	switch {
+	case c.Subject == "":
+		return nil, fmt.Errorf("%w: JWT has no sub", ErrUnauthenticated)
+	case c.ExpiresAt == 0:
+		return nil, fmt.Errorf("%w: JWT has no exp", ErrUnauthenticated)
+	case now.Add(-jwtLeeway).Unix() >= c.ExpiresAt:
+		return nil, fmt.Errorf("%w: JWT expired", ErrUnauthenticated)
+	case c.NotBefore != 0 && now.Add(jwtLeeway).Unix() < c.NotBefore:
+		return nil, fmt.Errorf("%w: JWT not valid yet", ErrUnauthenticated)
+	}
+	return &c, nil
+}
+
+func jwtSignature(secret []byte, signed string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticator checks the credentials of API requests.
+type Authenticator struct {
+	Required  bool        // when false every request is let through
+	Tokens    *TokenStore // personal API tokens
+	JWTSecret []byte      // HS256 key; nil accepts no JWTs
+}
+
+// NewAuthenticator checks requests as cfg.Auth says, with tokens from the data directory.
+func NewAuthenticator(cfg Config) *Authenticator {
+	a := &Authenticator{Required: cfg.Auth.Mode == AuthRequired, Tokens: NewTokenStore(dataDir(cfg))}
+	if cfg.Auth.JWTSecret != "" {
+		a.JWTSecret = []byte(cfg.Auth.JWTSecret)
+	}
+	return a
+}
+
+// Authenticate returns who bearer, an API token or a JWT, belongs to. Errors match
+// ErrUnauthenticated.
+func (a *Authenticator) Authenticate(bearer string) (*Identity, error) {
+	if bearer == "" {
+		return nil, fmt.Errorf("%w: send an API token or JWT as \"Authorization: Bearer <token>\"", ErrUnauthenticated)
+	}
+	if strings.HasPrefix(bearer, tokenPrefix) {
+		t, err := a.Tokens.Lookup(bearer)
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{User: t.User, Admin: t.Admin, Via: "token"}, nil
+	}
+	if a.JWTSecret == nil {
+		return nil, fmt.Errorf("%w: not an API token, and JWTs are not enabled", ErrUnauthenticated)
+	}
+	c, err := VerifyJWT(a.JWTSecret, bearer, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{User: c.Subject, Admin: c.Admin, Via: "jwt"}, nil
+}
@@ -0,0 +1,347 @@
+package todo
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	backupPrefix     = "todo-backup-"
+	backupSuffix     = ".tar.gz"
+	backupTimeFormat = "20060102T150405Z"
+	backupManifest   = "manifest.json"
+)
+
+// BackupManifest is stored in every archive next to the user files.
+type BackupManifest struct {
+	CreatedAt     time.Time      `json:"created_at"`
+	SchemaVersion int            `json:"schema_version"`
+	Encrypted     bool           `json:"encrypted"`
+	Users         map[string]int `json:"users"` // user -> number of tasks
+}
+
+// handleSnapshot returns a copy of every user's list as the actor sees it, unsaved
+// write-behind changes included. The actor serves nothing else meanwhile, so the copy
+// is consistent across users.
+func (a *actorState) handleSnapshot() Response {
+	if a.rows != nil {
+		lists, err := LoadAll(a.rows)
+		if err != nil {
+			return Response{Err: fmt.Errorf("%w: snapshot: %v", ErrStorage, err)}
+		}
+		return Response{Lists: lists}
+	}
+	lists := make(map[string][]ToDoTask, len(a.lists))
+	for user, tasks := range a.lists {
+		lists[user] = append([]ToDoTask(nil), tasks...)
+	}
+	return Response{Lists: lists}
+}
+
+// Snapshot asks the actor for a consistent copy of every user's list.
+func Snapshot(actor chan Request) (map[string][]ToDoTask, error) {
+	reply := make(chan Response, 1)
+	actor <- Request{Op: "snapshot", ReplyCh: reply}
+	resp := <-reply
+	return resp.Lists, resp.Err
+}
+
+// backupDir is where archives go unless a command overrides it.
+func backupDir(cfg Config) string {
+	if cfg.BackupDir != "" {
+		return cfg.BackupDir
+	}
+	return filepath.Join(dataDir(cfg), "backups")
+}
+
+// Backup writes a snapshot of every user to a timestamped archive in dir and returns its
+// path. Each user is staged with the same code that writes the data directory (and its
+// encryption, when keys is set), so a restore reads the files back like any other.
+func Backup(actor chan Request, dir string, keys *Keyring) (string, error) {
+	lists, err := Snapshot(actor)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	stage, err := os.MkdirTemp(dir, ".stage-*")
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	defer os.RemoveAll(stage)
+
+	now := time.Now().UTC()
+	manifest := BackupManifest{CreatedAt: now, SchemaVersion: CurrentSchemaVersion, Encrypted: keys != nil, Users: make(map[string]int)}
+	users := make([]string, 0, len(lists))
+	for user, tasks := range lists {
+		if err := saveFile(tasks, Paths{Dir: stage}.UserFile(user), keys); err != nil {
+			return "", fmt.Errorf("%w: stage user %q: %v", ErrStorage, user, err)
+		}
+		manifest.Users[user] = len(tasks)
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(stage, backupManifest), data, 0600); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+
+	names := []string{backupManifest}
+	for _, user := range users {
+		names = append(names, filepath.Base(Paths{Dir: stage}.UserFile(user)))
+	}
+	path := filepath.Join(dir, backupPrefix+now.Format(backupTimeFormat)+backupSuffix)
+	if err := writeArchive(path, stage, names); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	slog.Info("backup written", "file", path, "users", len(users))
+	return path, nil
+}
+
+// writeArchive tars and gzips the named files of dir into path, via a temp file that is
+// fsynced and renamed so a half-written archive is never left under the final name.
+func writeArchive(path, dir string, names []string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		if err = addToArchive(tw, filepath.Join(dir, name)); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func addToArchive(tw *tar.Writer, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: filepath.Base(path), Mode: 0600, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// ReadBackup unpacks an archive written by Backup into a temp directory and reads the
+// user files from there. Entries that are not user files or the manifest are ignored.
+func ReadBackup(path string, keys *Keyring) (map[string][]ToDoTask, *BackupManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s is not a backup archive: %v", ErrInvalidInput, path, err)
+	}
+	stage, err := os.MkdirTemp("", "todo-restore-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(stage)
+
+	var manifest BackupManifest
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: corrupt archive %s: %v", ErrInvalidInput, path, err)
+		}
+		name := hdr.Name
+		user, isUser := UserFromFile(name)
+		switch {
+		case hdr.Typeflag != tar.TypeReg || strings.ContainsAny(name, `/\`):
+			continue
+		case name == backupManifest:
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return nil, nil, fmt.Errorf("%w: bad manifest in %s: %v", ErrInvalidInput, path, err)
+			}
+			continue
+		case !isUser || ValidateUserID(user) != nil:
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := os.WriteFile(filepath.Join(stage, name), data, 0600); err != nil {
+			return nil, nil, err
+		}
+	}
+	// read like LoadAllTasksInDir, but a damaged entry fails the restore instead of
+	// being recovered as an empty list
+	store := &JSONStore{Dir: stage, Keys: keys}
+	users, err := store.Users()
+	if err != nil {
+		return nil, nil, err
+	}
+	lists := make(map[string][]ToDoTask, len(users))
+	for _, user := range users {
+		if lists[user], err = readTasks(store.path(user), keys); err != nil {
+			return nil, nil, fmt.Errorf("%w: user %q in %s: %v", ErrInvalidInput, user, path, err)
+		}
+	}
+	return lists, &manifest, nil
+}
+
+// Restore replaces users' lists through the actor with those in the archive, so it
+// works the same against a running server and a freshly started one. With user set only
+// that user is restored. Users that are not in the archive are left alone. It returns
+// the users restored.
+func Restore(actor chan Request, path string, keys *Keyring, user string) ([]string, error) {
+	lists, _, err := ReadBackup(path, keys)
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for u := range lists {
+		if user == "" || u == user {
+			users = append(users, u)
+		}
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%w: no matching users in %s", ErrNotFound, path)
+	}
+	sort.Strings(users)
+	for i, u := range users {
+		if err := Replace(actor, u, lists[u]); err != nil {
+			return users[:i], fmt.Errorf("restore user %q: %w", u, err)
+		}
+	}
+	return users, nil
+}
+
+// backupTime parses the time out of an archive name written by Backup.
+func backupTime(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix))
+	return t, err == nil
+}
+
+// PruneBackups applies the retention policy to the archives in dir: the newest archive
+// of each of the last keepHourly hours and of each of the last keepDaily days that have
+// one is kept, everything else is removed. It returns the removed files.
+func PruneBackups(dir string, keepHourly, keepDaily int) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type archive struct {
+		name string
+		at   time.Time
+	}
+	var archives []archive
+	for _, e := range entries {
+		if at, ok := backupTime(e.Name()); ok && !e.IsDir() {
+			archives = append(archives, archive{e.Name(), at})
+		}
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].at.After(archives[j].at) })
+
+	keep := make(map[string]bool)
+	hours := make(map[time.Time]bool)
+	days := make(map[time.Time]bool)
+	for _, a := range archives {
+		hour := a.at.Truncate(time.Hour)
+		if !hours[hour] && len(hours) < keepHourly {
+			hours[hour] = true
+			keep[a.name] = true
+		}
+		day := time.Date(a.at.Year(), a.at.Month(), a.at.Day(), 0, 0, 0, 0, time.UTC)
+		if !days[day] && len(days) < keepDaily {
+			days[day] = true
+			keep[a.name] = true
+		}
+	}
+
+	var removed []string
+	for _, a := range archives {
+		if keep[a.name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, a.name)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, a.name)
+	}
+	return removed, nil
+}
+
+// RunBackups takes a backup every cfg.BackupInterval and prunes old ones with the
+// configured retention, until ctx is done. It does nothing when the interval is 0.
+func RunBackups(ctx context.Context, cfg Config, actor chan Request) {
+	if cfg.BackupInterval <= 0 {
+		return
+	}
+	keys, err := cfg.keyring()
+	if err != nil {
+		slog.Error("scheduled backups disabled", "error", err)
+		return
+	}
+	dir := backupDir(cfg)
+	ticker := time.NewTicker(cfg.BackupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := Backup(actor, dir, keys); err != nil {
+			slog.Error("scheduled backup failed", "error", err)
+			continue
+		}
+		removed, err := PruneBackups(dir, cfg.BackupKeepHourly, cfg.BackupKeepDaily)
+		if err != nil {
+			slog.Error("pruning backups failed", "error", err)
+		}
+		if len(removed) > 0 {
+			slog.Info("pruned old backups", "removed", removed)
+		}
+	}
+}
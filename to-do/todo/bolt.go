@@ -0,0 +1,225 @@
+package todo
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltFile is the bbolt database file name used inside the data directory.
+const BoltFile = "todo.bolt"
+
+// BoltStore keeps one bucket per user and one key per task. Keys are the bucket's
+// NextSequence as 8 big-endian bytes, so cursor order is insertion order and a task's
+// position in the list is its position in the bucket. Every method is a single
+// transaction. It is a RowStore, so nothing is parsed at startup.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens (creating if needed) the database at path.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Load(user string) ([]ToDoTask, error) {
+	var tasks []ToDoTask
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(user))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var t ToDoTask
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			tasks = append(tasks, t)
+			return nil
+		})
+	})
+	return tasks, err
+}
+
+// Save replaces the user's bucket with tasks.
+func (s *BoltStore) Save(user string, tasks []ToDoTask) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(user)) != nil {
+			if err := tx.DeleteBucket([]byte(user)); err != nil {
+				return err
+			}
+		}
+		b, err := tx.CreateBucket([]byte(user))
+		if err != nil {
+			return err
+		}
+		for _, t := range tasks {
+			if err := putNext(b, t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Users() ([]string, error) {
+	var users []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			users = append(users, string(name))
+			return nil
+		})
+	})
+	return users, err
+}
+
+func (s *BoltStore) Delete(user string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(user))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *BoltStore) Count(user string) (int, error) {
+	n := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(user)); b != nil {
+			n = b.Stats().KeyN
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (s *BoltStore) Get(user string, index int) (ToDoTask, error) {
+	var t ToDoTask
+	err := s.db.View(func(tx *bolt.Tx) error {
+		_, v, err := keyAt(tx.Bucket([]byte(user)), user, index)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(v, &t)
+	})
+	return t, err
+}
+
+func (s *BoltStore) Insert(user string, t ToDoTask) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(user))
+		if err != nil {
+			return err
+		}
+		return putNext(b, t)
+	})
+}
+
+func (s *BoltStore) UpdateAt(user string, index int, t ToDoTask) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(user))
+		k, _, err := keyAt(b, user, index)
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return b.Put(k, v)
+	})
+}
+
+func (s *BoltStore) DeleteAt(user string, index int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(user))
+		k, _, err := keyAt(b, user, index)
+		if err != nil {
+			return err
+		}
+		return b.Delete(k)
+	})
+}
+
+// putNext stores t under the bucket's next sequence number.
+func putNext(b *bolt.Bucket, t ToDoTask) error {
+	id, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return b.Put(key, v)
+}
+
+// keyAt walks the bucket to the task at position index. The returned key is only valid
+// for the life of the transaction.
+func keyAt(b *bolt.Bucket, user string, index int) ([]byte, []byte, error) {
+	n := 0
+	if b != nil {
+		n = b.Stats().KeyN
+	}
+	if index < 0 || index >= n {
+		return nil, nil, &IndexError{UserID: user, Index: index, Len: n}
+	}
+	c := b.Cursor()
+	k, v := c.First()
+	for i := 0; i < index; i++ {
+		k, v = c.Next()
+	}
+	return k, v, nil
+}
+
+// Query pages through the user's bucket without loading it into a list. PageKey.Row is
+// the task's key, which deletes do not change.
+func (s *BoltStore) Query(user string, q Query) (*Page, error) {
+	page := newPage()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(user))
+		if b == nil {
+			return nil
+		}
+		var lastKey int64
+		i := 0
+		return b.ForEach(func(k, v []byte) error {
+			defer func() { i++ }()
+			var t ToDoTask
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if !q.Match(t) {
+				return nil
+			}
+			page.Total++
+			key := int64(binary.BigEndian.Uint64(k))
+			if q.After != nil && key <= q.After.Row {
+				return nil
+			}
+			if page.add(&q, t, i) {
+				lastKey = key
+			} else if page.Next == nil {
+				page.Next = &PageKey{Row: lastKey, Index: page.last()}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
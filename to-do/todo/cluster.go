@@ -0,0 +1,511 @@
+package todo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// How a follower treats a write in cluster mode.
+const (
+	FollowersForward  = "forward"  // send the write on to the leader's API and relay the reply
+	FollowersRedirect = "redirect" // reply with a NotLeaderError, a 307 to the leader over HTTP
+)
+
+// Where reads are served in cluster mode.
+const (
+	ReadsLocal        = "local"        // any node answers from its own copy, which may lag the leader
+	ReadsLinearizable = "linearizable" // the leader answers after a Raft barrier
+)
+
+// applyTimeout bounds how long a write waits to be committed.
+const applyTimeout = 10 * time.Second
+
+// maxClusterRequests bounds the requests a node handles at once; further ones wait in
+// the Actor channel.
+const maxClusterRequests = 64
+
+// ClusterPeer is one node of a cluster.
+type ClusterPeer struct {
+	ID       string
+	RaftAddr string // host:port of the node's Raft transport
+	URL      string // base URL of the node's API, e.g. http://10.0.0.2:8080
+}
+
+// ClusterConfig turns on cluster mode when NodeID is set, see StartCluster.
+type ClusterConfig struct {
+	NodeID    string
+	Peers     []ClusterPeer // every node, this one included, the same on all nodes
+	Dir       string        // Raft log and snapshots, "" is <data dir>/raft
+	Followers string        // FollowersForward or FollowersRedirect
+	Reads     string        // ReadsLocal or ReadsLinearizable
+}
+
+// ParsePeers reads comma separated "id=raft-host:port=api-url" entries, as in
+// TODO_CLUSTER_PEERS=n1=10.0.0.1:7000=http://10.0.0.1:8080,n2=...
+func ParsePeers(s string) ([]ClusterPeer, error) {
+	var peers []ClusterPeer
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("%w: cluster peer %q is not id=raft-host:port=api-url", ErrInvalidInput, field)
+		}
+		peers = append(peers, ClusterPeer{ID: parts[0], RaftAddr: parts[1], URL: strings.TrimRight(parts[2], "/")})
+	}
+	return peers, nil
+}
+
+func (cc ClusterConfig) peer(id string) (ClusterPeer, bool) {
+	for _, p := range cc.Peers {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return ClusterPeer{}, false
+}
+
+// NotLeaderError answers a write sent to a follower in FollowersRedirect mode. Leader is
+// the leader's API base URL and Path the request's path there. It matches ErrUnavailable.
+type NotLeaderError struct {
+	Leader string
+	Path   string
+}
+
+func (e *NotLeaderError) Error() string {
+	return "this node is not the cluster leader, send writes to " + e.Leader
+}
+
+func (e *NotLeaderError) Is(target error) bool { return target == ErrUnavailable }
+
+// raftCommand is a mutation as it is stored in the Raft log.
+type raftCommand struct {
+	Op     string     `json:"op"`
+	UserID string     `json:"user"`
+	Index  int        `json:"index,omitempty"`
+	Task   ToDoTask   `json:"task"`
+	Tasks  []ToDoTask `json:"tasks,omitempty"`
+	Patch  *TaskPatch `json:"patch,omitempty"`
+}
+
+// Cluster is one node of a Raft-replicated todo service. Its actor only changes when a
+// committed log entry is applied, on every node in the same order; Actor is what the
+// rest of the program sends requests to.
+type Cluster struct {
+	cc       ClusterConfig
+	limits   Limits
+	raft     *raft.Raft
+	fsm      *clusterFSM
+	local    chan Request // the node's own actor
+	reqs     chan Request
+	done     chan struct{} // closed by Shutdown
+	served   chan struct{} // closed once serve has handed out its last request
+	inFlight sync.WaitGroup
+	forward  map[string]*remote // by peer ID
+	trans    *raft.NetworkTransport
+	logs     *raftboltdb.BoltStore
+
+	mu  sync.Mutex
+	ops *opCounter // the actor's op quota is counted here, see StartCluster
+}
+
+// StartCluster starts this node of the cluster in cfg.Cluster. A node that has no Raft
+// state yet bootstraps with the peer list; after that the state comes from the Raft
+// snapshot and log, which are replayed into a fresh actor on every start, so task files
+// already in the data directory of a new cluster are not part of it (load them through
+// the API, e.g. with import-json). Backends that answer from the store itself (sqlite,
+// bolt) cannot be replayed and are refused. Directory watching does not apply.
+func StartCluster(cfg Config) (*Cluster, error) {
+	cc := cfg.Cluster
+	me, ok := cc.peer(cc.NodeID)
+	if !ok {
+		return nil, fmt.Errorf("%w: cluster node %q is not in the peer list", ErrInvalidInput, cc.NodeID)
+	}
+	if cfg.Store == nil {
+		cfg.Store = &JSONStore{Dir: dataDir(cfg)}
+	}
+	if _, ok := cfg.Store.(RowStore); ok {
+		return nil, fmt.Errorf("%w: cluster mode needs the %s, %s or %s backend", ErrInvalidInput, BackendJSON, BackendLog, BackendMemory)
+	}
+	dir := cc.Dir
+	if dir == "" {
+		dir = filepath.Join(dataDir(cfg), "raft")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{Name: "raft-" + me.ID, Level: hclog.Info, Output: os.Stderr})
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: raft log: %v", ErrStorage, err)
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(dir, 2, logger)
+	if err != nil {
+		logs.Close()
+		return nil, fmt.Errorf("%w: raft snapshots: %v", ErrStorage, err)
+	}
+	existing, err := raft.HasExistingState(logs, logs, snaps)
+	if err != nil {
+		logs.Close()
+		return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	trans, err := raft.NewTCPTransportWithLogger(me.RaftAddr, nil, 3, applyTimeout, logger)
+	if err != nil {
+		logs.Close()
+		return nil, fmt.Errorf("raft transport on %s: %w", me.RaftAddr, err)
+	}
+
+	c := &Cluster{
+		cc:      cc,
+		limits:  cfg.Limits,
+		local:   make(chan Request),
+		reqs:    make(chan Request, 1000),
+		done:    make(chan struct{}),
+		served:  make(chan struct{}),
+		forward: make(map[string]*remote),
+		trans:   trans,
+		logs:    logs,
+		ops:     newOpCounter(),
+	}
+	for _, p := range cc.Peers {
+		c.forward[p.ID] = &remote{base: p.URL, client: &http.Client{Timeout: applyTimeout + 5*time.Second}, bearer: clusterBearer(cfg)}
+	}
+	// replayed entries must not hit a per-minute quota, it is counted where requests arrive
+	actorCfg := cfg
+	actorCfg.Limits.MaxOpsPerMinute = 0
+	go RunActor(c.local, nil, actorCfg)
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(me.ID)
+	conf.Logger = logger
+	if !existing {
+		if users, _ := cfg.Store.Users(); len(users) > 0 {
+			slog.Warn("cluster: task files already in the data directory are not part of the new cluster", "users", len(users))
+		}
+		var servers []raft.Server
+		for _, p := range cc.Peers {
+			servers = append(servers, raft.Server{ID: raft.ServerID(p.ID), Address: raft.ServerAddress(p.RaftAddr)})
+		}
+		if err := raft.BootstrapCluster(conf, logs, logs, snaps, trans, raft.Configuration{Servers: servers}); err != nil {
+			close(c.local)
+			c.closeStores()
+			return nil, fmt.Errorf("bootstrap cluster: %w", err)
+		}
+	}
+	c.fsm = &clusterFSM{actor: c.local, failed: make(chan struct{})}
+	c.raft, err = raft.NewRaft(conf, c.fsm, logs, logs, snaps, trans)
+	if err != nil {
+		close(c.local)
+		c.closeStores()
+		return nil, fmt.Errorf("start raft: %w", err)
+	}
+	slog.Info("cluster node started", "node", me.ID, "raft", me.RaftAddr, "peers", len(cc.Peers))
+	go c.serve()
+	go func() {
+		select {
+		case <-c.fsm.failed:
+			slog.Error("cluster: leaving the cluster after a local storage failure", "node", me.ID, "error", c.fsm.failure())
+			c.raft.Shutdown()
+		case <-c.done:
+		}
+	}()
+	return c, nil
+}
+
+// Actor is the request channel for this node. Mutations are replicated before they are
+// applied; reads follow cc.Reads.
+func (c *Cluster) Actor() chan Request {
+	return c.reqs
+}
+
+// Leader returns the current leader's ID, or "" while there is none.
+func (c *Cluster) Leader() string {
+	_, id := c.raft.LeaderWithID()
+	return string(id)
+}
+
+// IsLeader reports whether this node is the leader.
+func (c *Cluster) IsLeader() bool {
+	return c.raft.State() == raft.Leader
+}
+
+// Shutdown leaves the cluster and stops the actor once the requests already sent have
+// been answered. Requests sent to Actor afterwards get ErrUnavailable.
+func (c *Cluster) Shutdown() error {
+	close(c.done)
+	<-c.served
+	c.inFlight.Wait()
+	err := c.raft.Shutdown().Error()
+	close(c.local) // saves what write-behind mode still holds
+	c.closeStores()
+	return err
+}
+
+func (c *Cluster) closeStores() {
+	c.trans.Close()
+	c.logs.Close()
+}
+
+// serve hands requests to at most maxClusterRequests goroutines. Once Shutdown is called
+// it hands out what is already queued and answers everything after that itself, as other
+// goroutines may still be sending.
+func (c *Cluster) serve() {
+	slots := make(chan struct{}, maxClusterRequests)
+	dispatch := func(req Request) {
+		slots <- struct{}{}
+		c.inFlight.Add(1)
+		go func() {
+			defer func() { <-slots; c.inFlight.Done() }()
+			req.ReplyCh <- c.handle(req)
+		}()
+	}
+loop:
+	for {
+		select {
+		case req := <-c.reqs:
+			dispatch(req)
+		case <-c.done:
+			break loop
+		}
+	}
+	// serve is the only receiver, so what is queued can be taken without blocking
+	for len(c.reqs) > 0 {
+		dispatch(<-c.reqs)
+	}
+	close(c.served)
+	for req := range c.reqs {
+		req.ReplyCh <- Response{Err: fmt.Errorf("%w: cluster node is shutting down", ErrUnavailable)}
+	}
+}
+
+func (c *Cluster) handle(req Request) Response {
+	if err := c.fsm.failure(); err != nil {
+		return Response{Err: fmt.Errorf("%w: node stopped after a storage failure: %v", ErrUnavailable, err)}
+	}
+	switch req.Op {
+	case "flush", "snapshot":
+		return c.ask(req)
+	case "usage":
+		return c.usage()
+	case "get", "list", "query":
+		if c.cc.Reads == ReadsLinearizable && !c.IsLeader() {
+			return c.toLeader(req) // counted by the leader
+		}
+		if err := c.countOp(req.UserID); err != nil {
+			return Response{Err: err}
+		}
+		if c.cc.Reads == ReadsLinearizable {
+			// once the barrier is applied every write committed before this read is too
+			if err := c.raft.Barrier(applyTimeout).Error(); err != nil {
+				return Response{Err: fmt.Errorf("%w: %v", ErrUnavailable, err)}
+			}
+		}
+		return c.ask(req)
+	case "add", "update", "patch", "delete", "append", "replace":
+		if !c.IsLeader() {
+			return c.toLeader(req)
+		}
+		return c.apply(req)
+	}
+	return Response{Err: fmt.Errorf("%w: op %q is not available in cluster mode", ErrInvalidInput, req.Op)}
+}
+
+// apply replicates a mutation and returns the actor's reply to it once it is committed.
+func (c *Cluster) apply(req Request) Response {
+	if err := ValidateUserID(req.UserID); err != nil {
+		return Response{Err: err}
+	}
+	if err := c.countOp(req.UserID); err != nil {
+		return Response{Err: err}
+	}
+	data, err := json.Marshal(raftCommand{Op: req.Op, UserID: req.UserID, Index: req.Index, Task: req.Task, Tasks: req.Tasks, Patch: req.Patch})
+	if err != nil {
+		return Response{Err: err}
+	}
+	f := c.raft.Apply(data, applyTimeout)
+	if err := f.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) {
+			// never entered the log, safe to send on; the new leader counts it
+			c.uncountOp(req.UserID)
+			return c.toLeader(req)
+		}
+		return Response{Err: fmt.Errorf("%w: %s not committed: %v", ErrUnavailable, req.Op, err)}
+	}
+	return f.Response().(Response)
+}
+
+// clusterBearer is what a node sends with the requests it forwards to the leader, which
+// has already authenticated them: a short-lived admin JWT when nodes share a JWT secret,
+// else cfg.Auth.Token.
+func clusterBearer(cfg Config) func() string {
+	if cfg.Auth.JWTSecret == "" {
+		return func() string { return cfg.Auth.Token }
+	}
+	return func() string {
+		now := time.Now()
+		token, err := SignJWT([]byte(cfg.Auth.JWTSecret), JWTClaims{Subject: "cluster-" + cfg.Cluster.NodeID, Admin: true, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix()})
+		if err != nil {
+			slog.Error("cluster: could not sign forwarding JWT", "error", err)
+		}
+		return token
+	}
+}
+
+// toLeader forwards req to the leader or points the caller there, per cc.Followers.
+func (c *Cluster) toLeader(req Request) Response {
+	leader, ok := c.cc.peer(c.Leader())
+	if !ok || leader.ID == c.cc.NodeID {
+		return Response{Err: fmt.Errorf("%w: no cluster leader elected yet, try again", ErrUnavailable)}
+	}
+	if c.cc.Followers == FollowersRedirect {
+		return Response{Err: &NotLeaderError{Leader: leader.URL, Path: apiPath(req)}}
+	}
+	slog.Debug("cluster: forwarding to leader", "op", req.Op, "leader", leader.ID)
+	return c.forward[leader.ID].handle(req)
+}
+
+func (c *Cluster) countOp(user string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ops.check(user, c.limits.MaxOpsPerMinute, time.Now())
+}
+
+func (c *Cluster) uncountOp(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ops.uncount(user, time.Now())
+}
+
+// usage is the actor's report with the op counts kept by the cluster.
+func (c *Cluster) usage() Response {
+	resp := c.ask(Request{Op: "usage"})
+	if resp.Err != nil {
+		return resp
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	resp.Usage.Limits = c.limits
+	for i, u := range resp.Usage.Users {
+		resp.Usage.Users[i].OpsThisMinute = c.ops.current(u.UserID, now)
+	}
+	return resp
+}
+
+func (c *Cluster) ask(req Request) Response {
+	reply := make(chan Response, 1)
+	req.ReplyCh = reply
+	c.local <- req
+	return <-reply
+}
+
+// clusterFSM applies committed log entries to the node's actor. An entry the actor could
+// not save leaves this node's copy behind the log, so the FSM refuses every later entry
+// and closes failed, which makes the node leave the cluster.
+type clusterFSM struct {
+	actor  chan Request
+	failed chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func (f *clusterFSM) Apply(l *raft.Log) interface{} {
+	if err := f.failure(); err != nil {
+		return Response{Err: fmt.Errorf("%w: log entry %d not applied, node stopped after: %v", ErrStorage, l.Index, err)}
+	}
+	var cmd raftCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		slog.Error("cluster: undecodable log entry", "index", l.Index, "error", err)
+		return Response{Err: fmt.Errorf("%w: log entry %d: %v", ErrStorage, l.Index, err)}
+	}
+	reply := make(chan Response, 1)
+	f.actor <- Request{Op: cmd.Op, UserID: cmd.UserID, Index: cmd.Index, Task: cmd.Task, Tasks: cmd.Tasks, Patch: cmd.Patch, ReplyCh: reply}
+	resp := <-reply
+	if errors.Is(resp.Err, ErrStorage) {
+		f.fail(fmt.Errorf("log entry %d: %w", l.Index, resp.Err))
+	}
+	return resp
+}
+
+func (f *clusterFSM) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.err = err
+		close(f.failed)
+	}
+}
+
+// failure is the error that stopped the FSM, or nil.
+func (f *clusterFSM) failure() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+func (f *clusterFSM) Snapshot() (raft.FSMSnapshot, error) {
+	lists, err := Snapshot(f.actor)
+	return clusterSnapshot(lists), err
+}
+
+func (f *clusterFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var lists map[string][]ToDoTask
+	if err := json.NewDecoder(rc).Decode(&lists); err != nil {
+		return fmt.Errorf("%w: raft snapshot: %v", ErrStorage, err)
+	}
+	reply := make(chan Response, 1)
+	f.actor <- Request{Op: "load", Lists: lists, ReplyCh: reply}
+	return (<-reply).Err
+}
+
+// clusterSnapshot is every user's list at one point of the log.
+type clusterSnapshot map[string][]ToDoTask
+
+func (s clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s clusterSnapshot) Release() {}
+
+// handleLoad makes lists the whole state: users in it get their list, every other user
+// an empty one. It installs a Raft snapshot.
+func (a *actorState) handleLoad(lists map[string][]ToDoTask) Response {
+	if a.rows != nil {
+		return Response{Err: fmt.Errorf("%w: load needs a backend kept in memory", ErrInvalidInput)}
+	}
+	next := make(map[string][]ToDoTask, len(lists))
+	for user := range a.lists {
+		next[user] = []ToDoTask{}
+	}
+	for user, tasks := range lists {
+		next[user] = append([]ToDoTask{}, tasks...)
+	}
+	var firstErr error
+	for user, tasks := range next {
+		if err := a.commit(user, tasks, LogRecord{Op: "replace", Tasks: tasks}); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return Response{Err: firstErr}
+}
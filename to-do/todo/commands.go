@@ -0,0 +1,558 @@
+package todo
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commands are the subcommands Run understands, e.g. "todo import-json -from ./old".
+// Each gets the arguments after its name.
+var commands = map[string]func(args []string, actor chan Request, cfg Config) error{
+	"import-json": runImportJSON,
+	"migrate":     runMigrate,
+	"gen-key":     runGenKey,
+	"rotate-key":  runRotateKey,
+	"decrypt":     runDecrypt,
+	"backup":      runBackup,
+	"restore":     runRestore,
+	"export":      runExport,
+	"import":      runImport,
+	"status":      runStatus,
+}
+
+// runImportJSON copies every <user>_todo.json in a directory into the configured
+// backend through the actor, replacing those users' lists.
+func runImportJSON(args []string, actor chan Request, cfg Config) error {
+	fs := flag.NewFlagSet("import-json", flag.ContinueOnError)
+	from := fs.String("from", ".", "Directory holding <user>_todo.json files")
+	user := fs.String("user", "", "Only import this user (default all)")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+
+	lists, err := LoadAll(&JSONStore{Dir: *from})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	users := make([]string, 0, len(lists))
+	for u := range lists {
+		if *user == "" || u == *user {
+			users = append(users, u)
+		}
+	}
+	if len(users) == 0 {
+		return fmt.Errorf("%w: no task files found in %s", ErrNotFound, *from)
+	}
+	sort.Strings(users)
+
+	for _, u := range users {
+		if err := Replace(actor, u, lists[u]); err != nil {
+			return fmt.Errorf("import user %q: %w", u, err)
+		}
+		slog.Info("imported tasks", "user", u, "tasks", len(lists[u]))
+		fmt.Printf("imported %d tasks for %s\n", len(lists[u]), u)
+	}
+	return nil
+}
+
+// offlineCommands work on the data directory without the actor. They run before the
+// data is loaded, so they still work when it cannot be, see RunOffline.
+var offlineCommands = map[string]func(args []string, cfg Config) error{
+	"fsck":  runFsck,
+	"token": runToken,
+}
+
+// RunOffline runs args[1] if it names one of offlineCommands and reports whether it did.
+// Binaries call it before opening the store.
+func RunOffline(args []string, cfg Config) (bool, error) {
+	if len(args) < 2 {
+		return false, nil
+	}
+	cmd, ok := offlineCommands[args[1]]
+	if !ok {
+		return false, nil
+	}
+	return true, cmd(args[2:], cfg)
+}
+
+// runFsck checks the data directory, optionally repairs it, and writes a JSON report.
+func runFsck(args []string, cfg Config) error {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := fs.Bool("repair", false, "Fix what can be fixed safely and quarantine unreadable files")
+	reportFile := fs.String("report", filepath.Join(dataDir(cfg), "fsck-report.json"), "Where to write the JSON report")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	keys, err := cfg.keyring()
+	if err != nil {
+		return err
+	}
+	if *repair {
+		// checking is safe next to a running server, repairing under it is not
+		lock, err := ClaimDir(dataDir(cfg), Owner{Kind: OwnerCLI})
+		if err != nil {
+			return fmt.Errorf("fsck -repair: %w", err)
+		}
+		defer lock.Release()
+	}
+	report, err := Fsck(dataDir(cfg), keys, *repair)
+	if err != nil {
+		return err
+	}
+	for _, is := range report.Issues {
+		line := fmt.Sprintf("%s: %s: %s", is.File, is.Kind, is.Detail)
+		if is.Task != nil {
+			line = fmt.Sprintf("%s: task %d: %s: %s", is.File, *is.Task, is.Kind, is.Detail)
+		}
+		if is.Action != "" {
+			line += " -> " + is.Action
+		}
+		fmt.Println(line)
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*reportFile, data, 0600); err != nil {
+		return fmt.Errorf("%w: write report: %v", ErrStorage, err)
+	}
+	fmt.Printf("checked %d files, %d issues, %d unresolved, report in %s\n",
+		report.Checked, len(report.Issues), report.Unresolved(), *reportFile)
+	if n := report.Unresolved(); n > 0 {
+		return fmt.Errorf("%w: %d problems in %s need attention", ErrStorage, n, report.Dir)
+	}
+	return nil
+}
+
+// runToken manages the API tokens in the data directory, e.g. "todo token issue -user
+// andrew". A running server sees the changes at once. "jwt" signs a JWT instead, with
+// the key in TODO_AUTH_JWT_SECRET.
+func runToken(args []string, cfg Config) error {
+	usage := fmt.Errorf("%w: usage: token issue|list|revoke|jwt [-user=ID] [-admin] [-name=NOTE] [-ttl=1h] [id]", ErrInvalidInput)
+	if len(args) == 0 {
+		return usage
+	}
+	fs := flag.NewFlagSet("token "+args[0], flag.ContinueOnError)
+	user := fs.String("user", "", "User the token acts as")
+	admin := fs.Bool("admin", false, "Allow every user's list and the admin endpoints")
+	name := fs.String("name", "", "What the token is for")
+	ttl := fs.Duration("ttl", time.Hour, "How long a JWT is valid")
+	if err := fs.Parse(args[1:]); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	store := NewTokenStore(dataDir(cfg))
+	switch args[0] {
+	case "issue":
+		secret, tok, err := store.Issue(*user, *name, *admin)
+		if err != nil {
+			return err
+		}
+		slog.Info("Issued API token, its secret is not shown again", "id", tok.ID, "user", tok.User, "admin", tok.Admin)
+		fmt.Println(secret)
+		return nil
+	case "list":
+		tokens, err := store.List()
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			fmt.Printf("%s\t%s\tadmin=%t\t%s\t%s\n", t.ID, t.User, t.Admin, t.Created.Format(time.RFC3339), t.Name)
+		}
+		return nil
+	case "revoke":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("%w: usage: token revoke <id>", ErrInvalidInput)
+		}
+		return store.Revoke(fs.Arg(0))
+	case "jwt":
+		if cfg.Auth.JWTSecret == "" {
+			return fmt.Errorf("%w: set TODO_AUTH_JWT_SECRET to sign JWTs", ErrInvalidInput)
+		}
+		if *user == "" {
+			return &ValidationError{Field: "user", Reason: "is required"}
+		}
+		if err := ValidateUserID(*user); err != nil {
+			return err
+		}
+		now := time.Now()
+		jwt, err := SignJWT([]byte(cfg.Auth.JWTSecret), JWTClaims{Subject: *user, Admin: *admin, IssuedAt: now.Unix(), ExpiresAt: now.Add(*ttl).Unix()})
+		if err != nil {
+			return err
+		}
+		fmt.Println(jwt)
+		return nil
+	}
+	return usage
+}
+
+// Replace asks the actor to make tasks the user's whole list.
+func Replace(actor chan Request, user string, tasks []ToDoTask) error {
+	reply := make(chan Response, 1)
+	actor <- Request{Op: "replace", UserID: user, Tasks: tasks, ReplyCh: reply}
+	return (<-reply).Err
+}
+
+// runMigrate upgrades every user file in the data directory to CurrentSchemaVersion,
+// backing each one up first. With -dry-run it only reports what would change.
+func runMigrate(args []string, actor chan Request, cfg Config) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Only report what would change")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	if !*dryRun {
+		if err := needLocal(cfg, "migrate"); err != nil {
+			return err
+		}
+	}
+
+	store, err := fileStore(cfg)
+	if err != nil {
+		return err
+	}
+	report, err := MigrateDir(store, *dryRun)
+	for _, line := range report {
+		fmt.Println(line)
+	}
+	return err
+}
+
+// MigrateDir upgrades every user file of store that uses an older schema and returns
+// one report line per file. With dryRun nothing is written.
+func MigrateDir(store *JSONStore, dryRun bool) ([]string, error) {
+	users, err := store.Users()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	sort.Strings(users)
+
+	var report []string
+	for _, user := range users {
+		path := store.path(user)
+		raw, err := readPlain(path, store.Keys)
+		if err != nil {
+			report = append(report, fmt.Sprintf("%s: unreadable, skipped (%v)", path, err))
+			continue
+		}
+		from, err := detectVersion(raw)
+		if err != nil {
+			report = append(report, fmt.Sprintf("%s: unreadable, skipped (%v)", path, err))
+			continue
+		}
+		if from >= CurrentSchemaVersion {
+			report = append(report, fmt.Sprintf("%s: already at version %d", path, from))
+			continue
+		}
+		tasks, _, err := decodeUserFile(raw, user)
+		if err != nil {
+			report = append(report, fmt.Sprintf("%s: migration failed, skipped (%v)", path, err))
+			continue
+		}
+		var steps []string
+		for v := from; v < CurrentSchemaVersion; v++ {
+			m, _ := migrationFrom(v)
+			steps = append(steps, fmt.Sprintf("v%d->v%d %s", v, v+1, m.Description))
+		}
+		line := fmt.Sprintf("%s: %d tasks, %s", path, len(tasks), strings.Join(steps, "; "))
+		if dryRun {
+			report = append(report, "would migrate "+line)
+			continue
+		}
+		if err := saveFile(tasks, path, store.Keys); err != nil {
+			return report, fmt.Errorf("%w: %v", ErrStorage, err)
+		}
+		report = append(report, "migrated "+line)
+	}
+	return report, nil
+}
+
+// needLocal refuses a command that rewrites the data directory itself while its
+// requests go to a server, which would not see the change.
+func needLocal(cfg Config, name string) error {
+	if cfg.Remote != "" {
+		return fmt.Errorf("%w: %s rewrites the data directory, stop the server at %s first", ErrConflict, name, cfg.Remote)
+	}
+	return nil
+}
+
+// fileStore is the JSONStore of cfg's data directory, with cfg's encryption keys.
+func fileStore(cfg Config) (*JSONStore, error) {
+	keys, err := cfg.keyring()
+	if err != nil {
+		return nil, err
+	}
+	return &JSONStore{Dir: dataDir(cfg), Keys: keys}, nil
+}
+
+// runGenKey prints a new random encryption key.
+func runGenKey(args []string, actor chan Request, cfg Config) error {
+	key, err := NewKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+// runRotateKey re-encrypts every user file in the data directory with the current key.
+// To rotate, put the new key first and keep the old one after it until this has run.
+func runRotateKey(args []string, actor chan Request, cfg Config) error {
+	if err := needLocal(cfg, "rotate-key"); err != nil {
+		return err
+	}
+	store, err := fileStore(cfg)
+	if err != nil {
+		return err
+	}
+	report, err := RotateKeys(store)
+	for _, line := range report {
+		fmt.Println(line)
+	}
+	return err
+}
+
+// RotateKeys rewrites every user file of store that is plaintext or encrypted with an
+// older key, and returns one report line per file.
+func RotateKeys(store *JSONStore) ([]string, error) {
+	if store.Keys == nil {
+		return nil, fmt.Errorf("%w: no encryption key configured", ErrInvalidInput)
+	}
+	users, err := store.Users()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	sort.Strings(users)
+
+	var report []string
+	for _, user := range users {
+		path := store.path(user)
+		if store.Keys.current(readHead(path)) {
+			report = append(report, fmt.Sprintf("%s: already under the current key", path))
+			continue
+		}
+		tasks, err := readTasks(path, store.Keys)
+		if err != nil {
+			return report, fmt.Errorf("%w: %s: %v", ErrStorage, path, err)
+		}
+		if err := saveFile(tasks, path, store.Keys); err != nil {
+			return report, fmt.Errorf("%w: %v", ErrStorage, err)
+		}
+		report = append(report, fmt.Sprintf("%s: re-encrypted %d tasks", path, len(tasks)))
+	}
+	return report, nil
+}
+
+// runDecrypt exports plaintext copies of the user files for recovery.
+func runDecrypt(args []string, actor chan Request, cfg Config) error {
+	fs := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	out := fs.String("out", "", "Directory to write the plaintext <user>_todo.json files to (required)")
+	user := fs.String("user", "", "Only export this user (default all)")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	if *out == "" {
+		return fmt.Errorf("%w: -out is required", ErrInvalidInput)
+	}
+	store, err := fileStore(cfg)
+	if err != nil {
+		return err
+	}
+	n, err := DecryptTo(store, *out, *user)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d plaintext files to %s\n", n, *out)
+	return nil
+}
+
+// DecryptTo writes a plaintext copy of each user file of store (or only user's, if set)
+// into dir and returns how many it wrote. dir must not be the store's own directory.
+func DecryptTo(store *JSONStore, dir, user string) (int, error) {
+	src, err1 := filepath.Abs(store.Dir)
+	dst, err2 := filepath.Abs(dir)
+	if err1 != nil || err2 != nil || src == dst {
+		return 0, fmt.Errorf("%w: export directory must differ from the data directory", ErrInvalidInput)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	users, err := store.Users()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	n := 0
+	for _, u := range users {
+		if user != "" && u != user {
+			continue
+		}
+		tasks, err := readTasks(store.path(u), store.Keys)
+		if err != nil {
+			return n, fmt.Errorf("%w: %s: %v", ErrStorage, store.path(u), err)
+		}
+		if err := SaveFile(tasks, Paths{Dir: dir}.UserFile(u)); err != nil {
+			return n, fmt.Errorf("%w: %v", ErrStorage, err)
+		}
+		n++
+	}
+	if user != "" && n == 0 {
+		return 0, fmt.Errorf("%w: no task file for user %q", ErrNotFound, user)
+	}
+	return n, nil
+}
+
+// runBackup writes a timestamped archive of every user's tasks.
+func runBackup(args []string, actor chan Request, cfg Config) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	dir := fs.String("dir", backupDir(cfg), "Directory to write the archive to")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	keys, err := cfg.keyring()
+	if err != nil {
+		return err
+	}
+	path, err := Backup(actor, *dir, keys)
+	if err != nil {
+		return err
+	}
+	fmt.Println(path)
+	return nil
+}
+
+// runRestore puts the lists from an archive back, for every user or just one.
+func runRestore(args []string, actor chan Request, cfg Config) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	from := fs.String("from", "", "Backup archive to restore (required)")
+	user := fs.String("user", "", "Only restore this user (default all in the archive)")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	if *from == "" {
+		return fmt.Errorf("%w: -from is required", ErrInvalidInput)
+	}
+	keys, err := cfg.keyring()
+	if err != nil {
+		return err
+	}
+	users, err := Restore(actor, *from, keys, *user)
+	for _, u := range users {
+		fmt.Printf("restored %s\n", u)
+	}
+	return err
+}
+
+// runExport writes one user's tasks in one of Formats, to a file or stdout.
+func runExport(args []string, actor chan Request, cfg Config) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	user := fs.String("user", "default", "User ID")
+	format := fs.String("format", "", "One of "+strings.Join(Formats, ", ")+" (default from -out's extension)")
+	out := fs.String("out", "", "File to write (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	f := *format
+	if f == "" {
+		f = formatForFile(*out)
+	}
+	if *out == "" {
+		return ExportTasks(actor, *user, f, os.Stdout)
+	}
+	file, err := os.Create(*out)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	if err := ExportTasks(actor, *user, f, file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// runImport adds tasks from a file in one of Formats to a user's list and prints a report.
+func runImport(args []string, actor chan Request, cfg Config) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	user := fs.String("user", "default", "User ID")
+	from := fs.String("from", "", "File to read, - for stdin (required)")
+	format := fs.String("format", "", "One of "+strings.Join(Formats, ", ")+" (default from -from's extension)")
+	dryRun := fs.Bool("dry-run", false, "Only report what would be imported")
+	replace := fs.Bool("replace", false, "Replace the user's list instead of adding to it")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	if *from == "" {
+		return fmt.Errorf("%w: -from is required", ErrInvalidInput)
+	}
+	f := *format
+	if f == "" {
+		f = formatForFile(*from)
+	}
+	in := os.Stdin
+	if *from != "-" {
+		file, err := os.Open(*from)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrNotFound, err)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	report, err := ImportTasks(actor, *user, f, in, *dryRun, *replace)
+	if err != nil {
+		return err
+	}
+	verb := "imported"
+	if report.DryRun {
+		verb = "would import"
+		for _, t := range report.Tasks {
+			fmt.Printf("  [%s] %s\n", t.Status, t.Description)
+		}
+	}
+	for _, p := range report.Problems {
+		fmt.Println("  skipped", p)
+	}
+	fmt.Printf("%s %d tasks for %s (%d skipped), list goes from %d to %d tasks\n",
+		verb, report.Parsed, report.User, len(report.Problems), report.Existing, report.Result)
+	return nil
+}
+
+// formatForFile guesses the format from a file name's extension.
+func formatForFile(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, f := range Formats {
+		if ext == FileExt(f) {
+			return f
+		}
+	}
+	return ""
+}
+
+// runStatus sets one task's status and leaves its description alone.
+func runStatus(args []string, actor chan Request, cfg Config) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	user := fs.String("user", "default", "User ID")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	if fs.NArg() < 2 {
+		return fmt.Errorf("%w: usage: status [-user=ID] <index> <status>", ErrInvalidInput)
+	}
+	idx, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("%w: index %q is not a number", ErrInvalidInput, fs.Arg(0))
+	}
+	status := strings.Join(fs.Args()[1:], " ")
+	t, err := PatchTask(actor, *user, idx, TaskPatch{Status: &status})
+	if err != nil {
+		return fmt.Errorf("set status of task %d: %w", idx, err)
+	}
+	slog.Info("Task updated", "Index", idx, "task", t)
+	return nil
+}
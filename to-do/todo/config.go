@@ -0,0 +1,273 @@
+package todo
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Persistence modes understood by the actor.
+const (
+	// PersistDurable saves and fsyncs the user's file before replying.
+	PersistDurable = "durable"
+	// PersistWriteBehind marks the user dirty and saves on the next flush tick.
+	PersistWriteBehind = "write-behind"
+)
+
+// Storage backends understood by OpenStore.
+const (
+	BackendJSON   = "json"   // one <user>_todo.json file per user in DataDir
+	BackendMemory = "memory" // nothing is written to disk
+	BackendLog    = "log"    // per-user snapshot plus append-only operation log in DataDir
+	BackendSQLite = "sqlite" // every user in DataDir/todo.db
+	BackendBolt   = "bolt"   // one bbolt bucket per user in DataDir/todo.bolt
+)
+
+// What a CLI or REPL does when a server owns the data directory, see Attach.
+const (
+	ServerRoute  = "route"  // send the requests to the server over HTTP
+	ServerRefuse = "refuse" // exit with an error naming the server
+)
+
+// Config controls how the actor persists task lists.
+type Config struct {
+	PersistMode       string        // PersistDurable or PersistWriteBehind
+	FlushInterval     time.Duration // how often dirty users are saved in write-behind mode
+	Backend           string        // one of the Backend* constants, used by OpenStore
+	DataDir           string        // see ResolveDataDir and Paths; "" is the working directory
+	Store             Store         // set from Backend by OpenStore; nil saves JSON files in the working directory
+	SnapshotEvery     int           // log backend: records between snapshots
+	Limits            Limits        // per-user quotas enforced by the actor, none by default
+	WatchInterval     time.Duration // how often WatchDir polls for external edits, 0 disables it
+	ConflictPolicy    string        // ConflictPreferDisk, ConflictPreferMemory or ConflictKeepBoth
+	EncryptionKey     string        // json backend: base64 keys, current first, see ParseKeyring
+	EncryptionKeyFile string        // read the keys from this file instead
+	BackupDir         string        // where backups go, "" is DataDir/backups
+	BackupInterval    time.Duration // how often RunBackups takes a backup, 0 disables it
+	BackupKeepHourly  int           // retention: newest backup of each of this many hours
+	BackupKeepDaily   int           // retention: newest backup of each of this many days
+	ServerMode        string        // ServerRoute or ServerRefuse
+	Remote            string        // set by Attach to the server's URL when requests go to it
+	Cluster           ClusterConfig // cluster mode, off unless Cluster.NodeID is set
+	Auth              AuthConfig    // API authentication, off by default
+	RateLimit         RateLimitConfig
+}
+
+// RateLimitConfig sets the HTTP server's rate limits, applied to each client IP and to
+// each authenticated user. Reads are GET and HEAD requests, writes the rest.
+type RateLimitConfig struct {
+	Reads  RateClass
+	Writes RateClass
+	Idle   time.Duration // a client's limiters are dropped after this long unused
+}
+
+// RateClass is a token bucket: PerSecond requests a second on average, up to Burst at
+// once. A PerSecond of 0 means no limit, a Burst of 0 one second's worth.
+type RateClass struct {
+	PerSecond float64
+	Burst     int
+}
+
+// DefaultConfig keeps the original behaviour: every mutation is saved before it is acknowledged.
+func DefaultConfig() Config {
+	return Config{
+		PersistMode:      PersistDurable,
+		FlushInterval:    time.Second,
+		Backend:          BackendJSON,
+		SnapshotEvery:    1000,
+		WatchInterval:    2 * time.Second,
+		ConflictPolicy:   ConflictPreferDisk,
+		BackupKeepHourly: 24,
+		BackupKeepDaily:  7,
+		ServerMode:       ServerRoute,
+		Cluster:          ClusterConfig{Followers: FollowersForward, Reads: ReadsLocal},
+		Auth:             AuthConfig{Mode: AuthOff},
+		RateLimit:        RateLimitConfig{Idle: 10 * time.Minute},
+	}
+}
+
+// ConfigFromEnv starts from DefaultConfig and applies TODO_PERSIST_MODE, TODO_FLUSH_INTERVAL,
+// TODO_BACKEND, TODO_SNAPSHOT_EVERY, TODO_MAX_TASKS, TODO_MAX_DESCRIPTION_LEN, TODO_MAX_OPS_PER_MINUTE,
+// TODO_WATCH_INTERVAL, TODO_CONFLICT_POLICY, TODO_ENCRYPTION_KEY, TODO_ENCRYPTION_KEY_FILE,
+// TODO_BACKUP_DIR, TODO_BACKUP_INTERVAL, TODO_BACKUP_KEEP_HOURLY, TODO_BACKUP_KEEP_DAILY
+// TODO_SERVER_MODE, TODO_CLUSTER_NODE_ID, TODO_CLUSTER_PEERS, TODO_CLUSTER_DIR,
+// TODO_CLUSTER_FOLLOWERS, TODO_CLUSTER_READS, TODO_AUTH, TODO_AUTH_JWT_SECRET, TODO_TOKEN,
+// TODO_RATE_READS, TODO_RATE_READ_BURST, TODO_RATE_WRITES, TODO_RATE_WRITE_BURST and
+// TODO_RATE_IDLE. Most invalid values are logged and the default kept; invalid cluster
+// peers, which have no safe default, are an error.
+func ConfigFromEnv() (Config, error) {
+	cfg := DefaultConfig()
+	if mode := os.Getenv("TODO_PERSIST_MODE"); mode != "" {
+		switch mode {
+		case PersistDurable, PersistWriteBehind:
+			cfg.PersistMode = mode
+		default:
+			slog.Warn("unknown TODO_PERSIST_MODE, using default", "mode", mode, "default", cfg.PersistMode)
+		}
+	}
+	if v := os.Getenv("TODO_FLUSH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			slog.Warn("invalid TODO_FLUSH_INTERVAL, using default", "value", v, "default", cfg.FlushInterval)
+		} else {
+			cfg.FlushInterval = d
+		}
+	}
+	if backend := os.Getenv("TODO_BACKEND"); backend != "" {
+		cfg.Backend = backend
+	}
+	if v := os.Getenv("TODO_WATCH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			slog.Warn("invalid TODO_WATCH_INTERVAL, using default", "value", v, "default", cfg.WatchInterval)
+		} else {
+			cfg.WatchInterval = d
+		}
+	}
+	if policy := os.Getenv("TODO_CONFLICT_POLICY"); policy != "" {
+		switch policy {
+		case ConflictPreferDisk, ConflictPreferMemory, ConflictKeepBoth:
+			cfg.ConflictPolicy = policy
+		default:
+			slog.Warn("unknown TODO_CONFLICT_POLICY, using default", "policy", policy, "default", cfg.ConflictPolicy)
+		}
+	}
+	cfg.EncryptionKey = os.Getenv("TODO_ENCRYPTION_KEY")
+	cfg.EncryptionKeyFile = os.Getenv("TODO_ENCRYPTION_KEY_FILE")
+	cfg.BackupDir = os.Getenv("TODO_BACKUP_DIR")
+	if v := os.Getenv("TODO_BACKUP_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			slog.Warn("invalid TODO_BACKUP_INTERVAL, backups stay off", "value", v)
+		} else {
+			cfg.BackupInterval = d
+		}
+	}
+	if mode := os.Getenv("TODO_SERVER_MODE"); mode != "" {
+		switch mode {
+		case ServerRoute, ServerRefuse:
+			cfg.ServerMode = mode
+		default:
+			slog.Warn("unknown TODO_SERVER_MODE, using default", "mode", mode, "default", cfg.ServerMode)
+		}
+	}
+	cfg.Cluster.NodeID = os.Getenv("TODO_CLUSTER_NODE_ID")
+	cfg.Cluster.Dir = os.Getenv("TODO_CLUSTER_DIR")
+	if v := os.Getenv("TODO_CLUSTER_PEERS"); v != "" {
+		peers, err := ParsePeers(v)
+		if err != nil {
+			return cfg, fmt.Errorf("TODO_CLUSTER_PEERS: %w", err)
+		}
+		cfg.Cluster.Peers = peers
+	}
+	if mode := os.Getenv("TODO_CLUSTER_FOLLOWERS"); mode != "" {
+		switch mode {
+		case FollowersForward, FollowersRedirect:
+			cfg.Cluster.Followers = mode
+		default:
+			slog.Warn("unknown TODO_CLUSTER_FOLLOWERS, using default", "mode", mode, "default", cfg.Cluster.Followers)
+		}
+	}
+	if mode := os.Getenv("TODO_CLUSTER_READS"); mode != "" {
+		switch mode {
+		case ReadsLocal, ReadsLinearizable:
+			cfg.Cluster.Reads = mode
+		default:
+			slog.Warn("unknown TODO_CLUSTER_READS, using default", "mode", mode, "default", cfg.Cluster.Reads)
+		}
+	}
+	if mode := os.Getenv("TODO_AUTH"); mode != "" {
+		switch mode {
+		case AuthOff, AuthRequired:
+			cfg.Auth.Mode = mode
+		default:
+			slog.Warn("unknown TODO_AUTH, using default", "mode", mode, "default", cfg.Auth.Mode)
+		}
+	}
+	cfg.Auth.JWTSecret = os.Getenv("TODO_AUTH_JWT_SECRET")
+	cfg.Auth.Token = os.Getenv("TODO_TOKEN")
+	if v := os.Getenv("TODO_RATE_IDLE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			slog.Warn("invalid TODO_RATE_IDLE, using default", "value", v, "default", cfg.RateLimit.Idle)
+		} else {
+			cfg.RateLimit.Idle = d
+		}
+	}
+	envRate("TODO_RATE_READS", &cfg.RateLimit.Reads.PerSecond)
+	envRate("TODO_RATE_WRITES", &cfg.RateLimit.Writes.PerSecond)
+	envInt("TODO_RATE_READ_BURST", &cfg.RateLimit.Reads.Burst)
+	envInt("TODO_RATE_WRITE_BURST", &cfg.RateLimit.Writes.Burst)
+	envInt("TODO_BACKUP_KEEP_HOURLY", &cfg.BackupKeepHourly)
+	envInt("TODO_BACKUP_KEEP_DAILY", &cfg.BackupKeepDaily)
+	envInt("TODO_SNAPSHOT_EVERY", &cfg.SnapshotEvery)
+	envInt("TODO_MAX_TASKS", &cfg.Limits.MaxTasks)
+	envInt("TODO_MAX_DESCRIPTION_LEN", &cfg.Limits.MaxDescriptionLen)
+	envInt("TODO_MAX_OPS_PER_MINUTE", &cfg.Limits.MaxOpsPerMinute)
+	return cfg, nil
+}
+
+// envInt overwrites *dst with a non-negative integer from the named variable, if set.
+func envInt(name string, dst *int) {
+	v := os.Getenv(name)
+	if v == "" {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		slog.Warn("invalid "+name+", using default", "value", v, "default", *dst)
+		return
+	}
+	*dst = n
+}
+
+// envRate overwrites *dst with a non-negative number of requests per second from the
+// named variable, if set.
+func envRate(name string, dst *float64) {
+	v := os.Getenv(name)
+	if v == "" {
+		return
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		slog.Warn("invalid "+name+", using default", "value", v, "default", *dst)
+		return
+	}
+	*dst = n
+}
+
+// OpenStore creates the Store selected by cfg.Backend.
+func OpenStore(cfg Config) (Store, error) {
+	dir := dataDir(cfg)
+	keys, err := cfg.keyring()
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil && cfg.Backend != BackendJSON && cfg.Backend != "" {
+		return nil, fmt.Errorf("%w: encryption at rest needs the %s backend", ErrInvalidInput, BackendJSON)
+	}
+	switch cfg.Backend {
+	case BackendJSON, "":
+		return &JSONStore{Dir: dir, Keys: keys}, nil
+	case BackendMemory:
+		return NewMemStore(), nil
+	case BackendLog:
+		return NewLogStore(dir, cfg.SnapshotEvery), nil
+	case BackendSQLite:
+		return OpenSQLiteStore(Paths{Dir: dir}.SQLite())
+	case BackendBolt:
+		return OpenBoltStore(Paths{Dir: dir}.Bolt())
+	default:
+		return nil, fmt.Errorf("%w: unknown storage backend %q", ErrInvalidInput, cfg.Backend)
+	}
+}
+
+// dataDir is the directory file based backends and commands work in.
+func dataDir(cfg Config) string {
+	if cfg.DataDir == "" {
+		return "."
+	}
+	return cfg.DataDir
+}
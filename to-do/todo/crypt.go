@@ -0,0 +1,159 @@
+package todo
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// encryptedMagic starts every encrypted user file. Plaintext files start with '{' or '['
+// so the two can never be confused.
+var encryptedMagic = []byte("TODOENC1")
+
+// An encrypted user file is
+//
+//	encryptedMagic | key id (4 bytes) | nonce (12 bytes) | AES-256-GCM ciphertext
+//
+// The key id is the start of the key's SHA-256, so a file names the key that opens it.
+// The magic, key id and user are authenticated, so a file copied over another user's
+// fails to open instead of silently moving tasks between users.
+const (
+	keyIDLen = 4
+	keySize  = 32
+)
+
+// errNoKey is returned when an encrypted file is read without a keyring.
+var errNoKey = errors.New("file is encrypted and no key is configured (set TODO_ENCRYPTION_KEY or TODO_ENCRYPTION_KEY_FILE)")
+
+// errDecrypt is returned when a file is cut short or does not authenticate with its key,
+// meaning the file is damaged or belongs to another user.
+var errDecrypt = errors.New("decrypt")
+
+// Keyring holds the keys used for encryption at rest. The first key encrypts everything
+// written; every key can decrypt, which is what makes rotation possible.
+type Keyring struct {
+	keys [][]byte
+}
+
+// ParseKeyring reads base64 encoded 32-byte keys separated by commas or newlines, current
+// key first. Blank lines and lines starting with '#' are skipped.
+func ParseKeyring(s string) (*Keyring, error) {
+	k := &Keyring{}
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(field)
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("%w: encryption keys must be %d bytes, base64 encoded", ErrInvalidInput, keySize)
+		}
+		k.keys = append(k.keys, key)
+	}
+	if len(k.keys) == 0 {
+		return nil, fmt.Errorf("%w: no encryption key found", ErrInvalidInput)
+	}
+	return k, nil
+}
+
+// NewKey returns a random key in the form ParseKeyring accepts.
+func NewKey() (string, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// keyring builds the Keyring configured in cfg, or nil when encryption is off.
+func (cfg Config) keyring() (*Keyring, error) {
+	switch {
+	case cfg.EncryptionKey != "":
+		return ParseKeyring(cfg.EncryptionKey)
+	case cfg.EncryptionKeyFile != "":
+		data, err := os.ReadFile(cfg.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read key file: %w", err)
+		}
+		return ParseKeyring(string(data))
+	}
+	return nil, nil
+}
+
+func keyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:keyIDLen]
+}
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+// seal encrypts plain for user with the current key.
+func (k *Keyring) seal(plain []byte, user string) ([]byte, error) {
+	key := k.keys[0]
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := append(append([]byte(nil), encryptedMagic...), keyID(key)...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aad := append(append([]byte(nil), header...), user...)
+	return gcm.Seal(append(header, nonce...), nonce, plain, aad), nil
+}
+
+// open decrypts a file written by seal with whichever key it names.
+func (k *Keyring) open(data []byte, user string) ([]byte, error) {
+	if k == nil {
+		return nil, errNoKey
+	}
+	headerLen := len(encryptedMagic) + keyIDLen
+	if len(data) < headerLen {
+		return nil, fmt.Errorf("%w: encrypted file too short", errDecrypt)
+	}
+	header, id := data[:headerLen], data[len(encryptedMagic):headerLen]
+	for _, key := range k.keys {
+		if !bytes.Equal(keyID(key), id) {
+			continue
+		}
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		rest := data[headerLen:]
+		if len(rest) < gcm.NonceSize() {
+			return nil, fmt.Errorf("%w: encrypted file too short", errDecrypt)
+		}
+		plain, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], append(append([]byte(nil), header...), user...))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errDecrypt, err)
+		}
+		return plain, nil
+	}
+	return nil, fmt.Errorf("file was encrypted with key %x, which is not configured", id)
+}
+
+// current reports whether data is encrypted with the key seal uses now.
+func (k *Keyring) current(data []byte) bool {
+	headerLen := len(encryptedMagic) + keyIDLen
+	return k != nil && isEncrypted(data) && len(data) >= headerLen &&
+		bytes.Equal(data[len(encryptedMagic):headerLen], keyID(k.keys[0]))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,110 @@
+package todo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors returned (usually wrapped) by the actor. Match them with errors.Is.
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrInvalidInput    = errors.New("invalid input")
+	ErrConflict        = errors.New("conflict")
+	ErrForbidden       = errors.New("forbidden")
+	ErrQuotaExceeded   = errors.New("quota exceeded")
+	ErrStorage         = errors.New("storage failure")
+	ErrUnavailable     = errors.New("unavailable")     // cluster mode: no leader to take the write
+	ErrUnauthenticated = errors.New("unauthenticated") // missing, unknown or expired API credentials
+)
+
+// IndexError reports a task index outside the user's list. It matches ErrNotFound.
+type IndexError struct {
+	UserID string
+	Index  int
+	Len    int
+}
+
+func (e *IndexError) Error() string {
+	return fmt.Sprintf("index %d out of range (user %q has %d tasks)", e.Index, e.UserID, e.Len)
+}
+
+func (e *IndexError) Is(target error) bool { return target == ErrNotFound }
+
+// ValidationError reports a request field that was rejected. It matches ErrInvalidInput.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+func (e *ValidationError) Is(target error) bool { return target == ErrInvalidInput }
+
+// QuotaError reports a per-user limit that was hit. It matches ErrQuotaExceeded.
+type QuotaError struct {
+	UserID string
+	Limit  string // name of the limit, e.g. "max_tasks"
+	Max    int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded for user %q: %s is %d", e.UserID, e.Limit, e.Max)
+}
+
+func (e *QuotaError) Is(target error) bool { return target == ErrQuotaExceeded }
+
+// StorageError wraps a persistence failure for one user. It matches ErrStorage.
+type StorageError struct {
+	UserID string
+	Err    error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("could not save tasks for user %q: %v", e.UserID, e.Err)
+}
+
+func (e *StorageError) Unwrap() error { return e.Err }
+
+func (e *StorageError) Is(target error) bool { return target == ErrStorage }
+
+// Exit codes used by the CLI for each kind of error.
+const (
+	ExitOK              = 0
+	ExitFailure         = 1
+	ExitInvalidInput    = 2
+	ExitNotFound        = 3
+	ExitConflict        = 4
+	ExitForbidden       = 5
+	ExitQuotaExceeded   = 6
+	ExitStorage         = 7
+	ExitUnavailable     = 8
+	ExitUnauthenticated = 9
+)
+
+// ExitCode maps an error returned by Run to the process exit code.
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, ErrInvalidInput):
+		return ExitInvalidInput
+	case errors.Is(err, ErrNotFound):
+		return ExitNotFound
+	case errors.Is(err, ErrConflict):
+		return ExitConflict
+	case errors.Is(err, ErrForbidden):
+		return ExitForbidden
+	case errors.Is(err, ErrQuotaExceeded):
+		return ExitQuotaExceeded
+	case errors.Is(err, ErrStorage):
+		return ExitStorage
+	case errors.Is(err, ErrUnavailable):
+		return ExitUnavailable
+	case errors.Is(err, ErrUnauthenticated):
+		return ExitUnauthenticated
+	default:
+		return ExitFailure
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package todo
+
+import "os"
+
+// flock is a no-op where flock(2) is not available, so there processes sharing a data
+// directory are not detected.
+func flock(f *os.File, exclusive, wait bool) error {
+	return nil
+}
@@ -0,0 +1,501 @@
+package todo
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Import and export formats.
+const (
+	FormatTodoTxt  = "todotxt"  // one task per line, "x " marks done, see todotxt.org
+	FormatCSV      = "csv"      // header row with description and status columns
+	FormatMarkdown = "markdown" // GitHub checklist, "- [ ]" and "- [x]"
+	FormatICal     = "ical"     // iCalendar with one VTODO per task
+)
+
+// Formats lists every format Export and ParseTasks understand.
+var Formats = []string{FormatTodoTxt, FormatCSV, FormatMarkdown, FormatICal}
+
+// ContentType is the media type a format is served with.
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatMarkdown:
+		return "text/markdown; charset=utf-8"
+	case FormatICal:
+		return "text/calendar; charset=utf-8"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// FileExt is the usual file extension of a format.
+func FileExt(format string) string {
+	switch format {
+	case FormatTodoTxt:
+		return ".txt"
+	case FormatMarkdown:
+		return ".md"
+	case FormatICal:
+		return ".ics"
+	default:
+		return "." + format
+	}
+}
+
+func unknownFormat(format string) error {
+	return &ValidationError{Field: "format", Reason: fmt.Sprintf("unknown format %q, expected one of %s", format, strings.Join(Formats, ", "))}
+}
+
+// Export writes tasks to w in format.
+func Export(w io.Writer, format string, tasks []ToDoTask) error {
+	switch format {
+	case FormatTodoTxt:
+		return exportTodoTxt(w, tasks)
+	case FormatCSV:
+		return exportCSV(w, tasks)
+	case FormatMarkdown:
+		return exportMarkdown(w, tasks)
+	case FormatICal:
+		return exportICal(w, tasks)
+	default:
+		return unknownFormat(format)
+	}
+}
+
+// ParseTasks reads tasks in format from r. Lines or entries that cannot be understood
+// are skipped and described in the returned problems; err is only set when r cannot be
+// read at all.
+func ParseTasks(r io.Reader, format string) (tasks []ToDoTask, problems []string, err error) {
+	switch format {
+	case FormatTodoTxt:
+		return parseLines(r, parseTodoTxtLine)
+	case FormatCSV:
+		return parseCSV(r)
+	case FormatMarkdown:
+		return parseLines(r, parseMarkdownLine)
+	case FormatICal:
+		return parseICal(r)
+	default:
+		return nil, nil, unknownFormat(format)
+	}
+}
+
+// Statuses with a native form in the line based formats; anything else is kept as a
+// status:<value> tag (spaces as underscores) so it survives a round trip.
+func statusTag(status string) string {
+	if status == "" || status == "not started" || status == "completed" {
+		return ""
+	}
+	return " status:" + strings.ReplaceAll(status, " ", "_")
+}
+
+var statusTagRe = regexp.MustCompile(`(^|\s)status:(\S+)`)
+
+// takeStatusTag removes a status:<value> tag from desc.
+func takeStatusTag(desc string) (string, string) {
+	m := statusTagRe.FindStringSubmatchIndex(desc)
+	if m == nil {
+		return desc, ""
+	}
+	status := strings.ReplaceAll(desc[m[4]:m[5]], "_", " ")
+	return strings.TrimSpace(desc[:m[0]] + desc[m[1]:]), status
+}
+
+func parseLines(r io.Reader, parse func(line string) (ToDoTask, bool, error)) ([]ToDoTask, []string, error) {
+	var tasks []ToDoTask
+	var problems []string
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		t, ok, err := parse(sc.Text())
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("line %d: %v", n, err))
+		case ok:
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks, problems, sc.Err()
+}
+
+// todo.txt
+
+var (
+	todoTxtDate     = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}\s+`)
+	todoTxtPriority = regexp.MustCompile(`^\([A-Z]\)\s+`)
+)
+
+func exportTodoTxt(w io.Writer, tasks []ToDoTask) error {
+	for _, t := range tasks {
+		prefix := ""
+		if t.Status == "completed" {
+			prefix = "x "
+		}
+		if _, err := fmt.Fprintf(w, "%s%s%s\n", prefix, oneLine(t.Description), statusTag(t.Status)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseTodoTxtLine reads one todo.txt line. Completion and creation dates are dropped,
+// a priority such as "(A)" stays part of the description.
+func parseTodoTxtLine(line string) (ToDoTask, bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return ToDoTask{}, false, nil
+	}
+	t := ToDoTask{Status: "not started"}
+	if strings.HasPrefix(line, "x ") {
+		t.Status = "completed"
+		line = strings.TrimSpace(line[2:])
+	}
+	priority := todoTxtPriority.FindString(line)
+	line = line[len(priority):]
+	for i := 0; i < 2; i++ { // completion date, then creation date
+		line = todoTxtDate.ReplaceAllString(line, "")
+	}
+	line = priority + line
+	desc, status := takeStatusTag(line)
+	if status != "" {
+		t.Status = status
+	}
+	if desc == "" {
+		return t, false, fmt.Errorf("empty description")
+	}
+	t.Description = desc
+	return t, true, nil
+}
+
+// Markdown checklist
+
+var checklistRe = regexp.MustCompile(`^\s*[-*+]\s+\[([ xX])\]\s*(.*)$`)
+
+func exportMarkdown(w io.Writer, tasks []ToDoTask) error {
+	for _, t := range tasks {
+		box := " "
+		if t.Status == "completed" {
+			box = "x"
+		}
+		if _, err := fmt.Fprintf(w, "- [%s] %s%s\n", box, oneLine(t.Description), statusTag(t.Status)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMarkdownLine reads one checklist item. Blank lines and headings are ignored,
+// any other line is reported.
+func parseMarkdownLine(line string) (ToDoTask, bool, error) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return ToDoTask{}, false, nil
+	}
+	m := checklistRe.FindStringSubmatch(line)
+	if m == nil {
+		return ToDoTask{}, false, fmt.Errorf("not a checklist item: %q", trimmed)
+	}
+	t := ToDoTask{Status: "not started"}
+	if m[1] != " " {
+		t.Status = "completed"
+	}
+	desc, status := takeStatusTag(strings.TrimSpace(m[2]))
+	if status != "" {
+		t.Status = status
+	}
+	if desc == "" {
+		return t, false, fmt.Errorf("empty description")
+	}
+	t.Description = desc
+	return t, true, nil
+}
+
+// CSV
+
+func exportCSV(w io.Writer, tasks []ToDoTask) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"description", "status"})
+	for _, t := range tasks {
+		cw.Write([]string{t.Description, t.Status})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// parseCSV needs a header row naming a description column; a status column is optional.
+// Columns are matched by name, in any order and case.
+func parseCSV(r io.Reader) ([]ToDoTask, []string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, &ValidationError{Field: "body", Reason: err.Error()}
+	}
+	descCol, statusCol := -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))) {
+		case "description":
+			descCol = i
+		case "status":
+			statusCol = i
+		}
+	}
+	if descCol < 0 {
+		return nil, nil, &ValidationError{Field: "body", Reason: "CSV header has no description column"}
+	}
+
+	var tasks []ToDoTask
+	var problems []string
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var pe *csv.ParseError
+			if !errors.As(err, &pe) {
+				return nil, nil, err
+			}
+			problems = append(problems, pe.Error())
+			continue
+		}
+		line, _ := cr.FieldPos(0)
+		if descCol >= len(rec) || strings.TrimSpace(rec[descCol]) == "" {
+			problems = append(problems, fmt.Sprintf("line %d: empty description", line))
+			continue
+		}
+		t := ToDoTask{Description: rec[descCol], Status: "not started"}
+		if statusCol >= 0 && statusCol < len(rec) && strings.TrimSpace(rec[statusCol]) != "" {
+			t.Status = strings.TrimSpace(rec[statusCol])
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, problems, nil
+}
+
+// iCalendar VTODO
+
+// icalStatus maps task statuses to VTODO STATUS values. Other task statuses are written
+// as NEEDS-ACTION plus an X-TODO-STATUS property holding the original value.
+var icalStatus = map[string]string{
+	"not started": "NEEDS-ACTION",
+	"started":     "IN-PROCESS",
+	"completed":   "COMPLETED",
+	"cancelled":   "CANCELLED",
+}
+
+func exportICal(w io.Writer, tasks []ToDoTask) error {
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	lines := []string{"BEGIN:VCALENDAR", "VERSION:2.0", "PRODID:-//to-do//todo export//EN"}
+	for i, t := range tasks {
+		status, ok := icalStatus[t.Status]
+		if !ok {
+			status = "NEEDS-ACTION"
+		}
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s", i, t.Description)))
+		lines = append(lines,
+			"BEGIN:VTODO",
+			"UID:"+hex.EncodeToString(sum[:12])+"@to-do",
+			"DTSTAMP:"+stamp,
+			"SUMMARY:"+icalEscape(t.Description),
+			"STATUS:"+status,
+		)
+		if !ok && t.Status != "" {
+			lines = append(lines, "X-TODO-STATUS:"+icalEscape(t.Status))
+		}
+		lines = append(lines, "END:VTODO")
+	}
+	lines = append(lines, "END:VCALENDAR")
+	for _, l := range lines {
+		if _, err := io.WriteString(w, icalFold(l)+"\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseICal(r io.Reader) ([]ToDoTask, []string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	// unfold: a line starting with a space or tab continues the previous one
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.NewReplacer("\n ", "", "\n\t", "").Replace(text)
+
+	var tasks []ToDoTask
+	var problems []string
+	var cur *ToDoTask
+	var xStatus string
+	todos := 0
+	for _, line := range strings.Split(text, "\n") {
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		name, value := strings.ToUpper(line[:colon]), line[colon+1:]
+		if semi := strings.IndexByte(name, ';'); semi >= 0 {
+			name = name[:semi] // parameters such as LANGUAGE are ignored
+		}
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VTODO"):
+			todos++
+			cur, xStatus = &ToDoTask{Status: "not started"}, ""
+		case cur == nil:
+		case name == "SUMMARY":
+			cur.Description = icalUnescape(value)
+		case name == "STATUS":
+			for status, v := range icalStatus {
+				if strings.EqualFold(value, v) {
+					cur.Status = status
+				}
+			}
+		case name == "X-TODO-STATUS":
+			xStatus = icalUnescape(value)
+		case name == "END" && strings.EqualFold(value, "VTODO"):
+			if xStatus != "" {
+				cur.Status = xStatus
+			}
+			if strings.TrimSpace(cur.Description) == "" {
+				problems = append(problems, fmt.Sprintf("VTODO %d: no SUMMARY", todos))
+			} else {
+				tasks = append(tasks, *cur)
+			}
+			cur = nil
+		}
+	}
+	return tasks, problems, nil
+}
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", "")
+
+func icalEscape(s string) string { return icalEscaper.Replace(s) }
+
+func icalUnescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'n' || s[i] == 'N' {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// icalFold splits lines longer than 75 octets, never inside a UTF-8 sequence.
+func icalFold(line string) string {
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		n := len(string(r))
+		if width+n > 75 {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += n
+	}
+	return b.String()
+}
+
+var newlines = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+
+// oneLine keeps a multi-line description on one line for the line based formats.
+func oneLine(s string) string {
+	return newlines.Replace(s)
+}
+
+// ImportReport describes what an import did, or with DryRun what it would do.
+type ImportReport struct {
+	User     string     `json:"user"`
+	Format   string     `json:"format"`
+	DryRun   bool       `json:"dry_run"`
+	Replace  bool       `json:"replace"`
+	Parsed   int        `json:"parsed"`
+	Existing int        `json:"existing"` // tasks the user had before
+	Result   int        `json:"result"`   // tasks the user has (or would have) after
+	Problems []string   `json:"problems,omitempty"`
+	Tasks    []ToDoTask `json:"tasks"` // the parsed tasks
+}
+
+// ImportTasks parses r in format and adds the tasks to user's list, or with replace makes
+// them the whole list. The change is one actor request, so it applies completely or not
+// at all. With dryRun nothing is changed and the report shows what would happen.
+func ImportTasks(actor chan Request, user, format string, r io.Reader, dryRun, replace bool) (*ImportReport, error) {
+	tasks, problems, err := ParseTasks(r, format)
+	if err != nil {
+		return nil, err
+	}
+	report := &ImportReport{User: user, Format: format, DryRun: dryRun, Replace: replace, Parsed: len(tasks), Problems: problems, Tasks: tasks}
+	if report.Tasks == nil {
+		report.Tasks = []ToDoTask{}
+	}
+
+	reply := make(chan Response, 1)
+	actor <- Request{Op: "list", UserID: user, ReplyCh: reply}
+	current := <-reply
+	if current.Err != nil {
+		return nil, current.Err
+	}
+	report.Existing = len(current.Tasks)
+	report.Result = len(current.Tasks) + len(tasks)
+	if replace {
+		report.Result = len(tasks)
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	op := "append"
+	if replace {
+		op = "replace"
+	}
+	actor <- Request{Op: op, UserID: user, Tasks: tasks, ReplyCh: reply}
+	res := <-reply
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	report.Result = len(res.Tasks)
+	return report, nil
+}
+
+// ExportTasks writes user's list to w in format.
+func ExportTasks(actor chan Request, user, format string, w io.Writer) error {
+	if !isFormat(format) {
+		return unknownFormat(format)
+	}
+	reply := make(chan Response, 1)
+	actor <- Request{Op: "list", UserID: user, ReplyCh: reply}
+	res := <-reply
+	if res.Err != nil {
+		return res.Err
+	}
+	return Export(w, format, res.Tasks)
+}
+
+func isFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
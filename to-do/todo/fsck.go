@@ -0,0 +1,269 @@
+package todo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of problem found by Fsck.
+const (
+	IssueInvalidJSON      = "invalid_json"      // the file does not decode
+	IssueUnreadable       = "unreadable"        // the file cannot be read or decrypted
+	IssueSchemaVersion    = "schema_version"    // older or newer than CurrentSchemaVersion
+	IssueMisnamedFile     = "misnamed_file"     // name or envelope user does not match the naming scheme
+	IssueDuplicateUser    = "duplicate_user"    // several files for users that differ only in case
+	IssueEmptyDescription = "empty_description" // a task without a description
+	IssueUnknownStatus    = "unknown_status"    // a status the app does not use
+	IssueStrayTemp        = "stray_temp"        // a temp file left behind by a crash
+)
+
+// KnownStatuses are the task statuses written by the CLI, REPL, API and importers.
+var KnownStatuses = []string{"not started", "started", "completed", "cancelled"}
+
+// statusAliases are spellings fsck can safely rewrite to a known status.
+var statusAliases = map[string]string{
+	"":            "not started",
+	"todo":        "not started",
+	"open":        "not started",
+	"new":         "not started",
+	"in progress": "started",
+	"in-progress": "started",
+	"doing":       "started",
+	"done":        "completed",
+	"complete":    "completed",
+	"finished":    "completed",
+	"canceled":    "cancelled",
+}
+
+// FsckIssue is one problem, and what --repair did about it. Action is empty when the
+// problem was only reported.
+type FsckIssue struct {
+	File   string `json:"file"`
+	User   string `json:"user,omitempty"`
+	Kind   string `json:"kind"`
+	Task   *int   `json:"task,omitempty"` // index in the file, for task level problems
+	Detail string `json:"detail"`
+	Action string `json:"action,omitempty"`
+}
+
+// FsckReport is the machine readable result of Fsck.
+type FsckReport struct {
+	Dir     string      `json:"dir"`
+	Time    time.Time   `json:"time"`
+	Repair  bool        `json:"repair"`
+	Checked int         `json:"files_checked"`
+	Issues  []FsckIssue `json:"issues"`
+}
+
+// Unresolved counts the issues that were not repaired.
+func (r *FsckReport) Unresolved() int {
+	n := 0
+	for _, is := range r.Issues {
+		if is.Action == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// add records is and returns its position, for setting the action later.
+func (r *FsckReport) add(is FsckIssue) int {
+	r.Issues = append(r.Issues, is)
+	return len(r.Issues) - 1
+}
+
+// nearUserFile matches names that were probably meant to be <user>_todo.json.
+var nearUserFile = regexp.MustCompile(`(?i)^(.+?)[_ -]todo\.json(\.json)?$`)
+
+// Fsck checks every user file in dir without going through the actor, so it works
+// when the server cannot load the data. With repair it fixes what it safely can: older
+// schemas are migrated, empty descriptions dropped, status spellings normalised,
+// misnamed files renamed, corrupt files restored from their previous generation or else
+// quarantined, and stray temp files removed. Files are rewritten through saveFile, so
+// the version before the repair is kept as the .bak generation.
+func Fsck(dir string, keys *Keyring, repair bool) (*FsckReport, error) {
+	report := &FsckReport{Dir: dir, Time: time.Now().UTC(), Repair: repair, Issues: []FsckIssue{}}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+
+	byFold := make(map[string][]string)
+	for _, e := range entries {
+		name := e.Name()
+		path := filepath.Join(dir, name)
+		if e.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(name, ".") && strings.Contains(name, "_"+TodoFile+".tmp-") {
+			is := report.add(FsckIssue{File: path, Kind: IssueStrayTemp, Detail: "left behind by an interrupted write"})
+			if repair && os.Remove(path) == nil {
+				report.Issues[is].Action = "removed"
+			}
+			continue
+		}
+		user, ok := UserFromFile(name)
+		if !ok {
+			if m := nearUserFile.FindStringSubmatch(name); m != nil {
+				fsckMisnamed(report, dir, path, m[1], keys, repair)
+			}
+			continue
+		}
+		report.Checked++
+		if err := ValidateUserID(user); err != nil {
+			report.add(FsckIssue{File: path, Kind: IssueMisnamedFile, Detail: err.Error()})
+			continue
+		}
+		byFold[strings.ToLower(user)] = append(byFold[strings.ToLower(user)], path)
+		fsckFile(report, path, user, keys, repair)
+	}
+
+	folds := make([]string, 0, len(byFold))
+	for f := range byFold {
+		folds = append(folds, f)
+	}
+	sort.Strings(folds)
+	for _, f := range folds {
+		if paths := byFold[f]; len(paths) > 1 {
+			for _, p := range paths {
+				report.add(FsckIssue{File: p, User: userForFile(p), Kind: IssueDuplicateUser,
+					Detail: fmt.Sprintf("%d files for user names that differ only in case, merge them by hand", len(paths))})
+			}
+		}
+	}
+	return report, nil
+}
+
+// fsckFile checks one <user>_todo.json and, with repair, rewrites it once with every
+// safe fix applied.
+func fsckFile(report *FsckReport, path, user string, keys *Keyring, repair bool) {
+	raw, err := readPlain(path, keys)
+	if err != nil {
+		if isEncrypted(readHead(path)) {
+			report.add(FsckIssue{File: path, User: user, Kind: IssueUnreadable, Detail: err.Error()})
+			return
+		}
+		fsckCorrupt(report, path, user, keys, repair, err)
+		return
+	}
+	version, err := detectVersion(raw)
+	if err != nil {
+		fsckCorrupt(report, path, user, keys, repair, err)
+		return
+	}
+	if version > CurrentSchemaVersion {
+		report.add(FsckIssue{File: path, User: user, Kind: IssueSchemaVersion,
+			Detail: fmt.Sprintf("written by a newer version (schema %d, this build reads up to %d)", version, CurrentSchemaVersion)})
+		return
+	}
+	tasks, _, err := decodeUserFile(raw, user)
+	if err != nil {
+		fsckCorrupt(report, path, user, keys, repair, err)
+		return
+	}
+
+	// fixes maps issue positions to the action taken if the repaired file is written
+	fixes := make(map[int]string)
+	if version < CurrentSchemaVersion {
+		is := report.add(FsckIssue{File: path, User: user, Kind: IssueSchemaVersion,
+			Detail: fmt.Sprintf("schema %d, current is %d", version, CurrentSchemaVersion)})
+		fixes[is] = "migrated to the current schema"
+	} else {
+		var env fileEnvelope
+		if json.Unmarshal(raw, &env) == nil && env.User != "" && env.User != user {
+			is := report.add(FsckIssue{File: path, User: user, Kind: IssueMisnamedFile,
+				Detail: fmt.Sprintf("file says it belongs to %q", env.User)})
+			fixes[is] = fmt.Sprintf("user set to %q to match the file name", user)
+		}
+	}
+
+	kept := make([]ToDoTask, 0, len(tasks))
+	for i, t := range tasks {
+		i := i
+		if strings.TrimSpace(t.Description) == "" {
+			is := report.add(FsckIssue{File: path, User: user, Kind: IssueEmptyDescription, Task: &i, Detail: "task has no description"})
+			fixes[is] = "task removed"
+			continue
+		}
+		if !isKnownStatus(t.Status) {
+			is := report.add(FsckIssue{File: path, User: user, Kind: IssueUnknownStatus, Task: &i, Detail: fmt.Sprintf("status %q", t.Status)})
+			if s, ok := statusAliases[normalStatus(t.Status)]; ok {
+				t.Status = s
+			} else if isKnownStatus(normalStatus(t.Status)) {
+				t.Status = normalStatus(t.Status)
+			}
+			if isKnownStatus(t.Status) {
+				fixes[is] = fmt.Sprintf("status set to %q", t.Status)
+			}
+		}
+		kept = append(kept, t)
+	}
+
+	if !repair || len(fixes) == 0 {
+		return
+	}
+	if err := saveFile(kept, path, keys); err != nil {
+		report.add(FsckIssue{File: path, User: user, Kind: IssueUnreadable, Detail: "repair failed: " + err.Error()})
+		return
+	}
+	for is, action := range fixes {
+		report.Issues[is].Action = action
+	}
+}
+
+// fsckCorrupt handles a file that does not decode: its previous generation is used if it
+// is good, otherwise the file is quarantined.
+func fsckCorrupt(report *FsckReport, path, user string, keys *Keyring, repair bool, cause error) {
+	is := report.add(FsckIssue{File: path, User: user, Kind: IssueInvalidJSON, Detail: cause.Error()})
+	if !repair {
+		return
+	}
+	if tasks, err := readTasks(path+BackupSuffix, keys); err == nil {
+		if err := saveFile(tasks, path, keys); err == nil {
+			report.Issues[is].Action = fmt.Sprintf("restored %d tasks from %s", len(tasks), path+BackupSuffix)
+			return
+		}
+	}
+	if moved, err := quarantine(path); err == nil {
+		report.Issues[is].Action = "quarantined to " + moved
+	}
+}
+
+// fsckMisnamed handles a file named almost like a user file. It is renamed to the right
+// name when that is free and the file decodes.
+func fsckMisnamed(report *FsckReport, dir, path, user string, keys *Keyring, repair bool) {
+	target := Paths{Dir: dir}.UserFile(user)
+	is := report.add(FsckIssue{File: path, User: user, Kind: IssueMisnamedFile, Detail: "expected " + filepath.Base(target)})
+	if !repair || ValidateUserID(user) != nil || isEncrypted(readHead(path)) {
+		return
+	}
+	if _, err := os.Stat(target); err == nil {
+		report.Issues[is].Detail += ", which already exists"
+		return
+	}
+	if _, err := readTasks(path, keys); err != nil {
+		return
+	}
+	if err := os.Rename(path, target); err == nil {
+		report.Issues[is].Action = "renamed to " + filepath.Base(target)
+	}
+}
+
+func isKnownStatus(status string) bool {
+	for _, s := range KnownStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func normalStatus(status string) string {
+	return strings.ToLower(strings.Join(strings.Fields(strings.ReplaceAll(status, "_", " ")), " "))
+}
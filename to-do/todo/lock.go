@@ -0,0 +1,145 @@
+package todo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// errLocked is returned by flock when it would have to wait.
+var errLocked = errors.New("locked by another process")
+
+// Kinds of process that own a data directory, see ClaimDir.
+const (
+	OwnerServer = "server"
+	OwnerCLI    = "cli"
+	OwnerREPL   = "repl"
+)
+
+// Owner is written into the owner lock file by the process holding it.
+type Owner struct {
+	PID   int       `json:"pid"`
+	Kind  string    `json:"kind"`
+	Addr  string    `json:"addr,omitempty"` // servers only: base URL clients can reach it on
+	Since time.Time `json:"since"`
+}
+
+// InUseError is returned when another process owns the data directory. Owner is nil if
+// it could not be read, e.g. because the owner was still writing it.
+type InUseError struct {
+	Dir   string
+	Owner *Owner
+}
+
+func (e *InUseError) Error() string {
+	if e.Owner == nil {
+		return fmt.Sprintf("data directory %s is in use by another todo process", e.Dir)
+	}
+	msg := fmt.Sprintf("data directory %s is in use by a todo %s (pid %d)", e.Dir, e.Owner.Kind, e.Owner.PID)
+	if e.Owner.Addr != "" {
+		msg += " at " + e.Owner.Addr
+	}
+	return msg
+}
+
+func (e *InUseError) Is(target error) bool { return target == ErrConflict }
+
+// DirLock is a claimed data directory. Release it when the process is done with it.
+type DirLock struct {
+	f *os.File
+}
+
+// Release gives up the data directory. It is safe on a nil lock.
+func (l *DirLock) Release() {
+	if l == nil {
+		return
+	}
+	l.f.Truncate(0)
+	l.f.Close()
+}
+
+// ClaimDir makes the calling process the only one using dir, so two processes never
+// keep separate copies of the same lists and overwrite each other's saves. It does not
+// wait: if another process owns dir it returns an *InUseError saying which.
+func ClaimDir(dir string, me Owner) (*DirLock, error) {
+	f, err := os.OpenFile(Paths{Dir: dir}.OwnerLock(), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	if err := flock(f, true, false); err != nil {
+		defer f.Close()
+		if err != errLocked {
+			return nil, fmt.Errorf("%w: lock %s: %v", ErrStorage, f.Name(), err)
+		}
+		var owner Owner
+		if data, _ := io.ReadAll(f); json.Unmarshal(data, &owner) == nil && owner.PID != 0 {
+			return nil, &InUseError{Dir: dir, Owner: &owner}
+		}
+		return nil, &InUseError{Dir: dir}
+	}
+	me.PID = os.Getpid()
+	me.Since = time.Now().UTC()
+	data, _ := json.Marshal(me)
+	f.Truncate(0) // a process that died holding the lock left its details behind
+	if _, err := f.WriteAt(data, 0); err != nil {
+		slog.Warn("could not record data directory owner", "file", f.Name(), "error", err)
+	}
+	return &DirLock{f: f}, nil
+}
+
+// Attach connects a CLI or REPL (kind OwnerCLI or OwnerREPL) to cfg's data directory.
+// If no other process owns it, it is claimed, cfg.Store is opened and the tasks are
+// loaded into an actor on ReqChan; call release after the final Flush. If a server owns
+// it, requests are sent to the server instead and cfg.Remote is set, or with
+// cfg.ServerMode ServerRefuse an error says so. Any other owner is always an error.
+func Attach(cfg *Config, kind string) (actor chan Request, release func(), err error) {
+	dir := dataDir(*cfg)
+	lock, err := ClaimDir(dir, Owner{Kind: kind})
+	var inUse *InUseError
+	if errors.As(err, &inUse) && inUse.Owner != nil && inUse.Owner.Kind == OwnerServer && inUse.Owner.Addr != "" {
+		if cfg.ServerMode == ServerRefuse {
+			return nil, nil, fmt.Errorf("%w; stop it first, or unset TODO_SERVER_MODE to send commands to it", err)
+		}
+		slog.Info("a server owns the data directory, sending requests to it", "addr", inUse.Owner.Addr, "pid", inUse.Owner.PID)
+		cfg.Remote = inUse.Owner.Addr
+		return RemoteActor(cfg.Remote, cfg.Auth.Token), func() {}, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w; only one todo process can use it at a time", err)
+	}
+
+	if cfg.Store, err = OpenStore(*cfg); err != nil {
+		lock.Release()
+		return nil, nil, fmt.Errorf("open store: %w", err)
+	}
+	userLists, err := Preload(cfg.Store)
+	if err != nil {
+		lock.Release()
+		return nil, nil, fmt.Errorf("load tasks (run fsck to check the data directory): %w", err)
+	}
+	slog.Info("Loaded files ...", "DATA", userLists)
+	go RunActor(ReqChan, userLists, *cfg)
+	return ReqChan, lock.Release, nil
+}
+
+// lock takes the store lock of s's directory for the duration of one read (shared) or
+// write (exclusive), so a file is never read while another process replaces it.
+func (s *JSONStore) lock(exclusive bool) (unlock func(), err error) {
+	f, err := os.OpenFile(Paths{Dir: s.Dir}.StoreLock(), os.O_RDWR|os.O_CREATE, 0600)
+	if os.IsNotExist(err) {
+		// no directory yet: nothing to read, and the write fails on its own
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	if err := flock(f, exclusive, true); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: lock %s: %v", ErrStorage, f.Name(), err)
+	}
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,47 @@
+package todo
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemStore keeps task lists in memory only. It is meant for tests and ephemeral servers.
+type MemStore struct {
+	mu    sync.Mutex
+	lists map[string][]ToDoTask
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{lists: make(map[string][]ToDoTask)}
+}
+
+func (s *MemStore) Load(user string) ([]ToDoTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ToDoTask(nil), s.lists[user]...), nil
+}
+
+func (s *MemStore) Save(user string, tasks []ToDoTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lists[user] = append([]ToDoTask(nil), tasks...)
+	return nil
+}
+
+func (s *MemStore) Users() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make([]string, 0, len(s.lists))
+	for user := range s.lists {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (s *MemStore) Delete(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.lists, user)
+	return nil
+}
@@ -0,0 +1,407 @@
+package todo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logSuffix      = ".log.jsonl"
+	snapshotSuffix = ".snapshot.json"
+)
+
+// LogRecord is one mutation in a user's operation log.
+type LogRecord struct {
+	Seq   uint64     `json:"seq"`
+	Time  time.Time  `json:"time"`
+	Op    string     `json:"op"` // add, update, delete or replace
+	Index int        `json:"index,omitempty"`
+	Task  *ToDoTask  `json:"task,omitempty"`
+	Tasks []ToDoTask `json:"tasks,omitempty"` // replace only
+}
+
+// Appender is implemented by stores that can persist a single mutation instead of
+// rewriting the whole list. tasks is the user's list after rec has been applied.
+type Appender interface {
+	Append(user string, rec LogRecord, tasks []ToDoTask) error
+}
+
+// snapshot is the on-disk form of <user>.snapshot.json.
+type snapshot struct {
+	Seq   uint64     `json:"seq"`
+	Tasks []ToDoTask `json:"tasks"`
+}
+
+// LogStore keeps, per user, a snapshot plus an append-only JSON-lines log of the
+// mutations made since that snapshot:
+//
+//	<Dir>/<user>.snapshot.json
+//	<Dir>/<user>.log.jsonl
+//	<Dir>/<user>.log.jsonl.<seq>  (archived segments, see History)
+//
+// Every SnapshotEvery records the current list is written as a new snapshot and the
+// log is archived as a segment named after its last sequence number. A user that only
+// has a legacy <user>_todo.json file is imported into a snapshot the first time it is
+// loaded.
+type LogStore struct {
+	Dir           string
+	SnapshotEvery int // records between snapshots, <= 0 means 1000
+
+	mu      sync.Mutex
+	seq     map[string]uint64 // last sequence number written per user
+	pending map[string]int    // records in the log since the last snapshot
+}
+
+func NewLogStore(dir string, snapshotEvery int) *LogStore {
+	return &LogStore{
+		Dir:           dir,
+		SnapshotEvery: snapshotEvery,
+		seq:           make(map[string]uint64),
+		pending:       make(map[string]int),
+	}
+}
+
+func (s *LogStore) logPath(user string) string {
+	return Paths{Dir: s.Dir}.UserLog(user)
+}
+
+func (s *LogStore) snapshotPath(user string) string {
+	return Paths{Dir: s.Dir}.UserSnapshot(user)
+}
+
+// Load replays the user's snapshot and log.
+func (s *LogStore) Load(user string) ([]ToDoTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap, ok, err := s.readSnapshot(user)
+	if err != nil {
+		return nil, err
+	}
+	records, err := s.readLog(user)
+	if err != nil {
+		return nil, err
+	}
+	if !ok && len(records) == 0 {
+		if snap, _, err = s.importLegacy(user); err != nil {
+			return nil, err
+		}
+	}
+	tasks, seq := snap.Tasks, snap.Seq
+	pending := 0
+	for _, rec := range records {
+		if rec.Seq <= seq {
+			continue // already part of the snapshot
+		}
+		if tasks, err = applyRecord(tasks, rec); err != nil {
+			return nil, fmt.Errorf("replay %s seq %d: %w", s.logPath(user), rec.Seq, err)
+		}
+		seq = rec.Seq
+		pending++
+	}
+	s.seq[user] = seq
+	s.pending[user] = pending
+	return tasks, nil
+}
+
+// Append writes rec to the user's log and fsyncs it, compacting when a snapshot is due.
+func (s *LogStore) Append(user string, rec LogRecord, tasks []ToDoTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec.Seq = s.seq[user] + 1
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.logPath(user), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err == nil {
+		if _, err = f.Write(append(line, '\n')); err == nil {
+			err = f.Sync()
+		}
+		if err != nil {
+			// cut off what was written, or the next record would be appended to a torn line
+			if terr := f.Truncate(size); terr != nil {
+				slog.Error("oplog: could not cut off failed append", "file", s.logPath(user), "error", terr)
+			}
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	s.seq[user] = rec.Seq
+	s.pending[user]++
+
+	every := s.SnapshotEvery
+	if every <= 0 {
+		every = 1000
+	}
+	if s.pending[user] >= every {
+		if err := s.compact(user, tasks); err != nil {
+			// the record is safely in the log, compaction is retried on the next append
+			slog.Warn("oplog: compaction failed", "user", user, "error", err)
+		}
+	}
+	return nil
+}
+
+// Save replaces the user's whole list. It writes a snapshot and archives the log.
+func (s *LogStore) Save(user string, tasks []ToDoTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq[user]++
+	return s.compact(user, tasks)
+}
+
+// compact writes tasks as the snapshot at the current sequence number and archives the
+// log as a segment, so the next append starts a new one.
+func (s *LogStore) compact(user string, tasks []ToDoTask) error {
+	seq := s.seq[user]
+	data, err := json.MarshalIndent(snapshot{Seq: seq, Tasks: tasks}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.snapshotPath(user), data, 0644); err != nil {
+		return err
+	}
+	// records up to seq are covered by the snapshot, so a crash before the rename is harmless
+	if info, err := os.Stat(s.logPath(user)); err == nil && info.Size() > 0 {
+		if err := os.Rename(s.logPath(user), s.segmentPath(user, seq)); err != nil {
+			return err
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.pending[user] = 0
+	return nil
+}
+
+func (s *LogStore) segmentPath(user string, seq uint64) string {
+	return fmt.Sprintf("%s.%d", s.logPath(user), seq)
+}
+
+// segments returns the user's archived log segments, oldest first.
+func (s *LogStore) segments(user string) ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	prefix := user + logSuffix + "."
+	seqs := make(map[string]uint64)
+	var paths []string
+	for _, e := range entries {
+		rest, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		seq, err := strconv.ParseUint(rest, 10, 64)
+		if err != nil {
+			continue
+		}
+		p := filepath.Join(s.Dir, e.Name())
+		seqs[p] = seq
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool { return seqs[paths[i]] < seqs[paths[j]] })
+	return paths, nil
+}
+
+// Users lists users with a snapshot, a log or a legacy <user>_todo.json file.
+func (s *LogStore) Users() ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		for _, suffix := range []string{snapshotSuffix, logSuffix, "_" + TodoFile} {
+			if strings.HasSuffix(name, suffix) {
+				seen[strings.TrimSuffix(name, suffix)] = true
+			}
+		}
+	}
+	users := make([]string, 0, len(seen))
+	for user := range seen {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (s *LogStore) Delete(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	segments, err := s.segments(user)
+	if err != nil {
+		return err
+	}
+	for _, p := range append([]string{s.snapshotPath(user), s.snapshotPath(user) + BackupSuffix, s.logPath(user)}, segments...) {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	delete(s.seq, user)
+	delete(s.pending, user)
+	return nil
+}
+
+// History returns every mutation recorded for the user, from the archived segments and
+// the current log, oldest first.
+func (s *LogStore) History(user string) ([]LogRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	segments, err := s.segments(user)
+	if err != nil {
+		return nil, err
+	}
+	var history []LogRecord
+	for _, p := range segments {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		records, _, err := decodeLog(p, data)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, records...)
+	}
+	records, err := s.readLog(user)
+	if err != nil {
+		return nil, err
+	}
+	return append(history, records...), nil
+}
+
+func (s *LogStore) readSnapshot(user string) (snapshot, bool, error) {
+	var snap snapshot
+	data, err := os.ReadFile(s.snapshotPath(user))
+	if os.IsNotExist(err) {
+		return snap, false, nil
+	}
+	if err != nil {
+		return snap, false, err
+	}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return snap, false, fmt.Errorf("invalid snapshot %s: %w", s.snapshotPath(user), err)
+	}
+	return snap, true, nil
+}
+
+// importLegacy turns an existing <user>_todo.json into the user's first snapshot.
+// The JSON file is left in place so switching back to the json backend stays possible.
+func (s *LogStore) importLegacy(user string) (snapshot, bool, error) {
+	legacy := Paths{Dir: s.Dir}.UserFile(user)
+	if _, err := os.Stat(legacy); err != nil {
+		return snapshot{}, false, nil
+	}
+	tasks, err := LoadFile(legacy)
+	if err != nil {
+		return snapshot{}, false, err
+	}
+	s.seq[user] = 0
+	if err := s.compact(user, tasks); err != nil {
+		return snapshot{}, false, fmt.Errorf("import %s: %w", legacy, err)
+	}
+	slog.Info("oplog: imported legacy task file", "file", legacy, "tasks", len(tasks))
+	return snapshot{Tasks: tasks}, true, nil
+}
+
+// readLog decodes the user's log. A torn last line, left by a crash mid-append, is
+// cut off so the next append starts on a fresh line.
+func (s *LogStore) readLog(user string) ([]LogRecord, error) {
+	data, err := os.ReadFile(s.logPath(user))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	records, torn, err := decodeLog(s.logPath(user), data)
+	if err != nil {
+		return nil, err
+	}
+	if torn > 0 {
+		if err := os.Truncate(s.logPath(user), int64(len(data)-torn)); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// decodeLog decodes the records in data, read from path. A last line that does not
+// decode is skipped and its length returned as torn.
+func decodeLog(path string, data []byte) (records []LogRecord, torn int, err error) {
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var rec LogRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if i == len(lines)-1 { // no trailing newline: the append never finished
+				slog.Warn("oplog: dropping torn last record", "file", path, "line", i+1)
+				return records, len(line), nil
+			}
+			return nil, 0, fmt.Errorf("invalid record in %s line %d: %w", path, i+1, err)
+		}
+		records = append(records, rec)
+	}
+	return records, 0, nil
+}
+
+// applyRecord returns tasks with rec applied. It may reuse the backing array of tasks.
+func applyRecord(tasks []ToDoTask, rec LogRecord) ([]ToDoTask, error) {
+	switch rec.Op {
+	case "add":
+		if rec.Task == nil {
+			return nil, fmt.Errorf("add record without task")
+		}
+		return append(tasks, *rec.Task), nil
+	case "update":
+		if rec.Task == nil || rec.Index < 0 || rec.Index >= len(tasks) {
+			return nil, fmt.Errorf("bad update at index %d", rec.Index)
+		}
+		tasks[rec.Index] = *rec.Task
+		return tasks, nil
+	case "delete":
+		if rec.Index < 0 || rec.Index >= len(tasks) {
+			return nil, fmt.Errorf("bad delete at index %d", rec.Index)
+		}
+		return append(tasks[:rec.Index], tasks[rec.Index+1:]...), nil
+	case "replace":
+		return append([]ToDoTask(nil), rec.Tasks...), nil
+	default:
+		return nil, fmt.Errorf("unknown op %q", rec.Op)
+	}
+}
@@ -0,0 +1,176 @@
+package todo
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// TaskPatch changes only the fields it sets, see the "patch" op. Without Expect its JSON
+// form is an RFC 7396 merge patch.
+type TaskPatch struct {
+	Description *string `json:"description,omitempty"`
+	Status      *string `json:"status,omitempty"`
+	// Expect holds JSON Patch "test" values by field: the patch fails with ErrConflict
+	// unless the task has them.
+	Expect map[string]string `json:"expect,omitempty"`
+}
+
+// PatchOp is one RFC 6902 JSON Patch operation.
+type PatchOp struct {
+	Op    string  `json:"op"`
+	Path  string  `json:"path"`
+	Value *string `json:"value,omitempty"`
+}
+
+// patchPaths are the JSON Patch paths a task has.
+var patchPaths = map[string]string{"/description": "description", "/status": "status"}
+
+// ParseMergePatch reads an RFC 7396 merge patch of a task. Errors match ErrInvalidInput.
+func ParseMergePatch(data []byte) (*TaskPatch, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, &ValidationError{Field: "body", Reason: "not a JSON object"}
+	}
+	p := &TaskPatch{}
+	for name, raw := range fields {
+		var v *string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, &ValidationError{Field: name, Reason: "must be a string"}
+		}
+		if err := p.set(name, v); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// ParseJSONPatch reads an RFC 6902 JSON Patch of a task. "add" and "replace" set a
+// field, "test" goes into Expect; fields cannot be removed. Errors match ErrInvalidInput.
+func ParseJSONPatch(data []byte) (*TaskPatch, error) {
+	var ops []PatchOp
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return nil, &ValidationError{Field: "body", Reason: "not a JSON Patch array"}
+	}
+	p := &TaskPatch{}
+	for i, op := range ops {
+		name, ok := patchPaths[op.Path]
+		if !ok {
+			return nil, &ValidationError{Field: fmt.Sprintf("[%d].path", i), Reason: fmt.Sprintf("a task has no %q", op.Path)}
+		}
+		switch op.Op {
+		case "add", "replace":
+			if err := p.set(name, op.Value); err != nil {
+				return nil, err
+			}
+		case "test":
+			if op.Value == nil {
+				return nil, &ValidationError{Field: fmt.Sprintf("[%d].value", i), Reason: "must be a string"}
+			}
+			if p.Expect == nil {
+				p.Expect = make(map[string]string)
+			}
+			p.Expect[name] = *op.Value
+		default:
+			return nil, &ValidationError{Field: fmt.Sprintf("[%d].op", i), Reason: fmt.Sprintf("%q is not supported, use add, replace or test", op.Op)}
+		}
+	}
+	return p, nil
+}
+
+func (p *TaskPatch) set(name string, v *string) error {
+	if v == nil {
+		return &ValidationError{Field: name, Reason: "cannot be removed, set it instead"}
+	}
+	switch name {
+	case "description":
+		if strings.TrimSpace(*v) == "" {
+			return &ValidationError{Field: name, Reason: "cannot be empty"}
+		}
+		p.Description = v
+	case "status":
+		if *v == "" {
+			return &ValidationError{Field: name, Reason: "cannot be empty"}
+		}
+		p.Status = v
+	default:
+		return &ValidationError{Field: name, Reason: "not a task field"}
+	}
+	return checkText(name, *v)
+}
+
+// Ops is p as a JSON Patch, which unlike a merge patch also carries Expect.
+func (p *TaskPatch) Ops() []PatchOp {
+	var ops []PatchOp
+	for _, name := range []string{"description", "status"} {
+		if v, ok := p.Expect[name]; ok {
+			ops = append(ops, PatchOp{Op: "test", Path: "/" + name, Value: &v})
+		}
+	}
+	if p.Description != nil {
+		ops = append(ops, PatchOp{Op: "replace", Path: "/description", Value: p.Description})
+	}
+	if p.Status != nil {
+		ops = append(ops, PatchOp{Op: "replace", Path: "/status", Value: p.Status})
+	}
+	return ops
+}
+
+// Apply returns t with p's fields, or ErrConflict if t fails one of p's tests.
+func (p *TaskPatch) Apply(t ToDoTask) (ToDoTask, error) {
+	have := map[string]string{"description": t.Description, "status": t.Status}
+	for name, want := range p.Expect {
+		if have[name] != want {
+			return t, fmt.Errorf("%w: task %s is %q, not %q", ErrConflict, name, have[name], want)
+		}
+	}
+	if p.Description != nil {
+		t.Description = *p.Description
+	}
+	if p.Status != nil {
+		t.Status = *p.Status
+	}
+	return t, nil
+}
+
+// resolvePatch turns a "patch" request into the "update" that writes the patched task,
+// so stores, the op log and replicas only ever see whole tasks.
+func (a *actorState) resolvePatch(req Request) (Request, error) {
+	if req.Patch == nil {
+		return req, &ValidationError{Field: "patch", Reason: "missing"}
+	}
+	var current ToDoTask
+	if a.rows != nil {
+		t, err := a.rows.Get(req.UserID, req.Index)
+		if err != nil {
+			return req, rowErr(req.UserID, err)
+		}
+		current = t
+	} else {
+		tasks := a.lists[req.UserID]
+		if req.Index < 0 || req.Index >= len(tasks) {
+			return req, &IndexError{UserID: req.UserID, Index: req.Index, Len: len(tasks)}
+		}
+		current = tasks[req.Index]
+	}
+	t, err := req.Patch.Apply(current)
+	if err != nil {
+		return req, err
+	}
+	// patches built in code, like the REPL's, have not been through set
+	if err := ValidateTask(t); err != nil {
+		return req, err
+	}
+	slog.Debug("actor patch", "index", req.Index, "task", t)
+	req.Op, req.Task, req.Patch = "update", t, nil
+	return req, nil
+}
+
+// PatchTask changes only the fields p sets on user's task idx and returns the result.
+func PatchTask(actor chan Request, user string, idx int, p TaskPatch) (*ToDoTask, error) {
+	reply := make(chan Response, 1)
+	actor <- Request{Op: "patch", UserID: user, Index: idx, Patch: &p, ReplyCh: reply}
+	resp := <-reply
+	return resp.Task, resp.Err
+}
@@ -0,0 +1,120 @@
+package todo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DataDirFlag is the command line flag that selects the data directory.
+const DataDirFlag = "data-dir"
+
+// Paths resolves every file kept in the data directory. The layout is flat and
+// discovery never descends into subdirectories:
+//
+//	<dir>/<user>_todo.json         json backend (plus .bak previous generation)
+//	<dir>/<user>.snapshot.json     log backend snapshot
+//	<dir>/<user>.log.jsonl         log backend operations since the snapshot
+//	<dir>/todo.db                  sqlite backend
+//	<dir>/todo.bolt                bolt backend
+//	<dir>/todo.lock                owner lock, held by the process using the directory
+//	<dir>/.todo-store.lock         store lock, held for each json read or write
+//	<dir>/tokens.json              API tokens, hashed
+type Paths struct {
+	Dir string
+}
+
+// UserFile is the JSON task file of user.
+func (p Paths) UserFile(user string) string {
+	return filepath.Join(p.Dir, user+"_"+TodoFile)
+}
+
+// UserLog is the operation log of user.
+func (p Paths) UserLog(user string) string {
+	return filepath.Join(p.Dir, user+logSuffix)
+}
+
+// UserSnapshot is the log backend snapshot of user.
+func (p Paths) UserSnapshot(user string) string {
+	return filepath.Join(p.Dir, user+snapshotSuffix)
+}
+
+func (p Paths) SQLite() string { return filepath.Join(p.Dir, SQLiteFile) }
+
+func (p Paths) Bolt() string { return filepath.Join(p.Dir, BoltFile) }
+
+// OwnerLock is locked for as long as a server, CLI or REPL uses the directory, see ClaimDir.
+func (p Paths) OwnerLock() string { return filepath.Join(p.Dir, "todo.lock") }
+
+// StoreLock is locked around each read and write of a user file.
+func (p Paths) StoreLock() string { return filepath.Join(p.Dir, ".todo-store.lock") }
+
+// Tokens holds the API tokens, see TokenStore.
+func (p Paths) Tokens() string { return filepath.Join(p.Dir, "tokens.json") }
+
+// UserFromFile returns the user a <user>_todo.json file name belongs to.
+func UserFromFile(name string) (string, bool) {
+	if !strings.HasSuffix(name, "_"+TodoFile) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, "_"+TodoFile), true
+}
+
+// ValidateUserID rejects IDs that could escape the data directory when used in a file name.
+func ValidateUserID(user string) error {
+	if user == "." || user == ".." || strings.ContainsAny(user, `/\`+"\x00") {
+		return &ValidationError{Field: "userID", Reason: "must not contain path separators"}
+	}
+	return nil
+}
+
+// ResolveDataDir picks the data directory: flagValue if set, else $TODO_DATA_DIR, else
+// $XDG_DATA_HOME/todo, else ~/.local/share/todo. The directory is created if needed.
+func ResolveDataDir(flagValue string) (string, error) {
+	dir := flagValue
+	if dir == "" {
+		dir = os.Getenv("TODO_DATA_DIR")
+	}
+	if dir == "" {
+		base := os.Getenv("XDG_DATA_HOME")
+		if base == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", fmt.Errorf("cannot find a data directory, set -%s or TODO_DATA_DIR: %w", DataDirFlag, err)
+			}
+			base = filepath.Join(home, ".local", "share")
+		}
+		dir = filepath.Join(base, "todo")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// TakeDataDirFlag removes -data-dir (in any of the forms the flag package accepts)
+// from args and returns the remaining args and the flag's value. It lets binaries
+// whose other flags are parsed later by Run accept the flag anywhere.
+func TakeDataDirFlag(args []string) ([]string, string) {
+	var rest []string
+	value := ""
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		name := strings.TrimLeft(a, "-")
+		switch {
+		case i > 0 && strings.HasPrefix(a, "-") && name == DataDirFlag && i+1 < len(args):
+			value = args[i+1]
+			i++
+		case i > 0 && strings.HasPrefix(a, "-") && strings.HasPrefix(name, DataDirFlag+"="):
+			value = strings.TrimPrefix(name, DataDirFlag+"=")
+		default:
+			rest = append(rest, a)
+		}
+	}
+	return rest, value
+}
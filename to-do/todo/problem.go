@@ -0,0 +1,94 @@
+package todo
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ProblemType is the media type of an API error body.
+const ProblemType = "application/problem+json"
+
+// Codes in a Problem. They are stable: clients may switch on them.
+const (
+	CodeNotFound             = "not_found"
+	CodeInvalidInput         = "invalid_input"
+	CodeConflict             = "conflict"
+	CodeForbidden            = "forbidden"
+	CodeQuotaExceeded        = "quota_exceeded"
+	CodeUnavailable          = "unavailable"
+	CodeUnauthenticated      = "unauthenticated"
+	CodeNotLeader            = "not_leader"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeTooLarge             = "too_large"
+	CodeInternal             = "internal"
+)
+
+// Problem is an RFC 7807 problem details body, the form of every API error.
+type Problem struct {
+	Type    string         `json:"type"`
+	Title   string         `json:"title"`
+	Status  int            `json:"status"`
+	Detail  string         `json:"detail,omitempty"`
+	Code    string         `json:"code"`
+	TraceID string         `json:"trace_id,omitempty"`
+	Errors  []FieldProblem `json:"errors,omitempty"` // invalid_input only
+}
+
+// FieldProblem is one rejected request field, a ValidationError on the wire.
+type FieldProblem struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// NewProblem fills in the type and title for code and status.
+func NewProblem(status int, code, detail string) *Problem {
+	return &Problem{Type: "urn:todo:problem:" + code, Title: http.StatusText(status), Status: status, Detail: detail, Code: code}
+}
+
+// ErrorCode is the Problem code for err.
+func ErrorCode(err error) string {
+	var notLeader *NotLeaderError
+	switch {
+	case errors.As(err, &notLeader):
+		return CodeNotLeader
+	case errors.Is(err, ErrNotFound):
+		return CodeNotFound
+	case errors.Is(err, ErrInvalidInput):
+		return CodeInvalidInput
+	case errors.Is(err, ErrConflict):
+		return CodeConflict
+	case errors.Is(err, ErrForbidden):
+		return CodeForbidden
+	case errors.Is(err, ErrQuotaExceeded):
+		return CodeQuotaExceeded
+	case errors.Is(err, ErrUnavailable):
+		return CodeUnavailable
+	case errors.Is(err, ErrUnauthenticated):
+		return CodeUnauthenticated
+	}
+	return CodeInternal
+}
+
+// FieldProblems lists every ValidationError in err's tree.
+func FieldProblems(err error) []FieldProblem {
+	var out []FieldProblem
+	var walk func(error)
+	walk = func(err error) {
+		if v, ok := err.(*ValidationError); ok {
+			out = append(out, FieldProblem{Field: v.Field, Reason: v.Reason})
+		}
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			if next := e.Unwrap(); next != nil {
+				walk(next)
+			}
+		case interface{ Unwrap() []error }:
+			for _, next := range e.Unwrap() {
+				walk(next)
+			}
+		}
+	}
+	walk(err)
+	return out
+}
@@ -0,0 +1,189 @@
+package todo
+
+import (
+	"strings"
+	"time"
+)
+
+// DueLayout is the date format of a due:YYYY-MM-DD token in a description.
+const DueLayout = "2006-01-02"
+
+// Query selects a page of one user's tasks, see the "query" op. Zero fields do not
+// filter. Tags and due dates are written in the description the todo.txt way:
+// "#tag", "+project" or "@context" and "due:2025-01-31".
+type Query struct {
+	Status  []string  // any of these statuses
+	Tag     string    // a #, + or @ tag, without the sign
+	DueFrom time.Time // due on or after
+	DueTo   time.Time // due on or before
+	Text    string    // in the description, ignoring case
+	After   *PageKey  // start after this task, the Next of the previous page
+	Limit   int       // matches to return, 0 for all
+}
+
+// Page is the reply to the "query" op.
+type Page struct {
+	Tasks   []ToDoTask
+	Indexes []int    // index of each task in the user's list, for get, update and delete
+	Total   int      // matches in the whole list
+	Next    *PageKey // After for the next page, nil when this is the last
+}
+
+// PageKey is the last task of a page. The next page starts after that task wherever it
+// has moved, so tasks deleted in between do not make a page skip or repeat any. Row is
+// the task's key in a Querier store; lists kept in memory have no keys, so there the
+// task is found again by its old Index and a Sum of its contents.
+type PageKey struct {
+	Row   int64  `json:"r,omitempty"`
+	Index int    `json:"i"`
+	Sum   string `json:"s,omitempty"`
+}
+
+// Querier is implemented by stores that filter and page a user's tasks themselves, so
+// the actor does not load the whole list for a query. Their PageKeys carry a Row.
+type Querier interface {
+	Query(user string, q Query) (*Page, error)
+}
+
+// taskSum identifies a task's contents in a PageKey.
+func taskSum(t ToDoTask) string {
+	return fingerprint([]ToDoTask{t})[:16]
+}
+
+// TaskTags returns the #, + and @ tags in t's description, without the sign.
+func TaskTags(t ToDoTask) []string {
+	var tags []string
+	for _, word := range strings.Fields(t.Description) {
+		if len(word) > 1 && strings.ContainsRune("#+@", rune(word[0])) {
+			tags = append(tags, word[1:])
+		}
+	}
+	return tags
+}
+
+// TaskDue returns the date of a due:YYYY-MM-DD token in t's description.
+func TaskDue(t ToDoTask) (time.Time, bool) {
+	for _, word := range strings.Fields(t.Description) {
+		if v, ok := strings.CutPrefix(word, "due:"); ok {
+			if d, err := time.Parse(DueLayout, v); err == nil {
+				return d, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// Match reports whether t passes every filter of q.
+func (q *Query) Match(t ToDoTask) bool {
+	if len(q.Status) > 0 {
+		ok := false
+		for _, s := range q.Status {
+			if normalStatus(s) == normalStatus(t.Status) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if q.Tag != "" {
+		ok := false
+		for _, tag := range TaskTags(t) {
+			if strings.EqualFold(tag, q.Tag) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if !q.DueFrom.IsZero() || !q.DueTo.IsZero() {
+		due, ok := TaskDue(t)
+		if !ok || (!q.DueFrom.IsZero() && due.Before(q.DueFrom)) || (!q.DueTo.IsZero() && due.After(q.DueTo)) {
+			return false
+		}
+	}
+	return q.Text == "" || strings.Contains(strings.ToLower(t.Description), strings.ToLower(q.Text))
+}
+
+// run pages through tasks, copying only the tasks it returns.
+func (q *Query) run(tasks []ToDoTask) *Page {
+	page := newPage()
+	from := q.resume(tasks)
+	for i, t := range tasks {
+		if !q.Match(t) {
+			continue
+		}
+		page.Total++
+		if i >= from && !page.add(q, t, i) && page.Next == nil {
+			page.Next = &PageKey{Index: page.last(), Sum: taskSum(page.Tasks[len(page.Tasks)-1])}
+		}
+	}
+	return page
+}
+
+// resume is the index in tasks to continue from after q.After. Tasks are only ever
+// appended at the end, so deletes can only have moved it towards the front.
+func (q *Query) resume(tasks []ToDoTask) int {
+	if q.After == nil {
+		return 0
+	}
+	for i := min(q.After.Index, len(tasks)-1); i >= 0; i-- {
+		if taskSum(tasks[i]) == q.After.Sum {
+			return i + 1
+		}
+	}
+	// it was deleted or changed: what followed it is at its old index at most
+	return min(q.After.Index, len(tasks))
+}
+
+func newPage() *Page {
+	return &Page{Tasks: []ToDoTask{}, Indexes: []int{}}
+}
+
+// add puts task index i on the page, or reports false when the page is full.
+func (p *Page) add(q *Query, t ToDoTask, i int) bool {
+	if q.Limit > 0 && len(p.Tasks) == q.Limit {
+		return false
+	}
+	p.Tasks = append(p.Tasks, t)
+	p.Indexes = append(p.Indexes, i)
+	return true
+}
+
+func (p *Page) last() int {
+	return p.Indexes[len(p.Indexes)-1]
+}
+
+// handleQuery answers the "query" op from the user's list.
+func (a *actorState) handleQuery(req Request) Response {
+	q := req.Query
+	if q == nil {
+		q = &Query{}
+	}
+	if querier, ok := a.rows.(Querier); ok {
+		page, err := querier.Query(req.UserID, *q)
+		if err != nil {
+			return Response{Err: rowErr(req.UserID, err)}
+		}
+		return Response{Page: page}
+	}
+	if a.rows != nil {
+		tasks, err := a.rows.Load(req.UserID)
+		if err != nil {
+			return Response{Err: rowErr(req.UserID, err)}
+		}
+		return Response{Page: q.run(tasks)}
+	}
+	return Response{Page: q.run(a.lists[req.UserID])}
+}
+
+// QueryTasks asks the actor for one page of user's tasks.
+func QueryTasks(actor chan Request, user string, q Query) (*Page, error) {
+	reply := make(chan Response, 1)
+	actor <- Request{Op: "query", UserID: user, Query: &q, ReplyCh: reply}
+	resp := <-reply
+	return resp.Page, resp.Err
+}
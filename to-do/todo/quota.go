@@ -0,0 +1,168 @@
+package todo
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits are the per-user quotas enforced by the actor. A zero value disables that limit.
+type Limits struct {
+	MaxTasks          int `json:"max_tasks"`
+	MaxDescriptionLen int `json:"max_description_len"` // in characters
+	MaxOpsPerMinute   int `json:"max_ops_per_minute"`
+}
+
+// Usage is one user's consumption measured against Limits.
+type Usage struct {
+	UserID        string `json:"user_id"`
+	Tasks         int    `json:"tasks"`
+	OpsThisMinute int    `json:"ops_this_minute"` // only counted while MaxOpsPerMinute is set
+}
+
+// UsageReport is the reply to the "usage" op.
+type UsageReport struct {
+	Limits Limits  `json:"limits"`
+	Users  []Usage `json:"users"`
+}
+
+// opWindow counts a user's operations in the current one-minute window.
+type opWindow struct {
+	start time.Time
+	count int
+}
+
+// opCounter holds each user's current one-minute window. User IDs come from request
+// paths, so windows that have closed are dropped, at most once a minute.
+type opCounter struct {
+	windows   map[string]*opWindow
+	lastSweep time.Time
+}
+
+func newOpCounter() *opCounter {
+	return &opCounter{windows: make(map[string]*opWindow)}
+}
+
+// check counts one operation for user and fails once max is used up. With no limit,
+// max 0, nothing is counted.
+func (c *opCounter) check(user string, max int, now time.Time) error {
+	if max <= 0 {
+		return nil
+	}
+	if now.Sub(c.lastSweep) >= time.Minute {
+		for u, w := range c.windows {
+			if now.Sub(w.start) >= time.Minute {
+				delete(c.windows, u)
+			}
+		}
+		c.lastSweep = now
+	}
+	w := c.windows[user]
+	if w == nil || now.Sub(w.start) >= time.Minute {
+		w = &opWindow{start: now}
+		c.windows[user] = w
+	}
+	if w.count >= max {
+		return &QuotaError{UserID: user, Limit: "max_ops_per_minute", Max: max}
+	}
+	w.count++
+	return nil
+}
+
+// uncount takes back an operation check counted for user, for one another node serves.
+func (c *opCounter) uncount(user string, now time.Time) {
+	if w := c.windows[user]; w != nil && w.count > 0 && now.Sub(w.start) < time.Minute {
+		w.count--
+	}
+}
+
+// current is how many operations user has done in the window that is still open.
+func (c *opCounter) current(user string, now time.Time) int {
+	if w := c.windows[user]; w != nil && now.Sub(w.start) < time.Minute {
+		return w.count
+	}
+	return 0
+}
+
+// checkRate counts one operation for user and fails once the per-minute limit is used up.
+func (a *actorState) checkRate(user string, now time.Time) error {
+	return a.ops.check(user, a.cfg.Limits.MaxOpsPerMinute, now)
+}
+
+// checkCount fails when a user who already has count tasks may not add another.
+func (a *actorState) checkCount(user string, count int) error {
+	if max := a.cfg.Limits.MaxTasks; max > 0 && count >= max {
+		return &QuotaError{UserID: user, Limit: "max_tasks", Max: max}
+	}
+	return nil
+}
+
+// checkDescription fails when t's description is longer than allowed.
+func (a *actorState) checkDescription(user string, t ToDoTask) error {
+	if max := a.cfg.Limits.MaxDescriptionLen; max > 0 && utf8.RuneCountInString(t.Description) > max {
+		return &QuotaError{UserID: user, Limit: "max_description_len", Max: max}
+	}
+	return nil
+}
+
+// checkList validates a whole list that is about to replace the user's tasks.
+func (a *actorState) checkList(user string, tasks []ToDoTask) error {
+	if max := a.cfg.Limits.MaxTasks; max > 0 && len(tasks) > max {
+		return &QuotaError{UserID: user, Limit: "max_tasks", Max: max}
+	}
+	for _, t := range tasks {
+		if err := a.checkDescription(user, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *actorState) usage(now time.Time) (*UsageReport, error) {
+	report := &UsageReport{Limits: a.cfg.Limits}
+	seen := make(map[string]bool)
+	add := func(user string) error {
+		if seen[user] {
+			return nil
+		}
+		seen[user] = true
+		n, err := a.count(user)
+		if err != nil {
+			return err
+		}
+		report.Users = append(report.Users, Usage{UserID: user, Tasks: n, OpsThisMinute: a.ops.current(user, now)})
+		return nil
+	}
+	for user := range a.lists {
+		if err := add(user); err != nil {
+			return nil, err
+		}
+	}
+	if a.rows != nil {
+		users, err := a.rows.Users()
+		if err != nil {
+			slog.Error("usage: could not list users", "error", err)
+		}
+		for _, user := range users {
+			if err := add(user); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for user := range a.ops.windows {
+		if err := add(user); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(report.Users, func(i, j int) bool { return report.Users[i].UserID < report.Users[j].UserID })
+	return report, nil
+}
+
+// GetUsage asks the actor for every user's usage against the configured limits.
+func GetUsage(actor chan Request) (*UsageReport, error) {
+	reply := make(chan Response, 1)
+	actor <- Request{Op: "usage", ReplyCh: reply}
+	res := <-reply
+	return res.Usage, res.Err
+}
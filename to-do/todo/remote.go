@@ -0,0 +1,242 @@
+package todo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RemoteError is an error reply from the server, matched to the sentinel errors by its
+// Problem code (or HTTP status, if the reply was not a Problem) so callers handle it
+// like an error from a local actor. Rejected fields unwrap to ValidationErrors.
+type RemoteError struct {
+	Status  int
+	Code    string
+	Msg     string
+	TraceID string
+	Fields  []FieldProblem
+}
+
+func (e *RemoteError) Error() string {
+	if e.TraceID != "" {
+		return fmt.Sprintf("%s (trace %s)", e.Msg, e.TraceID)
+	}
+	return e.Msg
+}
+
+func (e *RemoteError) Is(target error) bool {
+	switch e.Code {
+	case CodeNotFound:
+		return target == ErrNotFound
+	case CodeInvalidInput, CodeUnsupportedMediaType, CodeTooLarge:
+		return target == ErrInvalidInput
+	case CodeConflict:
+		return target == ErrConflict
+	case CodeForbidden:
+		return target == ErrForbidden
+	case CodeQuotaExceeded:
+		return target == ErrQuotaExceeded
+	case CodeUnavailable, CodeNotLeader:
+		return target == ErrUnavailable
+	case CodeUnauthenticated:
+		return target == ErrUnauthenticated
+	case CodeInternal:
+		return target == ErrStorage
+	}
+	switch e.Status {
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusBadRequest, http.StatusUnsupportedMediaType, http.StatusRequestEntityTooLarge:
+		return target == ErrInvalidInput
+	case http.StatusConflict:
+		return target == ErrConflict
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	case http.StatusTooManyRequests:
+		return target == ErrQuotaExceeded
+	case http.StatusServiceUnavailable:
+		return target == ErrUnavailable
+	case http.StatusUnauthorized:
+		return target == ErrUnauthenticated
+	}
+	return target == ErrStorage
+}
+
+func (e *RemoteError) Unwrap() []error {
+	var errs []error
+	for _, f := range e.Fields {
+		errs = append(errs, &ValidationError{Field: f.Field, Reason: f.Reason})
+	}
+	return errs
+}
+
+// remote forwards actor requests to a server's API.
+type remote struct {
+	base   string
+	client *http.Client
+	bearer func() string // credentials for each request, "" for none
+}
+
+// RemoteActor serves requests by sending them to the todo server at base, e.g.
+// "http://localhost:8080", for a CLI or REPL whose data directory the server owns.
+// token, an API token or JWT, is sent with each request if set. Ops the API has no
+// route for fail with ErrConflict.
+func RemoteActor(base, token string) chan Request {
+	reqs := make(chan Request, 100)
+	c := &remote{base: strings.TrimRight(base, "/"), client: &http.Client{Timeout: 30 * time.Second}, bearer: func() string { return token }}
+	go func() {
+		for req := range reqs {
+			req.ReplyCh <- c.handle(req)
+		}
+	}()
+	return reqs
+}
+
+func (c *remote) handle(req Request) Response {
+	slog.Debug("remote: forwarding request", "op", req.Op, "user", req.UserID)
+	path := apiPath(req)
+	switch req.Op {
+	case "get", "add", "update":
+		method := http.MethodGet
+		var body io.Reader
+		if req.Op != "get" {
+			data, err := json.Marshal(req.Task)
+			if err != nil {
+				return Response{Err: err}
+			}
+			method, body = http.MethodPut, bytes.NewReader(data)
+			if req.Op == "add" {
+				method = http.MethodPost
+			}
+		}
+		var t ToDoTask
+		if err := c.call(method, path, "application/json", body, &t); err != nil {
+			return Response{Err: err}
+		}
+		return Response{Task: &t}
+	case "patch":
+		if req.Patch == nil {
+			return Response{Err: &ValidationError{Field: "patch", Reason: "missing"}}
+		}
+		// a JSON Patch, since only it carries the patch's tests
+		data, err := json.Marshal(req.Patch.Ops())
+		if err != nil {
+			return Response{Err: err}
+		}
+		var t ToDoTask
+		if err := c.call(http.MethodPatch, path, "application/json-patch+json", bytes.NewReader(data), &t); err != nil {
+			return Response{Err: err}
+		}
+		return Response{Task: &t}
+	case "list":
+		return c.list(req.UserID)
+	case "query":
+		// the API's cursors are its own, so page through the whole list here
+		resp := c.list(req.UserID)
+		if resp.Err != nil {
+			return resp
+		}
+		q := req.Query
+		if q == nil {
+			q = &Query{}
+		}
+		return Response{Page: q.run(resp.Tasks)}
+	case "delete":
+		if err := c.call(http.MethodDelete, path, "", nil, nil); err != nil {
+			return Response{Err: err}
+		}
+		return c.list(req.UserID)
+	case "append", "replace":
+		// the import route takes any export format, CSV carries both fields as they are
+		var buf bytes.Buffer
+		if err := Export(&buf, FormatCSV, req.Tasks); err != nil {
+			return Response{Err: err}
+		}
+		if err := c.call(http.MethodPost, path, ContentType(FormatCSV), &buf, nil); err != nil {
+			return Response{Err: err}
+		}
+		return c.list(req.UserID)
+	case "usage":
+		var report UsageReport
+		if err := c.call(http.MethodGet, path, "", nil, &report); err != nil {
+			return Response{Err: err}
+		}
+		return Response{Usage: &report}
+	case "flush":
+		// the server saves its own changes
+		return Response{}
+	}
+	return Response{Err: fmt.Errorf("%w: %q cannot be sent to the server at %s, stop it first", ErrConflict, req.Op, c.base)}
+}
+
+// apiPath is the API path that serves req, with its query string.
+func apiPath(req Request) string {
+	userPath := "/todo/users/" + url.PathEscape(req.UserID)
+	switch req.Op {
+	case "get", "update", "patch", "delete":
+		return fmt.Sprintf("%s/%d", userPath, req.Index)
+	case "append":
+		return userPath + "/import?format=" + FormatCSV
+	case "replace":
+		return userPath + "/import?format=" + FormatCSV + "&replace=true"
+	case "usage":
+		return "/admin/usage"
+	}
+	return userPath
+}
+
+func (c *remote) list(user string) Response {
+	var tasks []ToDoTask
+	if err := c.call(http.MethodGet, apiPath(Request{Op: "list", UserID: user}), "", nil, &tasks); err != nil {
+		return Response{Err: err}
+	}
+	return Response{Tasks: tasks}
+}
+
+// call sends one request and decodes a successful JSON reply into out, if not nil.
+func (c *remote) call(method, path, contentType string, body io.Reader, out any) error {
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.bearer != nil {
+		if token := c.bearer(); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: server at %s: %v", ErrStorage, c.base, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return decodeProblem(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%w: bad reply from %s: %v", ErrStorage, c.base, err)
+	}
+	return nil
+}
+
+// decodeProblem reads an error reply, a Problem from any current server.
+func decodeProblem(resp *http.Response) error {
+	var p Problem
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&p)
+	msg := p.Detail
+	if msg == "" {
+		msg = resp.Status
+	}
+	return &RemoteError{Status: resp.StatusCode, Code: p.Code, Msg: msg, TraceID: p.TraceID, Fields: p.Errors}
+}
@@ -0,0 +1,119 @@
+package todo
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// RowStore is implemented by stores that can answer queries and apply one change at a
+// time themselves, so the actor does not have to hold every user's list in memory.
+// Indexes are positions in the user's list, as with the in-memory lists. Get, UpdateAt
+// and DeleteAt return an *IndexError for a position that does not exist.
+type RowStore interface {
+	Store
+	Count(user string) (int, error)
+	Get(user string, index int) (ToDoTask, error)
+	Insert(user string, t ToDoTask) error
+	UpdateAt(user string, index int, t ToDoTask) error
+	DeleteAt(user string, index int) error
+}
+
+// Preload returns the lists the actor should start with. Stores the actor queries
+// directly (RowStore) are not read up front.
+func Preload(s Store) (map[string][]ToDoTask, error) {
+	if _, ok := s.(RowStore); ok {
+		return nil, nil
+	}
+	return LoadAll(s)
+}
+
+// handleRows serves a request straight from the RowStore.
+func (a *actorState) handleRows(req Request) Response {
+	user := req.UserID
+	switch req.Op {
+	case "get":
+		t, err := a.rows.Get(user, req.Index)
+		if err != nil {
+			return Response{Err: rowErr(user, err)}
+		}
+		return Response{Task: &t}
+	case "list":
+		tasks, err := a.rows.Load(user)
+		if err != nil {
+			return Response{Err: rowErr(user, err)}
+		}
+		return Response{Tasks: tasks}
+	case "add":
+		t := req.Task
+		if t.Status == "" {
+			t.Status = "not started"
+		}
+		if a.cfg.Limits.MaxTasks > 0 {
+			n, err := a.count(user)
+			if err != nil {
+				return Response{Err: err}
+			}
+			if err := a.checkCount(user, n); err != nil {
+				return Response{Err: err}
+			}
+		}
+		if err := a.checkDescription(user, t); err != nil {
+			return Response{Err: err}
+		}
+		if err := a.rows.Insert(user, t); err != nil {
+			return Response{Err: rowErr(user, err)}
+		}
+		return Response{Task: &t}
+	case "update":
+		if err := a.checkDescription(user, req.Task); err != nil {
+			return Response{Err: err}
+		}
+		if err := a.rows.UpdateAt(user, req.Index, req.Task); err != nil {
+			return Response{Err: rowErr(user, err)}
+		}
+		t := req.Task
+		return Response{Task: &t}
+	case "delete":
+		if err := a.rows.DeleteAt(user, req.Index); err != nil {
+			return Response{Err: rowErr(user, err)}
+		}
+		tasks, err := a.rows.Load(user)
+		if err != nil {
+			return Response{Err: rowErr(user, err)}
+		}
+		return Response{Tasks: tasks}
+	case "append":
+		tasks, err := a.rows.Load(user)
+		if err != nil {
+			return Response{Err: rowErr(user, err)}
+		}
+		next := append(tasks, req.Tasks...)
+		if err := a.checkList(user, next); err != nil {
+			return Response{Err: err}
+		}
+		if err := a.rows.Save(user, next); err != nil {
+			return Response{Err: rowErr(user, err)}
+		}
+		return Response{Tasks: next}
+	case "replace":
+		if err := a.checkList(user, req.Tasks); err != nil {
+			return Response{Err: err}
+		}
+		if err := a.rows.Save(user, req.Tasks); err != nil {
+			return Response{Err: rowErr(user, err)}
+		}
+		return Response{Tasks: append([]ToDoTask(nil), req.Tasks...)}
+	default:
+		return a.handleUnknown(req)
+	}
+}
+
+// rowErr passes domain errors through and wraps everything else as a storage failure.
+func rowErr(user string, err error) error {
+	var idx *IndexError
+	if errors.As(err, &idx) {
+		return err
+	}
+	slog.Error("actor: store request failed", "user", user, "error", err)
+	return &StorageError{UserID: user, Err: err}
+}
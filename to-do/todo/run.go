@@ -17,13 +17,13 @@ func InitLogwithTraceID() {
 	slog.SetDefault(logger.With("traceID", ctx.Value("traceID")))
 }
 
-func RunCLI(ctx context.Context, wg *sync.WaitGroup, actor chan Request) {
+func RunCLI(ctx context.Context, wg *sync.WaitGroup, actor chan Request, cfg Config) {
 	defer wg.Done()
 	InitLogwithTraceID()
 
-	err := Run(os.Args, actor)
+	err := RunWithConfig(os.Args, actor, cfg)
 	if err != nil {
-		slog.Error("not found", "error", err)
+		slog.Error("command failed", "error", err, "exitCode", ExitCode(err))
 		return
 	}
 	slog.Debug("runCLI goroutine waiting for context done")
@@ -32,34 +32,53 @@ func RunCLI(ctx context.Context, wg *sync.WaitGroup, actor chan Request) {
 
 }
 
+// Run runs one CLI invocation with the default configuration.
 func Run(args []string, actor chan Request) error {
+	return RunWithConfig(args, actor, DefaultConfig())
+}
+
+// RunWithConfig runs one CLI invocation. args[1] may name a subcommand (see commands),
+// which gets cfg for anything it needs beyond the actor, such as the data directory.
+func RunWithConfig(args []string, actor chan Request, cfg Config) error {
+	if len(args) > 1 {
+		if cmd, ok := commands[args[1]]; ok {
+			return cmd(args[2:], actor, cfg)
+		}
+	}
+
 	fs := flag.NewFlagSet("todo", flag.ContinueOnError)
 
 	var taskDesc = fs.String("task", "", "Task description e.g. -task=newItemDescription (optional -status=newStatus) (default not started))")
 	var status = fs.String("status", "", "New status e.g. not started, completed, started, etc.,")
-	var updateIndex = fs.Int("update", -1, "Index of task to update, e.g. update=0 -task=newValue (optional -status=newStatus)")
+	var updateIndex = fs.Int("update", -1, "Index of task to update, e.g. update=0 -task=newValue and/or -status=newStatus; fields not given are kept")
 	var deleteIndex = fs.Int("delete", -1, "Index of task to delete (e.g. delete=0 )")
 	var user = fs.String("user", "default", "User ID (required)")
-	fs.Parse(args[1:]) // skip program name
+	if err := fs.Parse(args[1:]); err != nil { // skip program name
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
 
 	slog.Debug("args", "deleteIndex", deleteIndex, "updateIndex", updateIndex, "status", status, "taskDesc", taskDesc)
 	switch {
 	case *updateIndex >= 0:
-		var t ToDoTask
-		if *status != "" {
-			t = ToDoTask{Description: *taskDesc, Status: *status}
-		} else {
-			t = ToDoTask{Description: *taskDesc, Status: "not started"}
+		// only the flags given change, so -update=0 -status=completed keeps the description
+		var p TaskPatch
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "task":
+				p.Description = taskDesc
+			case "status":
+				p.Status = status
+			}
+		})
+		if p.Description == nil && p.Status == nil {
+			return fmt.Errorf("%w: -update needs -task or -status", ErrInvalidInput)
 		}
-		reply := make(chan Response)
-		actor <- Request{Op: "update", UserID: *user, Task: t, Index: *updateIndex, ReplyCh: reply}
-		res := <-reply
-		slog.Debug("received actor response", "response", res)
-		if res.Err != nil {
-			slog.Error("Invalid task:", "index", *updateIndex)
-			return fmt.Errorf("404") //404 not found
+		t, err := PatchTask(actor, *user, *updateIndex, p)
+		if err != nil {
+			slog.Error("Invalid task:", "index", *updateIndex, "error", err)
+			return fmt.Errorf("update task %d: %w", *updateIndex, err)
 		}
-		slog.Info("Task updated", "Index", *updateIndex)
+		slog.Info("Task updated", "Index", *updateIndex, "task", t)
 		return nil
 
 	case *taskDesc != "":
@@ -75,8 +94,8 @@ func Run(args []string, actor chan Request) error {
 		res := <-reply
 		slog.Debug("received actor response", "response", res)
 		if res.Err != nil {
-			slog.Error("Invalid task:", "index", *updateIndex)
-			return fmt.Errorf("404") //404 not found
+			slog.Error("Invalid task:", "task", t, "error", res.Err)
+			return fmt.Errorf("add task: %w", res.Err)
 		}
 		slog.Info("Added new task", "task", t)
 		return nil
@@ -87,14 +106,17 @@ func Run(args []string, actor chan Request) error {
 		res := <-reply
 		slog.Debug("received actor response", "response", res)
 		if res.Err != nil {
-			slog.Error("Invalid task:", "index", *updateIndex)
-			return fmt.Errorf("404") //404 not found
+			slog.Error("Invalid task:", "index", *deleteIndex, "error", res.Err)
+			return fmt.Errorf("delete task %d: %w", *deleteIndex, res.Err)
 		}
 
 	default:
 		reply := make(chan Response)
 		actor <- Request{Op: "list", UserID: *user, ReplyCh: reply}
 		res := <-reply
+		if res.Err != nil {
+			return fmt.Errorf("list tasks: %w", res.Err)
+		}
 		slog.Info("received actor response", "response", res.Tasks)
 	}
 	return nil
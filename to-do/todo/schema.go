@@ -0,0 +1,184 @@
+package todo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CurrentSchemaVersion is the version of the user file format written by SaveFile.
+//
+//	1: a bare JSON array of tasks
+//	2: an envelope with schema_version, user, updated_at and tasks
+const CurrentSchemaVersion = 2
+
+// fileEnvelope is the on-disk form of a user file from schema version 2 on.
+// schema_version is kept first so peekVersion can read it from the file's first bytes.
+type fileEnvelope struct {
+	SchemaVersion int        `json:"schema_version"`
+	User          string     `json:"user,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	Tasks         []ToDoTask `json:"tasks"`
+}
+
+// Migration upgrades the raw contents of a user file from version From to From+1.
+type Migration struct {
+	From        int
+	Description string
+	Apply       func(raw []byte, user string) ([]byte, error)
+}
+
+// migrations is the registry run by decodeUserFile, one entry per version step.
+var migrations = []Migration{
+	{From: 1, Description: "wrap the bare task array in a versioned envelope", Apply: migrateV1ToV2},
+}
+
+func migrateV1ToV2(raw []byte, user string) ([]byte, error) {
+	var tasks []ToDoTask
+	if err := json.Unmarshal(raw, &tasks); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fileEnvelope{SchemaVersion: 2, User: user, Tasks: tasks})
+}
+
+// detectVersion reports the schema version of raw file contents.
+func detectVersion(raw []byte) (int, error) {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		return 1, nil
+	}
+	var head struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(trimmed, &head); err != nil {
+		return 0, err
+	}
+	if head.SchemaVersion < 2 {
+		return 0, fmt.Errorf("envelope without a valid schema_version")
+	}
+	return head.SchemaVersion, nil
+}
+
+// decodeUserFile runs every migration raw needs and returns its tasks and the version
+// it was stored as. Files newer than CurrentSchemaVersion are refused, not guessed at.
+func decodeUserFile(raw []byte, user string) ([]ToDoTask, int, error) {
+	from, err := detectVersion(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	if from > CurrentSchemaVersion {
+		return nil, from, fmt.Errorf("schema version %d is newer than supported version %d", from, CurrentSchemaVersion)
+	}
+	for v := from; v < CurrentSchemaVersion; v++ {
+		m, ok := migrationFrom(v)
+		if !ok {
+			return nil, from, fmt.Errorf("no migration from schema version %d", v)
+		}
+		if raw, err = m.Apply(raw, user); err != nil {
+			return nil, from, fmt.Errorf("migrate from version %d: %w", v, err)
+		}
+	}
+	var env fileEnvelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, from, err
+	}
+	return env.Tasks, from, nil
+}
+
+func migrationFrom(v int) (Migration, bool) {
+	for _, m := range migrations {
+		if m.From == v {
+			return m, true
+		}
+	}
+	return Migration{}, false
+}
+
+// encodeUserFile renders tasks in the current schema.
+func encodeUserFile(tasks []ToDoTask, user string) ([]byte, error) {
+	if tasks == nil {
+		tasks = []ToDoTask{}
+	}
+	return json.MarshalIndent(fileEnvelope{
+		SchemaVersion: CurrentSchemaVersion,
+		User:          user,
+		UpdatedAt:     time.Now().UTC(),
+		Tasks:         tasks,
+	}, "", "  ")
+}
+
+// readHead returns up to the first 64 bytes of path, or nil if it cannot be read.
+func readHead(path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	head := make([]byte, 64)
+	n, _ := io.ReadFull(f, head)
+	return head[:n]
+}
+
+// peekVersion reads just enough of an existing plaintext file to learn its schema
+// version. It returns 0 when the file does not exist, is encrypted (always the current
+// version) or cannot be recognised.
+func peekVersion(path string) int {
+	head := bytes.TrimSpace(readHead(path))
+	if len(head) > 0 && head[0] == '[' {
+		return 1
+	}
+	var v int
+	if _, err := fmt.Sscanf(string(bytes.Join(bytes.Fields(head), nil)), `{"schema_version":%d`, &v); err != nil {
+		return 0
+	}
+	return v
+}
+
+// backupOldVersion copies a file written in an older schema to <path>.v<N>.bak before it
+// is overwritten in the current one, encrypted when keys is set. An existing backup is
+// never replaced.
+func backupOldVersion(path string, keys *Keyring) error {
+	v := peekVersion(path)
+	if v == 0 || v >= CurrentSchemaVersion {
+		return nil
+	}
+	bak := fmt.Sprintf("%s.v%d%s", path, v, BackupSuffix)
+	if _, err := os.Stat(bak); err == nil {
+		return nil
+	}
+	if keys == nil {
+		return copyFile(path, bak)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sealed, err := keys.seal(raw, userForFile(path))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(bak, sealed, 0644)
+}
+
+// userForFile returns the user a task file belongs to, or "" for other file names.
+// Previous generations, <file>.bak and <file>.v<N>.bak, belong to the user of <file>.
+func userForFile(path string) string {
+	name := filepath.Base(path)
+	if trimmed, ok := strings.CutSuffix(name, BackupSuffix); ok {
+		name = trimmed
+		if i := strings.LastIndex(name, ".v"); i >= 0 && isDigits(name[i+2:]) {
+			name = name[:i]
+		}
+	}
+	user, _ := UserFromFile(name)
+	return user
+}
+
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
@@ -0,0 +1,374 @@
+package todo
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // pure-Go driver, no cgo needed
+)
+
+// SQLiteFile is the database file name used inside the data directory.
+const SQLiteFile = "todo.db"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	user_id    TEXT PRIMARY KEY,
+	created_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tasks (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id     TEXT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	position    INTEGER NOT NULL,
+	description TEXT NOT NULL,
+	status      TEXT NOT NULL,
+	created_at  INTEGER NOT NULL,
+	updated_at  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS tasks_user_position ON tasks(user_id, position);
+CREATE INDEX IF NOT EXISTS tasks_user_status ON tasks(user_id, status, position);
+CREATE INDEX IF NOT EXISTS tasks_user_updated ON tasks(user_id, updated_at);
+`
+
+// SQLiteStore keeps every user's tasks in one SQLite database. Timestamps are stored as
+// Unix nanoseconds. It is a RowStore, so the actor does not cache lists in memory.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLiteStore opens (creating if needed) the database at path.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// the actor is the only writer, one connection keeps SQLite's locking simple
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create schema in %s: %w", path, err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) Load(user string) ([]ToDoTask, error) {
+	rows, err := s.db.Query(`SELECT description, status FROM tasks WHERE user_id = ? ORDER BY position`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tasks []ToDoTask
+	for rows.Next() {
+		var t ToDoTask
+		if err := rows.Scan(&t.Description, &t.Status); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+// Save replaces the user's whole list in one transaction. Rows are kept where they can
+// be, so created_at survives: each task takes an unused row holding the same task, else
+// one with the same description, else a new row; rows left over are deleted.
+func (s *SQLiteStore) Save(user string, tasks []ToDoTask) error {
+	return s.tx(func(tx *sql.Tx) error {
+		now := time.Now().UnixNano()
+		if err := ensureUser(tx, user, now); err != nil {
+			return err
+		}
+		old, err := savedRows(tx, user)
+		if err != nil {
+			return err
+		}
+
+		rowFor := make([]int, len(tasks)) // index into old, -1 for a new row
+		for i := range rowFor {
+			rowFor[i] = -1
+		}
+		used := make([]bool, len(old))
+		match := func(same func(r savedRow, t ToDoTask) bool) {
+			for i, t := range tasks {
+				if rowFor[i] != -1 {
+					continue
+				}
+				for j, r := range old {
+					if !used[j] && same(r, t) {
+						rowFor[i], used[j] = j, true
+						break
+					}
+				}
+			}
+		}
+		match(func(r savedRow, t ToDoTask) bool { return r.task == t })
+		match(func(r savedRow, t ToDoTask) bool { return r.task.Description == t.Description })
+
+		for i, r := range old {
+			if !used[i] {
+				if _, err := tx.Exec(`DELETE FROM tasks WHERE id = ?`, r.id); err != nil {
+					return err
+				}
+			}
+		}
+		for i, t := range tasks {
+			if rowFor[i] == -1 {
+				if _, err := tx.Exec(`INSERT INTO tasks (user_id, position, description, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)`,
+					user, i, t.Description, t.Status, now, now); err != nil {
+					return err
+				}
+				continue
+			}
+			r := old[rowFor[i]]
+			switch {
+			case r.task != t:
+				_, err = tx.Exec(`UPDATE tasks SET position = ?, description = ?, status = ?, updated_at = ? WHERE id = ?`,
+					i, t.Description, t.Status, now, r.id)
+			case r.position != i:
+				_, err = tx.Exec(`UPDATE tasks SET position = ? WHERE id = ?`, i, r.id)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type savedRow struct {
+	id       int64
+	position int
+	task     ToDoTask
+}
+
+// savedRows returns the user's rows in list order.
+func savedRows(tx *sql.Tx, user string) ([]savedRow, error) {
+	rows, err := tx.Query(`SELECT id, position, description, status FROM tasks WHERE user_id = ? ORDER BY position`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var saved []savedRow
+	for rows.Next() {
+		var r savedRow
+		if err := rows.Scan(&r.id, &r.position, &r.task.Description, &r.task.Status); err != nil {
+			return nil, err
+		}
+		saved = append(saved, r)
+	}
+	return saved, rows.Err()
+}
+
+func (s *SQLiteStore) Users() ([]string, error) {
+	rows, err := s.db.Query(`SELECT user_id FROM users ORDER BY user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []string
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLiteStore) Delete(user string) error {
+	return s.tx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM tasks WHERE user_id = ?`, user); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM users WHERE user_id = ?`, user)
+		return err
+	})
+}
+
+func (s *SQLiteStore) Count(user string) (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM tasks WHERE user_id = ?`, user).Scan(&n)
+	return n, err
+}
+
+func (s *SQLiteStore) Get(user string, index int) (ToDoTask, error) {
+	var t ToDoTask
+	if index < 0 {
+		return t, indexError(s.db, user, index)
+	}
+	err := s.db.QueryRow(`SELECT description, status FROM tasks WHERE user_id = ? ORDER BY position LIMIT 1 OFFSET ?`, user, index).
+		Scan(&t.Description, &t.Status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, indexError(s.db, user, index)
+	}
+	return t, err
+}
+
+func (s *SQLiteStore) Insert(user string, t ToDoTask) error {
+	return s.tx(func(tx *sql.Tx) error {
+		now := time.Now().UnixNano()
+		if err := ensureUser(tx, user, now); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO tasks (user_id, position, description, status, created_at, updated_at)
+			VALUES (?, (SELECT COALESCE(MAX(position), -1) + 1 FROM tasks WHERE user_id = ?), ?, ?, ?, ?)`,
+			user, user, t.Description, t.Status, now, now)
+		return err
+	})
+}
+
+func (s *SQLiteStore) UpdateAt(user string, index int, t ToDoTask) error {
+	return s.tx(func(tx *sql.Tx) error {
+		id, err := idAt(tx, user, index)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE tasks SET description = ?, status = ?, updated_at = ? WHERE id = ?`,
+			t.Description, t.Status, time.Now().UnixNano(), id)
+		return err
+	})
+}
+
+func (s *SQLiteStore) DeleteAt(user string, index int) error {
+	return s.tx(func(tx *sql.Tx) error {
+		id, err := idAt(tx, user, index)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM tasks WHERE id = ?`, id)
+		return err
+	})
+}
+
+// idAt finds the row id of the task at the given list position.
+func idAt(tx *sql.Tx, user string, index int) (int64, error) {
+	var id int64
+	if index < 0 {
+		return 0, indexError(tx, user, index)
+	}
+	err := tx.QueryRow(`SELECT id FROM tasks WHERE user_id = ? ORDER BY position LIMIT 1 OFFSET ?`, user, index).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, indexError(tx, user, index)
+	}
+	return id, err
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// indexError builds the not-found error for index. q must be the transaction when
+// called inside one, since the store only has a single connection.
+func indexError(q queryRower, user string, index int) error {
+	var n int
+	q.QueryRow(`SELECT COUNT(*) FROM tasks WHERE user_id = ?`, user).Scan(&n)
+	return &IndexError{UserID: user, Index: index, Len: n}
+}
+
+func (s *SQLiteStore) tx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func ensureUser(tx *sql.Tx, user string, now int64) error {
+	_, err := tx.Exec(`INSERT INTO users (user_id, created_at) VALUES (?, ?) ON CONFLICT(user_id) DO NOTHING`, user, now)
+	return err
+}
+
+// Query pages through the user's tasks in the database. A status filter is answered from
+// the tasks_user_status index; the other filters are checked on the rows it returns.
+// PageKey.Row is the task's position, which deletes do not change.
+func (s *SQLiteStore) Query(user string, q Query) (*Page, error) {
+	where, args := `user_id = ?`, []any{user}
+	if len(q.Status) > 0 {
+		// statuses match loosely, so find the stored spellings of the wanted ones
+		stored, err := s.statuses(user)
+		if err != nil {
+			return nil, err
+		}
+		var in []string
+		for _, status := range stored {
+			if (&Query{Status: q.Status}).Match(ToDoTask{Status: status}) {
+				in = append(in, "?")
+				args = append(args, status)
+			}
+		}
+		if len(in) == 0 {
+			return newPage(), nil
+		}
+		where += ` AND status IN (` + strings.Join(in, ", ") + `)`
+	}
+	rows, err := s.db.Query(`SELECT position, description, status FROM tasks WHERE `+where+` ORDER BY position`, args...)
+	if err != nil {
+		return nil, err
+	}
+	page := newPage()
+	var positions []int64
+	for rows.Next() {
+		var t ToDoTask
+		var pos int64
+		if err := rows.Scan(&pos, &t.Description, &t.Status); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !q.Match(t) {
+			continue
+		}
+		page.Total++
+		if q.After != nil && pos <= q.After.Row {
+			continue
+		}
+		if page.add(&q, t, 0) {
+			positions = append(positions, pos)
+		} else if page.Next == nil {
+			page.Next = &PageKey{Row: positions[len(positions)-1]}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// only now, the store has a single connection
+	for i, pos := range positions {
+		if err := s.db.QueryRow(`SELECT COUNT(*) FROM tasks WHERE user_id = ? AND position < ?`, user, pos).Scan(&page.Indexes[i]); err != nil {
+			return nil, err
+		}
+	}
+	if page.Next != nil {
+		page.Next.Index = page.last()
+	}
+	return page, nil
+}
+
+// statuses returns the distinct statuses the user's tasks have.
+func (s *SQLiteStore) statuses(user string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT status FROM tasks WHERE user_id = ?`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var statuses []string
+	for rows.Next() {
+		var status string
+		if err := rows.Scan(&status); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, rows.Err()
+}
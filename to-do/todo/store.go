@@ -2,92 +2,226 @@ package todo
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/fs"
 	"log/slog"
 	"os"
-	"path/filepath"
-	"strings"
-	"sync"
 )
 
-func LoadFile(todoFile string) ([]ToDoTask, error) {
-	var tasks []ToDoTask
+// Store persists task lists, one list per user.
+type Store interface {
+	Load(user string) ([]ToDoTask, error)
+	Save(user string, tasks []ToDoTask) error
+	Users() ([]string, error)
+	Delete(user string) error
+}
 
-	file, err := os.Open(todoFile)
+// LoadAll reads every user's list from s.
+func LoadAll(s Store) (map[string][]ToDoTask, error) {
+	users, err := s.Users()
+	if err != nil {
+		return nil, err
+	}
+	lists := make(map[string][]ToDoTask, len(users))
+	for _, user := range users {
+		tasks, err := s.Load(user)
+		if err != nil {
+			return nil, fmt.Errorf("load user %q: %w", user, err)
+		}
+		lists[user] = tasks
+	}
+	return lists, nil
+}
+
+// JSONStore keeps each user's list in <Dir>/<user>_todo.json. With Keys set files are
+// written encrypted; plaintext files are still read and get encrypted on their next save.
+// Reads and writes hold the directory's store lock, so processes sharing Dir do not
+// interleave a save with another save or a read.
+type JSONStore struct {
+	Dir  string
+	Keys *Keyring
+}
+
+func (s *JSONStore) path(user string) string {
+	return Paths{Dir: s.Dir}.UserFile(user)
+}
+
+func (s *JSONStore) Load(user string) ([]ToDoTask, error) {
+	unlock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return loadFile(s.path(user), s.Keys)
+}
+
+func (s *JSONStore) Save(user string, tasks []ToDoTask) error {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return saveFile(tasks, s.path(user), s.Keys)
+}
+
+// Users lists the users with a file directly inside Dir.
+func (s *JSONStore) Users() ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return tasks, nil
+			return nil, nil
 		}
+		return nil, err
+	}
+	var users []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if user, ok := UserFromFile(e.Name()); ok {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (s *JSONStore) Delete(user string) error {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = os.Remove(s.path(user))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// LoadFile reads a task list. A missing file is an empty list. If the file is corrupt the
+// previous generation (todoFile+BackupSuffix) is used instead; if that is unusable too the
+// corrupt file is moved aside and an empty list is returned, so one bad file never stops
+// the other users from loading.
+func LoadFile(todoFile string) ([]ToDoTask, error) {
+	return loadFile(todoFile, nil)
+}
+
+func loadFile(todoFile string, keys *Keyring) ([]ToDoTask, error) {
+	tasks, err := readTasks(todoFile, keys)
+	if err == nil || os.IsNotExist(err) {
+		return tasks, nil
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, errDecrypt) {
 		slog.Error("Failed to open file", "error", err)
 		return nil, err
 	}
 
-	defer file.Close()
+	slog.Warn("corrupt task file, trying previous generation", "file", todoFile, "error", err)
+	if tasks, bakErr := readTasks(todoFile+BackupSuffix, keys); bakErr == nil {
+		// move the corrupt file aside, or the next save would keep it as the previous
+		// generation in place of the good one
+		moved, qerr := quarantine(todoFile)
+		if qerr != nil {
+			return nil, fmt.Errorf("corrupt %s could not be moved aside: %w", todoFile, qerr)
+		}
+		slog.Warn("recovered tasks from previous generation", "file", todoFile+BackupSuffix, "tasks", len(tasks), "movedTo", moved)
+		return tasks, nil
+	}
 
-	bytes, err := io.ReadAll(file)
+	moved, qerr := quarantine(todoFile)
+	if qerr != nil {
+		return nil, fmt.Errorf("corrupt %s and no usable backup: %w", todoFile, err)
+	}
+	slog.Error("corrupt task file has no usable backup, starting empty", "file", todoFile, "movedTo", moved)
+	return nil, nil
+}
+
+// readTasks reads, decrypts and decodes one task file, migrating it in memory to the
+// current schema, without any recovery.
+func readTasks(todoFile string, keys *Keyring) ([]ToDoTask, error) {
+	bytes, err := readPlain(todoFile, keys)
 	if err != nil {
 		return nil, err
 	}
 
-	err = json.Unmarshal(bytes, &tasks)
+	tasks, version, err := decodeUserFile(bytes, userForFile(todoFile))
 	if err != nil {
 		return nil, err
 	}
+	if version < CurrentSchemaVersion {
+		slog.Debug("migrated task file in memory", "file", todoFile, "from", version, "to", CurrentSchemaVersion)
+	}
 	return tasks, nil
 }
 
-func LoadAllTasksInDir(dir string) (map[string][]ToDoTask, error) {
-	lists := make(map[string][]ToDoTask)
-
-	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			return nil
-		}
-		name := d.Name()
-		if !strings.HasSuffix(name, "_"+TodoFile) {
-			return nil
-		}
-		// extract userID from filename: <user>_todo.json
-		user := strings.TrimSuffix(name, "_"+TodoFile)
-		slog.Info("file path", "path", path)
+// readPlain returns the contents of a task file, decrypted if it is encrypted.
+func readPlain(todoFile string, keys *Keyring) ([]byte, error) {
+	file, err := os.Open(todoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 
-		data, err := os.ReadFile(path)
-		if err != nil {
-			return fmt.Errorf("failed to read %s: %w", path, err)
-		}
-		var tasks []ToDoTask
-		if err := json.Unmarshal(data, &tasks); err != nil {
-			return fmt.Errorf("invalid JSON in %s: %w", path, err)
-		}
-		lists[user] = tasks
-		return nil
-	})
+	bytes, err := io.ReadAll(file)
 	if err != nil {
 		return nil, err
 	}
-	return lists, nil
+	if len(bytes) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if isEncrypted(bytes) {
+		return keys.open(bytes, userForFile(todoFile))
+	}
+	return bytes, nil
+}
+
+// LoadAllTasksInDir loads every <user>_todo.json directly inside dir. Subdirectories
+// are not searched.
+func LoadAllTasksInDir(dir string) (map[string][]ToDoTask, error) {
+	return LoadAll(&JSONStore{Dir: dir})
 }
 
+// SaveFile writes tasks to todoFile in the current schema, atomically and fsynced,
+// keeping the previous generation as todoFile+BackupSuffix.
 func SaveFile(tasks []ToDoTask, todoFile string) error {
-	var mu sync.RWMutex
-	mu.Lock()
-	defer mu.Unlock()
-	bytes, err := json.MarshalIndent(tasks, "", "  ")
+	return saveFile(tasks, todoFile, nil)
+}
+
+// saveFile is SaveFile, encrypting with the current key of keys when it is not nil.
+func saveFile(tasks []ToDoTask, todoFile string, keys *Keyring) error {
+	user := userForFile(todoFile)
+	bytes, err := encodeUserFile(tasks, user)
 	if err != nil {
 		slog.Error("Failed to marshall file ", "error", err)
 		return err
 	}
+	if keys != nil {
+		if bytes, err = keys.seal(bytes, user); err != nil {
+			slog.Error("Failed to encrypt file", "error", err)
+			return err
+		}
+	}
 
-	err = os.WriteFile(todoFile, bytes, 0644)
-	if err != nil {
+	// the first write in the current schema keeps the old version around for rollback
+	if err := backupOldVersion(todoFile, keys); err != nil {
+		slog.Error("Failed to back up old schema version", "file", todoFile, "error", err)
+		return err
+	}
+
+	stale := keys != nil && !keys.current(readHead(todoFile))
+	if err := writeFileAtomic(todoFile, bytes, 0644); err != nil {
 		slog.Error("Failed to write file ", "error", err)
 		return err
 	}
+	if stale {
+		// the previous generation is plaintext or under an old key, don't leave it behind
+		if err := keepPreviousGeneration(todoFile); err != nil {
+			slog.Warn("could not replace previous generation", "file", todoFile, "error", err)
+		}
+	}
 
 	return nil
 }
@@ -1,11 +1,19 @@
 package todo
 
 import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSaveAndLoadTasks(t *testing.T) {
-	tmpFile := "test_todo.json"
+	tmpFile := filepath.Join(t.TempDir(), "test_todo.json")
 	// The file does not existing
 	//	loaded, err := LoadFile(tmpFile)
 	//	if err != nil {
@@ -30,3 +38,757 @@ func TestSaveAndLoadTasks(t *testing.T) {
 	}
 
 }
+
+func TestStoreImplementations(t *testing.T) {
+	db, err := OpenSQLiteStore(filepath.Join(t.TempDir(), SQLiteFile))
+	if err != nil {
+		t.Fatalf("OpenSQLiteStore() error = %v", err)
+	}
+	defer db.Close()
+
+	bdb, err := OpenBoltStore(filepath.Join(t.TempDir(), BoltFile))
+	if err != nil {
+		t.Fatalf("OpenBoltStore() error = %v", err)
+	}
+	defer bdb.Close()
+
+	stores := map[string]Store{
+		"json":   &JSONStore{Dir: t.TempDir()},
+		"memory": NewMemStore(),
+		"log":    NewLogStore(t.TempDir(), 3),
+		"sqlite": db,
+		"bolt":   bdb,
+	}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			tasks := []ToDoTask{{Description: "one", Status: "started"}, {Description: "two", Status: "completed"}}
+			if err := s.Save("alice", tasks); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+			if err := s.Save("bob", nil); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+
+			lists, err := LoadAll(s)
+			if err != nil {
+				t.Fatalf("LoadAll() error = %v", err)
+			}
+			if len(lists) != 2 || !reflect.DeepEqual(lists["alice"], tasks) {
+				t.Errorf("LoadAll() = %+v", lists)
+			}
+
+			if err := s.Delete("alice"); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			users, err := s.Users()
+			if err != nil {
+				t.Fatalf("Users() error = %v", err)
+			}
+			if !reflect.DeepEqual(users, []string{"bob"}) {
+				t.Errorf("Users() after delete = %v, want [bob]", users)
+			}
+		})
+	}
+}
+
+func TestCorruptFileFallsBackToPreviousGeneration(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "crash_"+TodoFile)
+
+	if err := SaveFile([]ToDoTask{{Description: "first", Status: "started"}}, file); err != nil {
+		t.Fatalf("SaveFile() error = %v", err)
+	}
+	if err := SaveFile([]ToDoTask{{Description: "second", Status: "started"}}, file); err != nil {
+		t.Fatalf("SaveFile() error = %v", err)
+	}
+	// simulate a crash that left the current generation truncated
+	if err := os.WriteFile(file, []byte(`[{"description":"sec`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadFile(file)
+	if err != nil {
+		t.Fatalf("LoadFile() error = %v", err)
+	}
+	if len(loaded) != 1 || loaded[0].Description != "first" {
+		t.Errorf("expected previous generation [first], got %+v", loaded)
+	}
+	// the next save must not keep the corrupt file as the previous generation
+	if err := SaveFile(loaded, file); err != nil {
+		t.Fatalf("SaveFile() error = %v", err)
+	}
+	if bak, err := readTasks(file+BackupSuffix, nil); err != nil || len(bak) != 1 || bak[0].Description != "first" {
+		t.Errorf("backup after recovery = %+v, %v; want [first]", bak, err)
+	}
+
+	// with no usable backup the file is quarantined instead of failing the load
+	if err := os.WriteFile(file+BackupSuffix, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(`[{"description":"sec`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = LoadFile(file)
+	if err != nil || len(loaded) != 0 {
+		t.Fatalf("LoadFile() = %v, %v; want empty list and no error", loaded, err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("expected corrupt file to be moved aside, stat error = %v", err)
+	}
+}
+
+func TestLogStoreReplayAndCompaction(t *testing.T) {
+	dir := t.TempDir()
+	// a legacy JSON file is imported on first load
+	if err := SaveFile([]ToDoTask{{Description: "legacy", Status: "started"}}, filepath.Join(dir, "ann_"+TodoFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Store = NewLogStore(dir, 3)
+	lists, err := LoadAll(cfg.Store)
+	if err != nil {
+		t.Fatalf("LoadAll() error = %v", err)
+	}
+	reqs := make(chan Request)
+	go RunActor(reqs, lists, cfg)
+	for _, req := range []Request{
+		{Op: "add", Task: ToDoTask{Description: "a"}},
+		{Op: "add", Task: ToDoTask{Description: "b"}},
+		{Op: "update", Index: 0, Task: ToDoTask{Description: "legacy", Status: "completed"}},
+		{Op: "delete", Index: 1},
+	} {
+		req.UserID = "ann"
+		req.ReplyCh = make(chan Response, 1)
+		reqs <- req
+		if res := <-req.ReplyCh; res.Err != nil {
+			t.Fatalf("%s failed: %v", req.Op, res.Err)
+		}
+	}
+	close(reqs)
+
+	// three records triggered a compaction, so only the delete is left in the log and
+	// the rest were archived, where History still finds them
+	if live, err := NewLogStore(dir, 3).readLog("ann"); err != nil || len(live) != 1 || live[0].Op != "delete" {
+		t.Errorf("expected only the delete in the log, got %+v, %v", live, err)
+	}
+	history, err := NewLogStore(dir, 3).History("ann")
+	if err != nil {
+		t.Fatalf("History() error = %v", err)
+	}
+	var ops []string
+	for _, rec := range history {
+		ops = append(ops, rec.Op)
+	}
+	if want := []string{"add", "add", "update", "delete"}; !reflect.DeepEqual(ops, want) {
+		t.Errorf("History() ops = %v, want %v", ops, want)
+	}
+
+	// simulate a crash half way through an append
+	f, err := os.OpenFile(filepath.Join(dir, "ann"+logSuffix), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":9,"op":"add","ta`)
+	f.Close()
+
+	got, err := NewLogStore(dir, 3).Load("ann")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	want := []ToDoTask{{Description: "legacy", Status: "completed"}, {Description: "b", Status: "not started"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() = %+v, want %+v", got, want)
+	}
+
+	// Delete takes the archived segments with it
+	if err := NewLogStore(dir, 3).Delete("ann"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "ann.*")); len(left) != 0 {
+		t.Errorf("files left after Delete(): %v", left)
+	}
+}
+
+func TestRowStoresServeActor(t *testing.T) {
+	open := map[string]func(dir string) (RowStore, error){
+		"sqlite": func(dir string) (RowStore, error) { return OpenSQLiteStore(filepath.Join(dir, SQLiteFile)) },
+		"bolt":   func(dir string) (RowStore, error) { return OpenBoltStore(filepath.Join(dir, BoltFile)) },
+	}
+	for name, openStore := range open {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := SaveFile([]ToDoTask{{Description: "old", Status: "completed"}}, filepath.Join(dir, "bea_"+TodoFile)); err != nil {
+				t.Fatal(err)
+			}
+			store, err := openStore(dir)
+			if err != nil {
+				t.Fatalf("open %s store: %v", name, err)
+			}
+			defer store.(interface{ Close() error }).Close()
+
+			cfg := DefaultConfig()
+			cfg.Store = store
+			lists, err := Preload(store)
+			if err != nil || lists != nil {
+				t.Fatalf("Preload() = %v, %v; want nothing loaded for a RowStore", lists, err)
+			}
+			reqs := make(chan Request)
+			defer close(reqs)
+			go RunActor(reqs, lists, cfg)
+
+			if err := Run([]string{"todo", "import-json", "-from", dir}, reqs); err != nil {
+				t.Fatalf("import-json error = %v", err)
+			}
+			send := func(req Request) Response {
+				req.UserID = "bea"
+				req.ReplyCh = make(chan Response, 1)
+				reqs <- req
+				return <-req.ReplyCh
+			}
+			send(Request{Op: "add", Task: ToDoTask{Description: "a"}})
+			send(Request{Op: "add", Task: ToDoTask{Description: "b"}})
+			send(Request{Op: "update", Index: 1, Task: ToDoTask{Description: "a", Status: "started"}})
+			send(Request{Op: "delete", Index: 0})
+
+			res := send(Request{Op: "list"})
+			want := []ToDoTask{{Description: "a", Status: "started"}, {Description: "b", Status: "not started"}}
+			if !reflect.DeepEqual(res.Tasks, want) {
+				t.Errorf("list = %+v, want %+v", res.Tasks, want)
+			}
+			if res := send(Request{Op: "get", Index: 5}); !errors.Is(res.Err, ErrNotFound) {
+				t.Errorf("get out of range: expected ErrNotFound, got %v", res.Err)
+			}
+
+			// queries are answered by the store and page by key, so a delete between
+			// pages neither skips nor repeats a task
+			if _, ok := store.(Querier); !ok {
+				t.Fatalf("%s store is not a Querier", name)
+			}
+			send(Request{Op: "add", Task: ToDoTask{Description: "c"}})
+			send(Request{Op: "add", Task: ToDoTask{Description: "d", Status: "Not_Started"}})
+			query := func(after *PageKey) *Page {
+				res := send(Request{Op: "query", Query: &Query{Status: []string{"not started"}, Limit: 2, After: after}})
+				if res.Err != nil {
+					t.Fatalf("query error = %v", res.Err)
+				}
+				return res.Page
+			}
+			first := query(nil)
+			if !reflect.DeepEqual(first.Indexes, []int{1, 2}) || first.Total != 3 || first.Next == nil {
+				t.Fatalf("first page = %+v", first)
+			}
+			send(Request{Op: "delete", Index: 1})
+			second := query(first.Next)
+			if len(second.Tasks) != 1 || second.Tasks[0].Description != "d" || second.Indexes[0] != 2 || second.Next != nil {
+				t.Errorf("second page = %+v, want d at index 2", second)
+			}
+		})
+	}
+}
+
+// uncountedStore is a SQLiteStore that can't count a user's tasks.
+type uncountedStore struct{ *SQLiteStore }
+
+func (uncountedStore) Count(string) (int, error) { return 0, errors.New("disk unreadable") }
+
+func TestRowStoreCountErrorFailsAdd(t *testing.T) {
+	store, err := OpenSQLiteStore(filepath.Join(t.TempDir(), SQLiteFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Insert("dee", ToDoTask{Description: "a", Status: "not started"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Store = uncountedStore{store}
+	cfg.Limits.MaxTasks = 2
+	reqs := make(chan Request)
+	defer close(reqs)
+	go RunActor(reqs, nil, cfg)
+
+	// without a count the limit can't be checked, so the add must not go through
+	reply := make(chan Response, 1)
+	reqs <- Request{Op: "add", UserID: "dee", Task: ToDoTask{Description: "b"}, ReplyCh: reply}
+	if res := <-reply; !errors.Is(res.Err, ErrStorage) {
+		t.Errorf("add: expected ErrStorage, got %v", res.Err)
+	}
+	if n, err := store.Count("dee"); err != nil || n != 1 {
+		t.Errorf("Count() = %d, %v; want the add not stored", n, err)
+	}
+	if _, err := GetUsage(reqs); !errors.Is(err, ErrStorage) {
+		t.Errorf("GetUsage: expected ErrStorage, got %v", err)
+	}
+}
+
+func TestSQLiteSaveKeepsRows(t *testing.T) {
+	store, err := OpenSQLiteStore(filepath.Join(t.TempDir(), SQLiteFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	created := func() map[string]int64 {
+		rows, err := store.db.Query(`SELECT description, created_at FROM tasks WHERE user_id = 'cy'`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		m := map[string]int64{}
+		for rows.Next() {
+			var d string
+			var at int64
+			rows.Scan(&d, &at)
+			m[d] = at
+		}
+		return m
+	}
+
+	if err := store.Save("cy", []ToDoTask{{Description: "a", Status: "not started"}, {Description: "b", Status: "not started"}, {Description: "c", Status: "not started"}}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	before := created()
+	time.Sleep(time.Millisecond)
+	// drop a and complete c, which must update c's row rather than replace it
+	want := []ToDoTask{{Description: "b", Status: "not started"}, {Description: "c", Status: "completed"}}
+	if err := store.Save("cy", want); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if got, err := store.Load("cy"); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Load() = %+v, %v; want %+v", got, err, want)
+	}
+	after := created()
+	if len(after) != 2 || after["b"] != before["b"] || after["c"] != before["c"] {
+		t.Errorf("created_at before %v, after %v; want b and c kept and a deleted", before, after)
+	}
+
+	time.Sleep(time.Millisecond)
+	// replacing b with d is a new task, not an edit of b
+	want = []ToDoTask{{Description: "d", Status: "not started"}, {Description: "c", Status: "completed"}}
+	if err := store.Save("cy", want); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if got, err := store.Load("cy"); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Load() = %+v, %v; want %+v", got, err, want)
+	}
+	replaced := created()
+	if len(replaced) != 2 || replaced["d"] <= after["b"] || replaced["c"] != before["c"] {
+		t.Errorf("created_at before %v, after %v; want a new one for d and c kept", after, replaced)
+	}
+}
+
+func TestDataDirResolutionAndDiscovery(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", xdg)
+	t.Setenv("TODO_DATA_DIR", "")
+	if dir, err := ResolveDataDir(""); err != nil || dir != filepath.Join(xdg, "todo") {
+		t.Errorf("ResolveDataDir() with XDG = %q, %v", dir, err)
+	}
+	env := t.TempDir()
+	t.Setenv("TODO_DATA_DIR", env)
+	if dir, err := ResolveDataDir(""); err != nil || dir != env {
+		t.Errorf("ResolveDataDir() with TODO_DATA_DIR = %q, %v", dir, err)
+	}
+	flagDir := t.TempDir()
+	if dir, err := ResolveDataDir(flagDir); err != nil || dir != flagDir {
+		t.Errorf("ResolveDataDir(flag) = %q, %v", dir, err)
+	}
+
+	args, value := TakeDataDirFlag([]string{"todo", "-task=x", "--data-dir", "/d", "-status=done"})
+	if value != "/d" || !reflect.DeepEqual(args, []string{"todo", "-task=x", "-status=done"}) {
+		t.Errorf("TakeDataDirFlag() = %v, %q", args, value)
+	}
+
+	// files in subdirectories are not picked up
+	if err := SaveFile(nil, Paths{Dir: flagDir}.UserFile("top")); err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(flagDir, "fixtures"), 0o755)
+	if err := SaveFile(nil, Paths{Dir: filepath.Join(flagDir, "fixtures")}.UserFile("nested")); err != nil {
+		t.Fatal(err)
+	}
+	lists, err := LoadAllTasksInDir(flagDir)
+	if err != nil {
+		t.Fatalf("LoadAllTasksInDir() error = %v", err)
+	}
+	if _, ok := lists["nested"]; ok || len(lists) != 1 {
+		t.Errorf("expected only the top level user, got %v", lists)
+	}
+
+	if err := ValidateUserID("../etc"); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("ValidateUserID(../etc) = %v, want ErrInvalidInput", err)
+	}
+}
+
+func TestSchemaMigration(t *testing.T) {
+	dir := t.TempDir()
+	file := Paths{Dir: dir}.UserFile("old")
+	v1 := `[{"description":"legacy","status":"started"}]`
+	if err := os.WriteFile(file, []byte(v1), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := MigrateDir(&JSONStore{Dir: dir}, true)
+	if err != nil || len(report) != 1 || !strings.HasPrefix(report[0], "would migrate") {
+		t.Fatalf("MigrateDir(dry run) = %v, %v", report, err)
+	}
+	if raw, _ := os.ReadFile(file); string(raw) != v1 {
+		t.Fatalf("dry run changed the file: %s", raw)
+	}
+
+	// loading migrates in memory only
+	tasks, err := LoadFile(file)
+	if err != nil || len(tasks) != 1 || tasks[0].Description != "legacy" {
+		t.Fatalf("LoadFile(v1) = %+v, %v", tasks, err)
+	}
+
+	if _, err := MigrateDir(&JSONStore{Dir: dir}, false); err != nil {
+		t.Fatalf("MigrateDir() error = %v", err)
+	}
+	if v := peekVersion(file); v != CurrentSchemaVersion {
+		t.Errorf("expected file at version %d, got %d", CurrentSchemaVersion, v)
+	}
+	if raw, err := os.ReadFile(file + ".v1" + BackupSuffix); err != nil || string(raw) != v1 {
+		t.Errorf("expected v1 backup, got %q, %v", raw, err)
+	}
+	if tasks, err := LoadFile(file); err != nil || !reflect.DeepEqual(tasks, []ToDoTask{{Description: "legacy", Status: "started"}}) {
+		t.Errorf("LoadFile(v2) = %+v, %v", tasks, err)
+	}
+
+	if err := os.WriteFile(file, []byte(`{"schema_version": 99, "tasks": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFile(file); err == nil {
+		t.Errorf("expected an error for a newer schema version")
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, _ := NewKey()
+	newKey, _ := NewKey()
+	keys, err := ParseKeyring(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &JSONStore{Dir: dir, Keys: keys}
+	tasks := []ToDoTask{{Description: "call ACME Corp", Status: "started"}}
+
+	// a plaintext file is still read and encrypted on its next save, backup included
+	if err := SaveFile(tasks, store.path("enc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save("enc", tasks); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	for _, p := range []string{store.path("enc"), store.path("enc") + BackupSuffix} {
+		raw, _ := os.ReadFile(p)
+		if !isEncrypted(raw) || strings.Contains(string(raw), "ACME") {
+			t.Errorf("%s is not encrypted: %q", p, raw)
+		}
+	}
+	if got, err := store.Load("enc"); err != nil || !reflect.DeepEqual(got, tasks) {
+		t.Fatalf("Load() = %+v, %v", got, err)
+	}
+
+	// without a key the file is refused, never mistaken for a corrupt one
+	if _, err := LoadFile(store.path("enc")); err == nil {
+		t.Errorf("expected an error loading an encrypted file without a key")
+	}
+	// a damaged file is recovered from its previous generation like a corrupt plaintext one
+	if err := store.Save("enc", tasks); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	raw, _ := os.ReadFile(store.path("enc"))
+	raw[len(raw)-1] ^= 0xff
+	os.WriteFile(store.path("enc"), raw, 0600)
+	if got, err := store.Load("enc"); err != nil || !reflect.DeepEqual(got, tasks) {
+		t.Fatalf("Load() of a damaged file = %+v, %v; want the previous generation", got, err)
+	}
+	if err := store.Save("enc", tasks); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	// another user's file must not open as this user's
+	os.Rename(store.path("enc"), store.path("other"))
+	if _, err := readTasks(store.path("other"), keys); err == nil {
+		t.Errorf("expected a file moved between users to fail authentication")
+	}
+	os.Rename(store.path("other"), store.path("enc"))
+
+	// rotation: new key first, old key kept for reading
+	if store.Keys, err = ParseKeyring(newKey + "," + oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RotateKeys(store); err != nil {
+		t.Fatalf("RotateKeys() error = %v", err)
+	}
+	store.Keys, _ = ParseKeyring(newKey)
+	if got, err := store.Load("enc"); err != nil || !reflect.DeepEqual(got, tasks) {
+		t.Fatalf("Load() with only the new key = %+v, %v", got, err)
+	}
+
+	out := t.TempDir()
+	if n, err := DecryptTo(store, out, ""); err != nil || n != 1 {
+		t.Fatalf("DecryptTo() = %d, %v", n, err)
+	}
+	if got, err := LoadFile(Paths{Dir: out}.UserFile("enc")); err != nil || !reflect.DeepEqual(got, tasks) {
+		t.Errorf("decrypted export = %+v, %v", got, err)
+	}
+	if _, err := DecryptTo(store, dir, ""); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("expected exporting over the data directory to be refused, got %v", err)
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Store = &JSONStore{Dir: t.TempDir()}
+	reqs := make(chan Request)
+	defer close(reqs)
+	go RunActor(reqs, map[string][]ToDoTask{
+		"a": {{Description: "a1", Status: "started"}},
+		"b": {{Description: "b1", Status: "completed"}},
+	}, cfg)
+
+	path, err := Backup(reqs, t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	lists, manifest, err := ReadBackup(path, nil)
+	if err != nil || len(lists) != 2 || manifest.Users["a"] != 1 || manifest.SchemaVersion != CurrentSchemaVersion {
+		t.Fatalf("ReadBackup() = %+v, %+v, %v", lists, manifest, err)
+	}
+
+	Replace(reqs, "a", nil)
+	Replace(reqs, "b", nil)
+	if users, err := Restore(reqs, path, nil, "b"); err != nil || !reflect.DeepEqual(users, []string{"b"}) {
+		t.Fatalf("Restore(b) = %v, %v", users, err)
+	}
+	snap, _ := Snapshot(reqs)
+	if len(snap["a"]) != 0 || len(snap["b"]) != 1 {
+		t.Fatalf("after restoring b only got %+v", snap)
+	}
+	if _, err := Restore(reqs, path, nil, ""); err != nil {
+		t.Fatalf("Restore(all) error = %v", err)
+	}
+	if snap, _ = Snapshot(reqs); !reflect.DeepEqual(snap["a"], []ToDoTask{{Description: "a1", Status: "started"}}) {
+		t.Fatalf("after restoring all got %+v", snap)
+	}
+	if loaded, _ := cfg.Store.Load("a"); len(loaded) != 1 {
+		t.Errorf("restore was not persisted, store has %+v", loaded)
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	var names []string
+	// two backups an hour for the last 30 hours
+	for i := 0; i < 60; i++ {
+		at := base.Add(-time.Duration(i) * 30 * time.Minute)
+		name := backupPrefix + at.Format(backupTimeFormat) + backupSuffix
+		names = append(names, name)
+		os.WriteFile(filepath.Join(dir, name), nil, 0600)
+	}
+	removed, err := PruneBackups(dir, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	var kept []string
+	for _, e := range entries {
+		kept = append(kept, e.Name())
+	}
+	// newest of the 12, 11 and 10 o'clock hours, and the newest of the previous day
+	want := []string{names[0], names[1], names[3], names[25]}
+	sort.Strings(want)
+	if !reflect.DeepEqual(kept, want) || len(removed) != 56 {
+		t.Errorf("kept %v (removed %d), want %v", kept, len(removed), want)
+	}
+}
+
+func TestFormatsRoundTrip(t *testing.T) {
+	tasks := []ToDoTask{
+		{Description: "write report", Status: "not started"},
+		{Description: "call ACME, Inc; ask about \"invoice\"", Status: "completed"},
+		{Description: "review", Status: "started"},
+		{Description: "waiting on legal", Status: "on hold"},
+		{Description: strings.Repeat("long description ", 8), Status: "cancelled"},
+	}
+	for _, format := range Formats {
+		var buf bytes.Buffer
+		if err := Export(&buf, format, tasks); err != nil {
+			t.Fatalf("%s: Export() error = %v", format, err)
+		}
+		got, problems, err := ParseTasks(&buf, format)
+		if err != nil || len(problems) != 0 {
+			t.Fatalf("%s: ParseTasks() problems %v, error %v", format, problems, err)
+		}
+		if format != FormatCSV && format != FormatICal {
+			// the line based formats trim the trailing space of the long description
+			got[4].Description += " "
+		}
+		if !reflect.DeepEqual(got, tasks) {
+			t.Errorf("%s: round trip got %+v", format, got)
+		}
+	}
+
+	// foreign input: todo.txt dates and priorities, markdown noise, a bare VTODO
+	tests := []struct {
+		format, in string
+		want       []ToDoTask
+	}{
+		{FormatTodoTxt, "x 2026-01-02 2026-01-01 pay rent\n(A) 2026-01-01 file taxes +home\n", []ToDoTask{{"pay rent", "completed"}, {"(A) file taxes +home", "not started"}}},
+		{FormatMarkdown, "# Sprint\n\n* [X] ship it\n  - [ ] nested\n", []ToDoTask{{"ship it", "completed"}, {"nested", "not started"}}},
+		{FormatCSV, "Status,Description\ncompleted,a\n,b\n", []ToDoTask{{"a", "completed"}, {"b", "not started"}}},
+		{FormatICal, "BEGIN:VCALENDAR\r\nBEGIN:VTODO\r\nSUMMARY;LANGUAGE=en:fold\r\n ed\r\nSTATUS:IN-PROCESS\r\nEND:VTODO\r\nEND:VCALENDAR\r\n", []ToDoTask{{"folded", "started"}}},
+	}
+	for _, tt := range tests {
+		got, _, err := ParseTasks(strings.NewReader(tt.in), tt.format)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseTasks(%q) = %+v, %v", tt.format, tt.in, got, err)
+		}
+	}
+}
+
+func TestFsck(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("good_todo.json", `{"schema_version": 2, "user": "good", "tasks": [{"description": "fine", "status": "started"}]}`)
+	write("old_todo.json", `[{"description": "legacy", "status": "Done"}, {"description": " ", "status": "started"}, {"description": "odd", "status": "blocked"}]`)
+	write("broken_todo.json", `{"schema_version": 2, "tasks": [`)
+	write("future_todo.json", `{"schema_version": 9, "tasks": []}`)
+	write("other_todo.json", `{"schema_version": 2, "user": "someone", "tasks": []}`)
+	write("Good_todo.json", `[]`)
+	write("carol-todo.json", `[{"description": "x", "status": "completed"}]`)
+	write(".good_todo.json.tmp-123", `{`)
+
+	report, err := Fsck(dir, nil, false)
+	if err != nil {
+		t.Fatalf("Fsck() error = %v", err)
+	}
+	kinds := make(map[string]int)
+	for _, is := range report.Issues {
+		kinds[is.Kind]++
+		if is.Action != "" {
+			t.Errorf("check only run took action %q", is.Action)
+		}
+	}
+	want := map[string]int{
+		IssueSchemaVersion: 3, IssueEmptyDescription: 1, IssueUnknownStatus: 2, IssueInvalidJSON: 1,
+		IssueMisnamedFile: 2, IssueDuplicateUser: 2, IssueStrayTemp: 1,
+	}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("issues by kind = %v, want %v", kinds, want)
+	}
+
+	report, err = Fsck(dir, nil, true)
+	if err != nil {
+		t.Fatalf("Fsck(repair) error = %v", err)
+	}
+	// left for a person: the newer schema, the unknown "blocked" status and the case duplicates
+	if n := report.Unresolved(); n != 4 {
+		t.Errorf("expected 4 unresolved issues after repair, got %d: %+v", n, report.Issues)
+	}
+	if tasks, err := LoadFile(filepath.Join(dir, "old_todo.json")); err != nil ||
+		!reflect.DeepEqual(tasks, []ToDoTask{{"legacy", "completed"}, {"odd", "blocked"}}) {
+		t.Errorf("repaired old file = %+v, %v", tasks, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "broken_todo.json")); !os.IsNotExist(err) {
+		t.Errorf("expected the broken file to be quarantined")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "carol_todo.json")); err != nil {
+		t.Errorf("expected the misnamed file to be renamed: %v", err)
+	}
+	if _, err := LoadAllTasksInDir(dir); err == nil {
+		t.Errorf("expected the newer schema file to still stop a full load")
+	}
+}
+
+func TestClaimDir(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := ClaimDir(dir, Owner{Kind: OwnerREPL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ClaimDir(dir, Owner{Kind: OwnerServer, Addr: "http://localhost:8080"})
+	var inUse *InUseError
+	if !errors.As(err, &inUse) || !errors.Is(err, ErrConflict) {
+		t.Fatalf("second claim: expected an InUseError, got %v", err)
+	}
+	if inUse.Owner == nil || inUse.Owner.Kind != OwnerREPL || inUse.Owner.PID != os.Getpid() {
+		t.Errorf("owner = %+v, want this process's repl", inUse.Owner)
+	}
+	if err := runFsck([]string{"-repair", "-report", filepath.Join(t.TempDir(), "r.json")}, Config{DataDir: dir}); !errors.Is(err, ErrConflict) {
+		t.Errorf("fsck -repair while owned: expected ErrConflict, got %v", err)
+	}
+
+	lock.Release()
+	lock, err = ClaimDir(dir, Owner{Kind: OwnerServer})
+	if err != nil {
+		t.Fatalf("claim after release: %v", err)
+	}
+	lock.Release()
+}
+
+func TestTokensAndJWT(t *testing.T) {
+	dir := t.TempDir()
+	auth := NewAuthenticator(Config{DataDir: dir, Auth: AuthConfig{Mode: AuthRequired, JWTSecret: "s3cret"}})
+	secret, tok, err := auth.Tokens.Issue("andrew", "laptop", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := auth.Authenticate(secret); err != nil || *id != (Identity{User: "andrew", Via: "token"}) {
+		t.Errorf("token: %+v %v", id, err)
+	}
+	if _, err := auth.Authenticate(secret + "x"); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("wrong secret: expected ErrUnauthenticated, got %v", err)
+	}
+	if _, _, err := auth.Tokens.Issue("", "", false); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("issue without user: expected ErrInvalidInput, got %v", err)
+	}
+	// a second store on the same file, like the CLI next to a server
+	other := NewTokenStore(dir)
+	if list, err := other.List(); err != nil || len(list) != 1 || list[0].ID != tok.ID || list[0].Hash != "" {
+		t.Errorf("list: %+v %v", list, err)
+	}
+	if err := other.Revoke(tok.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Authenticate(secret); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("revoked token: expected ErrUnauthenticated, got %v", err)
+	}
+	if err := other.Revoke(tok.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("revoke twice: expected ErrNotFound, got %v", err)
+	}
+
+	now := time.Now()
+	sign := func(key string, c JWTClaims) string {
+		jwt, err := SignJWT([]byte(key), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jwt
+	}
+	jwt := sign("s3cret", JWTClaims{Subject: "root", Admin: true, ExpiresAt: now.Add(time.Minute).Unix()})
+	if id, err := auth.Authenticate(jwt); err != nil || *id != (Identity{User: "root", Admin: true, Via: "jwt"}) {
+		t.Errorf("jwt: %+v %v", id, err)
+	}
+	// andrew's signature on root's claims
+	user := strings.Split(sign("s3cret", JWTClaims{Subject: "andrew", ExpiresAt: now.Add(time.Minute).Unix()}), ".")
+	forged := strings.Join([]string{user[0], strings.Split(jwt, ".")[1], user[2]}, ".")
+	for name, token := range map[string]string{
+		"other key": sign("other", JWTClaims{Subject: "root", Admin: true, ExpiresAt: now.Add(time.Minute).Unix()}),
+		"expired":   sign("s3cret", JWTClaims{Subject: "root", ExpiresAt: now.Add(-time.Hour).Unix()}),
+		"no exp":    sign("s3cret", JWTClaims{Subject: "root"}),
+		"tampered":  forged,
+		"empty":     "",
+	} {
+		if _, err := auth.Authenticate(token); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("%s: expected ErrUnauthenticated, got %v", name, err)
+		}
+	}
+}
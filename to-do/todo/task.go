@@ -1,5 +1,12 @@
 package todo
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
 const TodoFile = "todo.json"
 
 type ToDoTask struct {
@@ -7,3 +14,24 @@ type ToDoTask struct {
 	Description string `json:"description"`
 	Status      string `json:"status"`
 }
+
+// ValidateTask checks a task sent by a client: it needs a description, and neither field
+// may hold control characters, which would break the line based export formats. An
+// empty status is allowed, the actor makes it "not started". Every problem is reported;
+// the error matches ErrInvalidInput.
+func ValidateTask(t ToDoTask) error {
+	var errs []error
+	if strings.TrimSpace(t.Description) == "" {
+		errs = append(errs, &ValidationError{Field: "description", Reason: "is required"})
+	}
+	errs = append(errs, checkText("description", t.Description), checkText("status", t.Status))
+	return errors.Join(errs...)
+}
+
+// checkText fails if s, the value of field, holds a control character.
+func checkText(field, s string) error {
+	if i := strings.IndexFunc(s, unicode.IsControl); i >= 0 {
+		return &ValidationError{Field: field, Reason: fmt.Sprintf("has a control character at byte %d", i)}
+	}
+	return nil
+}
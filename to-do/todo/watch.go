@@ -0,0 +1,155 @@
+package todo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Conflict policies applied when a user file changes on disk while the actor holds
+// unsaved changes for that user (write-behind mode only; durable mode never has any).
+const (
+	ConflictPreferDisk   = "prefer-disk"   // drop the unsaved changes and take the file
+	ConflictPreferMemory = "prefer-memory" // keep the unsaved changes, the next flush overwrites the file
+	ConflictKeepBoth     = "keep-both"     // keep memory and append the file's other tasks marked with ConflictMarker
+)
+
+// ConflictMarker prefixes the description of tasks kept from disk by ConflictKeepBoth.
+const ConflictMarker = "[conflict] "
+
+// fingerprint identifies a task list independently of how the file around it was written.
+func fingerprint(tasks []ToDoTask) string {
+	if tasks == nil {
+		tasks = []ToDoTask{}
+	}
+	data, _ := json.Marshal(tasks)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// handleReload re-reads the user's file after the watcher saw it change. A file whose
+// tasks match what the actor last wrote or read is the actor's own write and is ignored.
+func (a *actorState) handleReload(user string) Response {
+	js, ok := a.cfg.Store.(*JSONStore)
+	if !ok {
+		return Response{Err: fmt.Errorf("%w: reload needs the %s backend", ErrInvalidInput, BackendJSON)}
+	}
+	// no recovery here: a file caught half-way through an edit is retried on the next change
+	disk, err := readTasks(js.path(user), js.Keys)
+	if err != nil && !os.IsNotExist(err) {
+		slog.Warn("actor: skipping unreadable external edit", "user", user, "error", err)
+		return Response{Err: fmt.Errorf("%w: %v", ErrInvalidInput, err)}
+	}
+	sum := fingerprint(disk)
+	if sum == a.onDisk[user] {
+		return Response{Tasks: append([]ToDoTask(nil), a.lists[user]...)}
+	}
+	a.onDisk[user] = sum
+
+	if !a.dirty[user] {
+		slog.Info("actor: reloaded externally edited tasks", "user", user, "tasks", len(disk))
+		a.lists[user] = disk
+		return Response{Tasks: append([]ToDoTask(nil), disk...)}
+	}
+
+	mem := a.lists[user]
+	slog.Warn("actor: external edit conflicts with unsaved changes", "user", user, "policy", a.cfg.ConflictPolicy)
+	switch a.cfg.ConflictPolicy {
+	case ConflictPreferMemory:
+		// stays dirty, the next flush writes memory over the file
+	case ConflictKeepBoth:
+		merged := append([]ToDoTask(nil), mem...)
+		for _, t := range disk {
+			if !containsTask(mem, t) {
+				t.Description = ConflictMarker + t.Description
+				merged = append(merged, t)
+			}
+		}
+		a.lists[user] = merged
+	default: // ConflictPreferDisk
+		a.lists[user] = disk
+		delete(a.dirty, user)
+	}
+	return Response{Tasks: append([]ToDoTask(nil), a.lists[user]...)}
+}
+
+func containsTask(tasks []ToDoTask, t ToDoTask) bool {
+	for _, x := range tasks {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload asks the actor to pick up an external change to user's file.
+func Reload(actor chan Request, user string) ([]ToDoTask, error) {
+	reply := make(chan Response, 1)
+	actor <- Request{UserID: user, Op: "reload", ReplyCh: reply}
+	resp := <-reply
+	return resp.Tasks, resp.Err
+}
+
+// fileStamp is what the watcher compares between polls.
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+// WatchDir polls cfg's data directory every cfg.WatchInterval and sends a reload to the
+// actor for each user file that appeared or changed, until ctx is done. It only runs
+// for the json backend with a positive interval, and not in cluster mode, where changes
+// must go through the Raft log.
+func WatchDir(ctx context.Context, cfg Config, actor chan Request) {
+	if cfg.WatchInterval <= 0 || (cfg.Backend != BackendJSON && cfg.Backend != "") || cfg.Cluster.NodeID != "" {
+		return
+	}
+	dir := dataDir(cfg)
+	seen := scanUserFiles(dir)
+	ticker := time.NewTicker(cfg.WatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := scanUserFiles(dir)
+		for user, stamp := range now {
+			if old, ok := seen[user]; ok && old == stamp {
+				continue
+			}
+			slog.Debug("watch: user file changed", "user", user)
+			// an unreadable file is tried again when it next changes, e.g. when the editor finishes
+			Reload(actor, user)
+		}
+		seen = now
+	}
+}
+
+// scanUserFiles stamps every <user>_todo.json directly inside dir.
+func scanUserFiles(dir string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Warn("watch: cannot read data directory", "dir", dir, "error", err)
+		return stamps
+	}
+	for _, e := range entries {
+		user, ok := UserFromFile(e.Name())
+		if !ok || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		stamps[user] = fileStamp{mod: info.ModTime(), size: info.Size()}
+	}
+	return stamps
+}